@@ -17,17 +17,85 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+// DeletionPolicy selects what happens to bound HelxInsts when the HelxApp or
+// HelxUser they reference is deleted
+// +kubebuilder:validation:Enum=Delete;Orphan;Block
+type DeletionPolicy string
+
+const (
+	// DeletionPolicyDelete removes the bound instances and their derived objects
+	DeletionPolicyDelete DeletionPolicy = "Delete"
+	// DeletionPolicyOrphan leaves the bound instances and their derived objects in place
+	DeletionPolicyOrphan DeletionPolicy = "Orphan"
+	// DeletionPolicyBlock holds the deletion until no instances are bound
+	DeletionPolicyBlock DeletionPolicy = "Block"
+)
+
+// ResourcePolicy selects how HelxInst requests and limits are held to the
+// resourceBounds of the app's services
+// +kubebuilder:validation:Enum=Reject;Clamp;Default
+type ResourcePolicy string
+
+const (
+	// ResourcePolicyReject refuses to render an instance with a request or
+	// limit outside the bounds
+	ResourcePolicyReject ResourcePolicy = "Reject"
+	// ResourcePolicyClamp moves a request or limit outside the bounds to the
+	// nearest bound
+	ResourcePolicyClamp ResourcePolicy = "Clamp"
+	// ResourcePolicyDefault sets a missing request to min and a missing limit
+	// to max, and otherwise rejects like Reject
+	ResourcePolicyDefault ResourcePolicy = "Default"
+)
+
 // HelxAppSpec defines the desired state of HelxApp
 type HelxAppSpec struct {
 	AppClassName string    `json:"appClassName,omitempty"`
 	SourceText   string    `json:"sourceText,omitempty"`
 	Services     []Service `json:"services"`
+	// +kubebuilder:default=Delete
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// +kubebuilder:default=Reject
+	ResourcePolicy ResourcePolicy `json:"resourcePolicy,omitempty"`
+	Scheduling     `json:",inline"`
+	// Profiles are named hardware choices, e.g. gpu-small, that a HelxInst
+	// picks with spec.profile instead of spelling out its resources
+	Profiles map[string]HardwareProfile `json:"profiles,omitempty"`
+}
+
+// HardwareProfile is a set of per-service resources together with the
+// scheduling needed to find nodes that have them
+type HardwareProfile struct {
+	Description string `json:"description,omitempty"`
+	// Resources maps service names to requests and limits, as in HelxInst
+	// spec.resources; they must lie within the services' resourceBounds
+	Resources map[string]Resources `json:"resources,omitempty"`
+	// Scheduling is merged over the app's and under the instance's
+	Scheduling `json:",inline"`
+}
+
+// Scheduling places the instance pod on particular nodes. It is set on the
+// HelxApp and may be overridden per HelxInst
+type Scheduling struct {
+	// NodeSelector labels are merged, instance values winning
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Tolerations of the instance are added to the app's
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Affinity of the instance replaces the app's node, pod or pod
+	// anti-affinity, each on its own
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// TopologySpreadConstraints of the instance replace app constraints with
+	// the same topologyKey and are otherwise added
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint `json:"topologySpreadConstraints,omitempty"`
+	// PriorityClassName of the instance replaces the app's
+	PriorityClassName string `json:"priorityClassName,omitempty"`
 }
 
 // Service represents a single service in a HeLxApp
@@ -41,9 +109,109 @@ type Service struct {
 	ResourceBounds  map[string]ResourceBoundary `json:"resourceBounds,omitempty"`
 	SecurityContext *SecurityContext            `json:"securityContext,omitempty"`
 	Volumes         map[string]string           `json:"volumes,omitempty"`
+	// Activity lets the idle culler ask the service when it was last used
+	Activity *ActivityProbe `json:"activity,omitempty"`
+	// Env adds variables read from Secrets, ConfigMaps or pod fields;
+	// literal values go in Environment
+	Env []EnvVar `json:"env,omitempty"`
+	// EnvFrom adds every key of a Secret or ConfigMap as a variable
+	EnvFrom []EnvFromSource `json:"envFrom,omitempty"`
+	// LivenessProbe restarts the container when it fails
+	LivenessProbe *Probe `json:"livenessProbe,omitempty"`
+	// ReadinessProbe keeps the instance from reporting Ready until it passes
+	ReadinessProbe *Probe `json:"readinessProbe,omitempty"`
+	// StartupProbe holds off the other probes until a slow-starting app is up
+	StartupProbe *Probe `json:"startupProbe,omitempty"`
+	// ServiceType of the Service for Ports, ClusterIP when empty; the
+	// controller only renders the types its --allowed-service-types names
+	ServiceType ServiceType `json:"serviceType,omitempty"`
 }
 
-// ServicePort represents a single port for a service in a HeLxApp
+// EnvVar is an environment variable whose value is read when the container
+// starts. Secret and ConfigMap names may contain {{ .system.* }} expressions,
+// e.g. "{{ .system.UserName }}-credentials"
+type EnvVar struct {
+	Name      string       `json:"name"`
+	ValueFrom EnvVarSource `json:"valueFrom"`
+}
+
+// EnvVarSource selects where an EnvVar value comes from; exactly one is set
+type EnvVarSource struct {
+	SecretKeyRef    *KeySelector   `json:"secretKeyRef,omitempty"`
+	ConfigMapKeyRef *KeySelector   `json:"configMapKeyRef,omitempty"`
+	FieldRef        *FieldSelector `json:"fieldRef,omitempty"`
+}
+
+// KeySelector names a key of a Secret or ConfigMap in the instance namespace
+type KeySelector struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+	// Optional lets the container start when the object or key is missing
+	Optional bool `json:"optional,omitempty"`
+}
+
+// FieldSelector names a pod field, e.g. metadata.name or status.podIP
+type FieldSelector struct {
+	FieldPath string `json:"fieldPath"`
+}
+
+// EnvFromSource adds the keys of a Secret or ConfigMap as variables; exactly
+// one of secretRef and configMapRef is set
+type EnvFromSource struct {
+	// Prefix is prepended to every key
+	Prefix       string        `json:"prefix,omitempty"`
+	SecretRef    *EnvObjectRef `json:"secretRef,omitempty"`
+	ConfigMapRef *EnvObjectRef `json:"configMapRef,omitempty"`
+}
+
+// EnvObjectRef names a Secret or ConfigMap in the instance namespace
+type EnvObjectRef struct {
+	Name string `json:"name"`
+	// Optional lets the container start when the object is missing
+	Optional bool `json:"optional,omitempty"`
+}
+
+// Probe is a container probe; exactly one of exec, httpGet and tcpSocket is set.
+// Init services cannot have probes
+type Probe struct {
+	Exec                *ExecAction      `json:"exec,omitempty"`
+	HTTPGet             *HTTPGetAction   `json:"httpGet,omitempty"`
+	TCPSocket           *TCPSocketAction `json:"tcpSocket,omitempty"`
+	InitialDelaySeconds int32            `json:"initialDelaySeconds,omitempty"`
+	PeriodSeconds       int32            `json:"periodSeconds,omitempty"`
+	TimeoutSeconds      int32            `json:"timeoutSeconds,omitempty"`
+	FailureThreshold    int32            `json:"failureThreshold,omitempty"`
+}
+
+// ExecAction runs a command in the container; exit status 0 is success
+type ExecAction struct {
+	Command []string `json:"command"`
+}
+
+// HTTPGetAction requests a path on a container port; 2xx and 3xx are success
+type HTTPGetAction struct {
+	Path string `json:"path"`
+	Port int32  `json:"port"`
+	// +kubebuilder:validation:Enum=HTTP;HTTPS
+	Scheme      string            `json:"scheme,omitempty"`
+	HTTPHeaders map[string]string `json:"httpHeaders,omitempty"`
+}
+
+// TCPSocketAction opens a connection to a container port
+type TCPSocketAction struct {
+	Port int32 `json:"port"`
+}
+
+// ActivityProbe is an HTTP endpoint, reached through the generated Service,
+// whose JSON response carries a last_activity timestamp (Jupyter's /api/status)
+type ActivityProbe struct {
+	Path string `json:"path"`
+	// Port is the Service port to query; defaults to the first service port
+	Port int32 `json:"port,omitempty"`
+}
+
+// ResourceBoundary bounds one resource, e.g. cpu or memory, of a service's
+// requests and limits; either side may be omitted
 type ResourceBoundary struct {
 	Min string `json:"min,omitempty"`
 	Max string `json:"max,omitempty"`
@@ -53,8 +221,29 @@ type ResourceBoundary struct {
 type PortMap struct {
 	ContainerPort int32 `json:"containerPort"`
 	Port          int32 `json:"port,omitempty"`
+	// Name names the container port and the Service port that targets it;
+	// it defaults to port-<containerPort>
+	// +kubebuilder:validation:MaxLength=15
+	Name string `json:"name,omitempty"`
+	// Protocol defaults to TCP
+	// +kubebuilder:validation:Enum=TCP;UDP;SCTP
+	Protocol string `json:"protocol,omitempty"`
+	// AppProtocol is passed to the Service port, e.g. http or kubernetes.io/ws
+	AppProtocol string `json:"appProtocol,omitempty"`
 }
 
+// ServiceType selects how the Service for a service's ports is exposed.
+// Headless is a ClusterIP Service without a cluster IP
+// +kubebuilder:validation:Enum=ClusterIP;Headless;NodePort;LoadBalancer
+type ServiceType string
+
+const (
+	ServiceTypeClusterIP    ServiceType = "ClusterIP"
+	ServiceTypeHeadless     ServiceType = "Headless"
+	ServiceTypeNodePort     ServiceType = "NodePort"
+	ServiceTypeLoadBalancer ServiceType = "LoadBalancer"
+)
+
 type SecurityContext struct {
 	RunAsUser          *int64  `json:"runAsUser,omitempty"`
 	RunAsGroup         *int64  `json:"runAsGroup,omitempty"`
@@ -65,10 +254,20 @@ type SecurityContext struct {
 // HelxAppStatus defines the observed state of HelxApp
 type HelxAppStatus struct {
 	ObservedGeneration int64 `json:"observedGeneration"`
+	// Instances lists the namespaced names of the HelxInsts bound to this app
+	Instances     []string `json:"instances,omitempty"`
+	InstanceCount int      `json:"instanceCount"`
+	// Valid is true when every service passes a dry render
+	Valid            bool     `json:"valid"`
+	ValidationErrors []string `json:"validationErrors,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Class",type=string,JSONPath=`.spec.appClassName`
+// +kubebuilder:printcolumn:name="Instances",type=integer,JSONPath=`.status.instanceCount`
+// +kubebuilder:printcolumn:name="Valid",type=boolean,JSONPath=`.status.valid`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 // HelxApp is the Schema for the helxapps API
 type HelxApp struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -29,6 +29,27 @@ type HelxInstSpec struct {
 	SecurityContext *SecurityContext     `json:"securityContext,omitempty"`
 	Resources       map[string]Resources `json:"resources,omitempty"`
 	UserName        string               `json:"userName"`
+	// Suspended scales the Deployment to zero and removes the Services while
+	// keeping the PVCs and UUID; clearing it restores the workload
+	Suspended bool `json:"suspended,omitempty"`
+	// TTL deletes the instance this long after it was created
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+	// ExpiresAt deletes the instance at a fixed time; with TTL the earlier wins
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	// RestartedAt is copied to the pod template annotations; setting it to a
+	// new time rolls the pods without changing the UUID
+	RestartedAt *metav1.Time `json:"restartedAt,omitempty"`
+	// Env is added to every container after the app's own, replacing app
+	// entries of the same name in env or environment; the variables the
+	// controller sets, such as USER, cannot be overridden
+	Env []EnvVar `json:"env,omitempty"`
+	// EnvFrom is added to every container after the app's own
+	EnvFrom []EnvFromSource `json:"envFrom,omitempty"`
+	// Scheduling is merged over the app's scheduling
+	Scheduling `json:",inline"`
+	// Profile names one of the app's hardware profiles; its resources are
+	// used wherever Resources leaves a value out
+	Profile string `json:"profile,omitempty"`
 }
 
 // ServicePort represents a single port for a service in a HeLxApp
@@ -37,14 +58,107 @@ type Resources struct {
 	Limits   map[string]string `json:"limit,omitempty"`
 }
 
+// Condition types recorded in HelxInstStatus.Conditions, in the order the
+// reconciler evaluates them.
+const (
+	HelxInstConditionAppResolved  = "AppResolved"
+	HelxInstConditionUserResolved = "UserResolved"
+	HelxInstConditionRendered     = "Rendered"
+	HelxInstConditionApplied      = "Applied"
+	HelxInstConditionReady        = "Ready"
+	// HelxInstConditionExpiring is set only when the instance has a TTL or expiresAt
+	HelxInstConditionExpiring = "Expiring"
+	// HelxInstConditionQuotaExceeded is set only when the user has a quota
+	HelxInstConditionQuotaExceeded = "QuotaExceeded"
+	// HelxInstConditionResourcesBounded is set only when the app's services
+	// have resourceBounds
+	HelxInstConditionResourcesBounded = "ResourcesBounded"
+)
+
+// HelxInstPhase is a one-word summary of the HelxInst conditions
+type HelxInstPhase string
+
+const (
+	// HelxInstPhasePending means the app or user has not been found yet, or
+	// the instance would exceed its user's quota
+	HelxInstPhasePending HelxInstPhase = "Pending"
+	// HelxInstPhaseDeploying means the workload was applied but is not ready
+	HelxInstPhaseDeploying HelxInstPhase = "Deploying"
+	// HelxInstPhaseRunning means the workload is available
+	HelxInstPhaseRunning HelxInstPhase = "Running"
+	// HelxInstPhaseFailed means rendering or applying the workload failed, or
+	// the instance resources are outside the app's resourceBounds
+	HelxInstPhaseFailed HelxInstPhase = "Failed"
+	// HelxInstPhaseSuspended means the workload is scaled to zero by spec.suspended
+	HelxInstPhaseSuspended HelxInstPhase = "Suspended"
+)
+
+// HelxInstContainerStatus summarises one container of the instance's pod
+type HelxInstContainerStatus struct {
+	Name string `json:"name"`
+	// Init is true for an init container; init containers are listed first
+	Init         bool  `json:"init,omitempty"`
+	Ready        bool  `json:"ready"`
+	RestartCount int32 `json:"restartCount"`
+	// Reason the container is waiting or terminated, e.g. ImagePullBackOff or CrashLoopBackOff
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+// HelxInstEndpoint is an in-cluster address of one of the instance's Services
+type HelxInstEndpoint struct {
+	Service string `json:"service"`
+	// Container is the HelxApp service the Service was rendered for; the
+	// Service selects the instance's whole pod and reaches the container
+	// only through the named target port
+	Container string `json:"container,omitempty"`
+	// Name is the name of the Service port
+	Name     string `json:"name,omitempty"`
+	Host     string `json:"host"`
+	Port     int32  `json:"port"`
+	Protocol string `json:"protocol,omitempty"`
+}
+
 // HelxInstanceStatus defines the observed state of HelxInstance
 type HelxInstStatus struct {
-	ObservedGeneration int64  `json:"observedGeneration"`
-	UUID               string `json:"uuid,omitempty"`
+	ObservedGeneration int64         `json:"observedGeneration"`
+	UUID               string        `json:"uuid,omitempty"`
+	Phase              HelxInstPhase `json:"phase,omitempty"`
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// AvailableReplicas is summed over the instance's Deployments
+	AvailableReplicas int32 `json:"availableReplicas,omitempty"`
+	// PodName, PodPhase and PodIP describe the newest pod of the instance
+	PodName    string                    `json:"podName,omitempty"`
+	PodPhase   string                    `json:"podPhase,omitempty"`
+	PodIP      string                    `json:"podIP,omitempty"`
+	Containers []HelxInstContainerStatus `json:"containers,omitempty"`
+	// Endpoints lists the in-cluster addresses of the rendered Services
+	Endpoints []HelxInstEndpoint `json:"endpoints,omitempty"`
+	// ExpiresAt is the deadline resolved from spec.ttl and spec.expiresAt
+	ExpiresAt *metav1.Time `json:"expiresAt,omitempty"`
+	// LastActivity is the latest activity reported by the app's activity probes
+	LastActivity *metav1.Time `json:"lastActivity,omitempty"`
+	// LastRestartedAt is the spec.restartedAt last applied to the Deployment
+	LastRestartedAt *metav1.Time `json:"lastRestartedAt,omitempty"`
+	// Resources are the requests and limits rendered after the app's
+	// resourceBounds were applied; set only when the app has bounds
+	Resources map[string]Resources `json:"resources,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="App",type=string,JSONPath=`.spec.appName`
+// +kubebuilder:printcolumn:name="User",type=string,JSONPath=`.spec.userName`
+// +kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+// +kubebuilder:printcolumn:name="Rendered",type=string,JSONPath=`.status.conditions[?(@.type=="Rendered")].status`,priority=1
+// +kubebuilder:printcolumn:name="Applied",type=string,JSONPath=`.status.conditions[?(@.type=="Applied")].status`,priority=1
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Available",type=integer,JSONPath=`.status.availableReplicas`,priority=1
+// +kubebuilder:printcolumn:name="Pod IP",type=string,JSONPath=`.status.podIP`,priority=1
+// +kubebuilder:printcolumn:name="Expires",type=date,JSONPath=`.status.expiresAt`,priority=1
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 // HelxInstance is the Schema for the helxinstances API
 type HelxInst struct {
 	metav1.TypeMeta   `json:",inline"`
@@ -17,7 +17,9 @@ limitations under the License.
 package v1
 
 import (
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -30,6 +32,24 @@ type HelxUserSpec struct {
 
 	// Foo is an example field of HelxUser. Edit helxuser_types.go to remove/update
 	UserHandle *string `json:"userHandle,omitempty"`
+	// +kubebuilder:default=Delete
+	DeletionPolicy DeletionPolicy `json:"deletionPolicy,omitempty"`
+	// Quota limits the instances of this user; instances that would exceed it
+	// stay Pending and are not rendered
+	Quota *UserQuota `json:"quota,omitempty"`
+}
+
+// UserQuota bounds what all of a user's HelxInsts may use together. Unset
+// fields are unlimited.
+type UserQuota struct {
+	// MaxInstances counts instances that are not suspended
+	MaxInstances *int32 `json:"maxInstances,omitempty"`
+	// CPU and Memory bound the summed container requests of instances that
+	// are not suspended
+	CPU    *resource.Quantity `json:"cpu,omitempty"`
+	Memory *resource.Quantity `json:"memory,omitempty"`
+	// Storage bounds the summed size of the distinct PVCs of all instances
+	Storage *resource.Quantity `json:"storage,omitempty"`
 }
 
 // HelxUserStatus defines the observed state of HelxUser
@@ -37,10 +57,27 @@ type HelxUserStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 	ObservedGeneration int64 `json:"observedGeneration"`
+	// SecurityContext is the identity last resolved from the userHandle
+	SecurityContext *SecurityContext `json:"securityContext,omitempty"`
+	// UserInfo is the userHandle response the securityContext was resolved
+	// from, rendered as .system.UserInfo
+	//+kubebuilder:pruning:PreserveUnknownFields
+	UserInfo *runtime.RawExtension `json:"userInfo,omitempty"`
+	// LastLookupTime is when the userHandle last answered successfully
+	LastLookupTime *metav1.Time `json:"lastLookupTime,omitempty"`
+	// LastError is the error from the most recent lookup, if it failed
+	LastError string `json:"lastError,omitempty"`
+	// ActiveInstances counts the bound instances that are not suspended
+	ActiveInstances int `json:"activeInstances"`
 }
 
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="UID",type=integer,JSONPath=`.status.securityContext.runAsUser`
+//+kubebuilder:printcolumn:name="GID",type=integer,JSONPath=`.status.securityContext.runAsGroup`
+//+kubebuilder:printcolumn:name="Instances",type=integer,JSONPath=`.status.activeInstances`
+//+kubebuilder:printcolumn:name="Last Lookup",type=date,JSONPath=`.status.lastLookupTime`
+//+kubebuilder:printcolumn:name="Error",type=string,JSONPath=`.status.lastError`,priority=1
 
 // HelxUser is the Schema for the helxusers API
 type HelxUser struct {
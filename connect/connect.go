@@ -1,6 +1,7 @@
 package connect
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -9,8 +10,19 @@ import (
 
 // fetchData retrieves data from a given URL and returns a map that can be used with Go templates.
 func FetchData(url string) (map[string]interface{}, error) {
+	return FetchDataContext(context.Background(), url)
+}
+
+// FetchDataContext is FetchData bounded by ctx, so a caller can give up on a
+// slow endpoint.
+func FetchDataContext(ctx context.Context, url string) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching data: %w", err)
+	}
+
 	// Perform the HTTP GET request
-	resp, err := http.Get(url)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching data: %w", err)
 	}
@@ -1,10 +1,12 @@
 package connect
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestFetchData_Success(t *testing.T) {
@@ -75,3 +77,16 @@ func TestFetchData_EmptyJSONObject(t *testing.T) {
 		t.Errorf("expected empty map, got %v", data)
 	}
 }
+
+func TestFetchDataContext_Canceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := FetchDataContext(ctx, server.URL); err == nil {
+		t.Fatal("expected an error once the context is done")
+	}
+}
@@ -19,22 +19,39 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	helxv1 "github.com/helxplatform/helxapp-controller/api/v1"
 	"github.com/helxplatform/helxapp-controller/helxapp_operations"
 	"github.com/kr/pretty"
 )
 
+// deletionBlockedRetry is how soon a deletion held by the Block policy is
+// re-checked, in case an instance removal is missed
+const deletionBlockedRetry = time.Minute
+
 // HelxAppReconciler reconciles a HelxApp object
 type HelxAppReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme     *runtime.Scheme
+	Recorder   record.EventRecorder
+	Operations *helxapp_operations.Operations
+	// MaxConcurrentReconciles defaults to 1 when unset
+	MaxConcurrentReconciles int
 }
 
 //+kubebuilder:rbac:groups=helx.renci.org,namespace=jeffw,resources=helxapps,verbs=get;list;watch;create;update;patch;delete
@@ -52,57 +69,114 @@ type HelxAppReconciler struct {
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
 func (r *HelxAppReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
-	appName := req.NamespacedName.String()
 
 	// Fetch the HelxApp custom resource
 	helxApp := &helxv1.HelxApp{}
 	if err := r.Get(ctx, req.NamespacedName, helxApp); err != nil {
 		if errors.IsNotFound(err) {
-			// Resource is already deleted, return without error
+			// Resource is already deleted, return without error; bound
+			// instances were handled by the finalizer
 			logger.Info("HelxApp deleted", "NamespacedName", req.NamespacedName)
-			for _, inst := range helxapp_operations.DeleteApp(appName) {
-				if err := helxapp_operations.DeleteDerivatives(&inst, r.Client, req, ctx); err != nil {
-					logger.Error(err, "unable to delete derivatives")
-				}
-			}
 			return ctrl.Result{}, nil
 		}
 		logger.Error(err, "unable to fetch HelxApp", "NamespacedName", req.NamespacedName)
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	if !helxApp.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, req, helxApp)
+	}
+	if controllerutil.AddFinalizer(helxApp, helxapp_operations.Finalizer) {
+		if err := r.Update(ctx, helxApp); err != nil {
+			logger.Error(err, "unable to add finalizer", "NamespacedName", req.NamespacedName)
+			return ctrl.Result{}, err
+		}
+	}
+
 	// Check if this reconciliation needs to process changes or if it's a resync
 	if helxApp.Status.ObservedGeneration >= helxApp.Generation {
 		// No changes since last observation
 		logger.Info("No updates needed", "NamespacedName", req.NamespacedName)
-		helxapp_operations.AddApp(helxApp)
-		return ctrl.Result{}, nil
+		return ctrl.Result{}, r.updateStatus(ctx, helxApp, helxApp.Status.ObservedGeneration)
 	}
 
-	// Update observed generation after processing
-	defer func() {
-		helxApp.Status.ObservedGeneration = helxApp.Generation
-		if err := r.Status().Update(ctx, helxApp); err != nil {
-			logger.Error(err, "Failed to update HelxApp status", "NamespacedName", req.NamespacedName)
-		}
-	}()
-
-	// Log the event and custom resource content
+	// Log the event and custom resource content; bound instances are
+	// re-rendered by the HelxInst controller, which watches HelxApps
 	logger.Info("Reconciling HelxApp")
 	logger.V(1).Info(fmt.Sprintf("%# v\n", pretty.Formatter(helxApp)))
-	if instList := helxapp_operations.AddApp(helxApp); len(instList) != 0 {
-		for _, inst := range instList {
-			if err := helxapp_operations.CreateDerivatives(&inst, r.Client, r.Scheme, req, ctx); err != nil {
-				return ctrl.Result{}, err
-			}
-		}
+	return ctrl.Result{}, r.updateStatus(ctx, helxApp, helxApp.Generation)
+}
+
+// finalize applies the deletion policy to the instances bound to the app and
+// releases the finalizer once nothing holds the deletion.
+func (r *HelxAppReconciler) finalize(ctx context.Context, req ctrl.Request, helxApp *helxv1.HelxApp) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(helxApp, helxapp_operations.Finalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	appName := helxapp_operations.GetNamespacedName(helxApp)
+	insts, err := helxapp_operations.ListBoundInsts(ctx, r.Client, helxapp_operations.AppNameIndex, appName)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	blocked, err := r.Operations.FinalizeInsts(ctx, r.Client, r.Recorder, req, helxApp.Spec.DeletionPolicy,
+		"AppDeleted", fmt.Sprintf("HelxApp %s was deleted", appName), insts)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if blocked {
+		r.Recorder.Eventf(helxApp, corev1.EventTypeWarning, "DeletionBlocked", "%d HelxInsts still reference this app", len(insts))
+		return ctrl.Result{RequeueAfter: deletionBlockedRetry}, nil
+	}
+
+	controllerutil.RemoveFinalizer(helxApp, helxapp_operations.Finalizer)
+	return ctrl.Result{}, r.Update(ctx, helxApp)
+}
+
+// updateStatus refreshes the bound instances and the dry-render result and
+// writes the status back only when something changed.
+func (r *HelxAppReconciler) updateStatus(ctx context.Context, helxApp *helxv1.HelxApp, observedGeneration int64) error {
+	insts, err := helxapp_operations.ListBoundInsts(ctx, r.Client, helxapp_operations.AppNameIndex, helxapp_operations.GetNamespacedName(helxApp))
+	if err != nil {
+		return err
+	}
+	status := helxv1.HelxAppStatus{
+		ObservedGeneration: observedGeneration,
+		Instances:          helxapp_operations.InstNames(insts),
+		ValidationErrors:   helxapp_operations.ValidateApp(helxApp),
+	}
+	for _, err := range r.Operations.ValidateServiceTypes(helxApp) {
+		status.ValidationErrors = append(status.ValidationErrors, err.Error())
+	}
+	status.InstanceCount = len(status.Instances)
+	status.Valid = len(status.ValidationErrors) == 0
+
+	if equality.Semantic.DeepEqual(status, helxApp.Status) {
+		return nil
+	}
+	helxApp.Status = status
+	return r.Status().Update(ctx, helxApp)
+}
+
+// findAppForInst maps a HelxInst to the HelxApp it references so the app
+// status follows the instances bound to it.
+func (r *HelxAppReconciler) findAppForInst(obj client.Object) []reconcile.Request {
+	inst, ok := obj.(*helxv1.HelxInst)
+	if !ok {
+		return nil
+	}
+	appName := helxapp_operations.GetAppNameFromInst(inst)
+	if appName == "" {
+		return nil
 	}
-	return ctrl.Result{}, nil
+	return []reconcile.Request{{NamespacedName: helxapp_operations.ParseNamespacedName(appName)}}
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *HelxAppReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&helxv1.HelxApp{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		Watches(&source.Kind{Type: &helxv1.HelxInst{}}, handler.EnqueueRequestsFromMapFunc(r.findAppForInst)).
 		Complete(r)
 }
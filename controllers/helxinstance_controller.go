@@ -19,13 +19,28 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"time"
 
 	"github.com/google/uuid"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	helxv1 "github.com/helxplatform/helxapp-controller/api/v1"
 	"github.com/helxplatform/helxapp-controller/helxapp_operations"
@@ -35,12 +50,23 @@ import (
 // HelxInstanceReconciler reconciles a HelxInstance object
 type HelxInstReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme     *runtime.Scheme
+	Recorder   record.EventRecorder
+	Operations *helxapp_operations.Operations
+	// MaxConcurrentReconciles defaults to 1 when unset
+	MaxConcurrentReconciles int
+	// ExpiryWarning is how long before an instance's deadline the Expiring
+	// condition and warning Event are posted
+	ExpiryWarning time.Duration
 }
 
 //+kubebuilder:rbac:groups=helx.renci.org,namespace=jeffw,resources=helxinsts,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=helx.renci.org,namespace=jeffw,resources=helxinsts/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=helx.renci.org,namespace=jeffw,resources=helxinsts/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,namespace=jeffw,resources=events,verbs=create;patch
+//+kubebuilder:rbac:groups=core,namespace=jeffw,resources=pods,verbs=get;list;watch
+//+kubebuilder:rbac:groups=networking.k8s.io,namespace=jeffw,resources=ingresses,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=gateway.networking.k8s.io,namespace=jeffw,resources=httproutes,verbs=get;list;watch;create;update;patch;delete
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -51,52 +77,211 @@ type HelxInstReconciler struct {
 //
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.4/pkg/reconcile
-func (r *HelxInstReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+func (r *HelxInstReconciler) Reconcile(ctx context.Context, req ctrl.Request) (result ctrl.Result, err error) {
 	logger := log.FromContext(ctx)
-	instName := req.NamespacedName.String()
 
 	// Fetch the HelxInstance custom resource
 	helxInst := &helxv1.HelxInst{}
 	if err := r.Get(ctx, req.NamespacedName, helxInst); err != nil {
 		if errors.IsNotFound(err) {
-			// Resource is already deleted, return without error
+			// Resource is already deleted, return without error; derived
+			// objects are garbage-collected through their owner references
 			logger.Info("HelxInstance deleted", "NamespacedName", req.NamespacedName)
-			helxapp_operations.DeleteInst(instName)
 			return ctrl.Result{}, nil
 		}
 		logger.Error(err, "unable to fetch HelxInstance", "NamespacedName", req.NamespacedName)
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	// Check if this reconciliation needs to process changes or if it's a resync
-	if helxInst.Status.ObservedGeneration >= helxInst.Generation {
-		// No changes since last observation
-		logger.Info("No updates needed", "NamespacedName", req.NamespacedName)
-		helxapp_operations.AddInst(helxInst)
+	// There is no generation short-cut: an instance is re-rendered whenever it,
+	// its app or its user changes, and the status is written only on change
+	original := helxInst.DeepCopy()
+
+	// An expired instance is deleted; owned objects follow through garbage
+	// collection while retained ones, which have no owner reference, stay
+	expired, requeueAfter := helxapp_operations.ObserveExpiry(r.Recorder, helxInst, time.Now(), r.ExpiryWarning)
+	if expired {
+		logger.Info("HelxInstance expired", "NamespacedName", req.NamespacedName)
+		if err := r.Delete(ctx, helxInst); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
 		return ctrl.Result{}, nil
 	}
 
+	// The defaulting webhook pre-assigns the UUID as a label, so it survives
+	// a failed status update
 	if helxInst.Status.UUID == "" {
-		helxInst.Status.UUID = uuid.New().String()
+		if id := helxInst.Labels[helxapp_operations.IDLabel]; id != "" {
+			helxInst.Status.UUID = id
+		} else {
+			helxInst.Status.UUID = uuid.New().String()
+		}
 	}
-	// Update observed generation after processing
+	// Update observed generation after processing. The status is patched
+	// rather than replaced so that fields written concurrently by others,
+	// such as the idle culler's lastActivity, are not overwritten from this
+	// copy; a failed patch is returned so the request is retried.
 	defer func() {
 		helxInst.Status.ObservedGeneration = helxInst.Generation
-		if err := r.Status().Update(ctx, helxInst); err != nil {
-			logger.Error(err, "Failed to update HelxInstance status", "NamespacedName", req.NamespacedName)
+		if equality.Semantic.DeepEqual(original.Status, helxInst.Status) {
+			return
+		}
+		if patchErr := r.Status().Patch(ctx, helxInst, client.MergeFrom(original)); patchErr != nil {
+			logger.Error(patchErr, "Failed to update HelxInstance status", "NamespacedName", req.NamespacedName)
+			if err == nil {
+				err = patchErr
+			}
 		}
 	}()
 
 	// Log the event and custom resource content
 	logger.Info("Reconciling HelxInstance")
 	logger.V(1).Info(fmt.Sprintf("%# v\n", pretty.Formatter(helxInst)))
-	helxapp_operations.AddInst(helxInst)
-	return ctrl.Result{}, helxapp_operations.CreateDerivatives(helxInst, r.Client, r.Scheme, req, ctx)
+	return ctrl.Result{RequeueAfter: requeueAfter}, r.Operations.CreateDerivatives(helxInst, r.Client, r.Scheme, r.Recorder, req, ctx)
+}
+
+// requestsForIndex maps an object to the HelxInsts whose index value names it.
+func (r *HelxInstReconciler) requestsForIndex(index string, objName string) []reconcile.Request {
+	insts, err := helxapp_operations.ListBoundInsts(context.Background(), r.Client, index, objName)
+	if err != nil {
+		log.Log.Error(err, "unable to list bound instances", "index", index, "name", objName)
+		return nil
+	}
+
+	requests := make([]reconcile.Request, len(insts))
+	for i := range insts {
+		requests[i] = reconcile.Request{NamespacedName: types.NamespacedName{Namespace: insts[i].Namespace, Name: insts[i].Name}}
+	}
+	return requests
+}
+
+// findInstsForApp maps a HelxApp to the HelxInsts that reference it.
+func (r *HelxInstReconciler) findInstsForApp(obj client.Object) []reconcile.Request {
+	return r.requestsForIndex(helxapp_operations.AppNameIndex, helxapp_operations.GetNamespacedName(obj))
 }
 
-// SetupWithManager sets up the controller with the Manager.
+// findInstsForUser maps a HelxUser to the HelxInsts that reference it.
+func (r *HelxInstReconciler) findInstsForUser(obj client.Object) []reconcile.Request {
+	return r.requestsForIndex(helxapp_operations.UserNameIndex, helxapp_operations.GetNamespacedName(obj))
+}
+
+// findQuotaHeldSiblings maps a HelxInst to the other instances of the same
+// user that are held by the user's quota, so they are admitted as soon as
+// this one is suspended, shrunk, deleted or fails.
+func (r *HelxInstReconciler) findQuotaHeldSiblings(obj client.Object) []reconcile.Request {
+	userName := helxapp_operations.GetUserNameFromInst(obj.(*helxv1.HelxInst))
+	if userName == "" {
+		return nil
+	}
+	insts, err := helxapp_operations.ListBoundInsts(context.Background(), r.Client, helxapp_operations.UserNameIndex, userName)
+	if err != nil {
+		log.Log.Error(err, "unable to list bound instances", "index", helxapp_operations.UserNameIndex, "name", userName)
+		return nil
+	}
+
+	var requests []reconcile.Request
+	for i := range insts {
+		if insts[i].UID != obj.GetUID() && meta.IsStatusConditionTrue(insts[i].Status.Conditions, helxv1.HelxInstConditionQuotaExceeded) {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: insts[i].Namespace, Name: insts[i].Name}})
+		}
+	}
+	return requests
+}
+
+// findInstForRetained maps a retained derived object, which has no owner
+// reference, back to its HelxInst through the id label. Owned objects are
+// handled by Owns.
+func (r *HelxInstReconciler) findInstForRetained(obj client.Object) []reconcile.Request {
+	id := obj.GetLabels()[helxapp_operations.IDLabel]
+	if id == "" || !helxapp_operations.IsRetained(obj) {
+		return nil
+	}
+	return r.requestsForIndex(helxapp_operations.UUIDIndex, id)
+}
+
+// findInstForWorkload maps a pod or Deployment to its HelxInst through the id
+// label so that the workload state on the instance status stays current.
+func (r *HelxInstReconciler) findInstForWorkload(obj client.Object) []reconcile.Request {
+	id := obj.GetLabels()[helxapp_operations.IDLabel]
+	if id == "" {
+		return nil
+	}
+	return r.requestsForIndex(helxapp_operations.UUIDIndex, id)
+}
+
+// reconcileWorkload refreshes the pod, container and readiness state on the
+// status of the instance a pod or Deployment belongs to. Pod events and
+// Deployment status changes come through here rather than Reconcile, so they
+// do not re-render and re-apply the artifacts.
+func (r *HelxInstReconciler) reconcileWorkload(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	helxInst := &helxv1.HelxInst{}
+	if err := r.Get(ctx, req.NamespacedName, helxInst); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !helxInst.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+	original := helxInst.DeepCopy()
+	helxapp_operations.RefreshWorkload(ctx, r.Client, helxInst)
+	if equality.Semantic.DeepEqual(original.Status, helxInst.Status) {
+		return ctrl.Result{}, nil
+	}
+	return ctrl.Result{}, r.Status().Patch(ctx, helxInst, client.MergeFrom(original))
+}
+
+// renderedChanged passes Deployment events that touch what the render owns,
+// spec or metadata, and drops status-only updates such as replica counts.
+var renderedChanged = predicate.Or(predicate.GenerationChangedPredicate{}, predicate.LabelChangedPredicate{}, predicate.AnnotationChangedPredicate{})
+
+// SetupWithManager sets up the controller with the Manager. The field
+// indexes it relies on are registered by helxapp_operations.SetupIndexes.
+// Changes to derived objects re-run the render so that drift from the
+// rendered artifacts is repaired and deleted objects are recreated.
+// Pod events and Deployment status changes go to a separate
+// helxinst-workload controller that only refreshes the workload state on the
+// status; main caches only pods with the id label.
+// Ingresses are only watched when route classes are configured, so that
+// installs without them need no access to Ingresses, and HTTPRoutes only
+// when a route class renders them and the cluster serves the Gateway API.
 func (r *HelxInstReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	instBuilder := ctrl.NewControllerManagedBy(mgr).
 		For(&helxv1.HelxInst{}).
-		Complete(r)
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		Owns(&appsv1.Deployment{}, builder.WithPredicates(renderedChanged)).
+		Owns(&corev1.Service{}).
+		Owns(&corev1.PersistentVolumeClaim{}).
+		Watches(&source.Kind{Type: &appsv1.Deployment{}}, handler.EnqueueRequestsFromMapFunc(r.findInstForRetained), builder.WithPredicates(renderedChanged)).
+		Watches(&source.Kind{Type: &corev1.Service{}}, handler.EnqueueRequestsFromMapFunc(r.findInstForRetained)).
+		Watches(&source.Kind{Type: &corev1.PersistentVolumeClaim{}}, handler.EnqueueRequestsFromMapFunc(r.findInstForRetained)).
+		Watches(&source.Kind{Type: &helxv1.HelxInst{}}, handler.EnqueueRequestsFromMapFunc(r.findQuotaHeldSiblings)).
+		Watches(&source.Kind{Type: &helxv1.HelxApp{}}, handler.EnqueueRequestsFromMapFunc(r.findInstsForApp)).
+		Watches(&source.Kind{Type: &helxv1.HelxUser{}}, handler.EnqueueRequestsFromMapFunc(r.findInstsForUser))
+	if r.Operations != nil && len(r.Operations.RouteClasses) != 0 {
+		instBuilder = instBuilder.
+			Owns(&networkingv1.Ingress{}).
+			Watches(&source.Kind{Type: &networkingv1.Ingress{}}, handler.EnqueueRequestsFromMapFunc(r.findInstForRetained))
+	}
+	if r.Operations.UsesRouteKind(helxapp_operations.RouteKindHTTPRoute) {
+		gvk := helxapp_operations.HTTPRouteGVK
+		if _, err := mgr.GetRESTMapper().RESTMapping(gvk.GroupKind(), gvk.Version); meta.IsNoMatchError(err) {
+			mgr.GetLogger().Info("the Gateway API is not served, HTTPRoutes are not watched")
+		} else if err != nil {
+			return err
+		} else {
+			httpRoute := &unstructured.Unstructured{}
+			httpRoute.SetGroupVersionKind(gvk)
+			instBuilder = instBuilder.
+				Owns(httpRoute).
+				Watches(&source.Kind{Type: httpRoute}, handler.EnqueueRequestsFromMapFunc(r.findInstForRetained))
+		}
+	}
+	if err := instBuilder.Complete(r); err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("helxinst-workload").
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, handler.EnqueueRequestsFromMapFunc(r.findInstForWorkload)).
+		Watches(&source.Kind{Type: &appsv1.Deployment{}}, handler.EnqueueRequestsFromMapFunc(r.findInstForWorkload)).
+		Complete(reconcile.Func(r.reconcileWorkload))
 }
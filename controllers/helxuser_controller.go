@@ -18,23 +18,45 @@ package controllers
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	helxv1 "github.com/helxplatform/helxapp-controller/api/v1"
 	"github.com/helxplatform/helxapp-controller/helxapp_operations"
 	"github.com/kr/pretty"
 )
 
+const (
+	// userLookupInterval is how often a resolved identity is refreshed
+	userLookupInterval = 10 * time.Minute
+	// userLookupRetry is how soon a failed lookup is retried
+	userLookupRetry = time.Minute
+)
+
 // HelxUserReconciler reconciles a HelxUser object
 type HelxUserReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme     *runtime.Scheme
+	Recorder   record.EventRecorder
+	Operations *helxapp_operations.Operations
+	// MaxConcurrentReconciles defaults to 1 when unset
+	MaxConcurrentReconciles int
 }
 
 //+kubebuilder:rbac:groups=helx.renci.org,resources=helxusers,verbs=get;list;watch;create;update;patch;delete
@@ -52,57 +74,159 @@ type HelxUserReconciler struct {
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.14.1/pkg/reconcile
 func (r *HelxUserReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
-	userName := req.NamespacedName.String()
 
 	// Fetch the HelxApp custom resource
 	helxUser := &helxv1.HelxUser{}
 	if err := r.Get(ctx, req.NamespacedName, helxUser); err != nil {
 		if errors.IsNotFound(err) {
-			// Resource is already deleted, return without error
+			// Resource is already deleted, return without error; bound
+			// instances were handled by the finalizer
 			logger.Info("HelxUser deleted", "NamespacedName", req.NamespacedName)
-			for _, inst := range helxapp_operations.DeleteUser(userName) {
-				if err := helxapp_operations.DeleteDerivatives(&inst, r.Client, req, ctx); err != nil {
-					logger.Error(err, "unable to delete derivatives")
-				}
-			}
 			return ctrl.Result{}, nil
 		}
 		logger.Error(err, "unable to fetch HelxUser", "NamespacedName", req.NamespacedName)
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	if !helxUser.DeletionTimestamp.IsZero() {
+		return r.finalize(ctx, req, helxUser)
+	}
+	if controllerutil.AddFinalizer(helxUser, helxapp_operations.Finalizer) {
+		if err := r.Update(ctx, helxUser); err != nil {
+			logger.Error(err, "unable to add finalizer", "NamespacedName", req.NamespacedName)
+			return ctrl.Result{}, err
+		}
+	}
+
 	// Check if this reconciliation needs to process changes or if it's a resync
 	if helxUser.Status.ObservedGeneration >= helxUser.Generation {
 		// No changes since last observation
 		logger.Info("No updates needed", "NamespacedName", req.NamespacedName)
-		helxapp_operations.AddUser(helxUser)
-		return ctrl.Result{}, nil
+		return r.updateStatus(ctx, helxUser, helxUser.Status.ObservedGeneration)
 	}
 
-	// Update observed generation after processing
-	defer func() {
-		helxUser.Status.ObservedGeneration = helxUser.Generation
-		if err := r.Status().Update(ctx, helxUser); err != nil {
-			logger.Error(err, "Failed to update HelxUser status", "NamespacedName", req.NamespacedName)
-		}
-	}()
-
-	// Log the event and custom resource content
+	// Log the event and custom resource content; bound instances are
+	// re-rendered by the HelxInst controller, which watches HelxUsers
 	logger.Info("Reconciling HelxUser")
 	logger.V(1).Info(fmt.Sprintf("%# v\n", pretty.Formatter(helxUser)))
-	if instList := helxapp_operations.AddUser(helxUser); len(instList) != 0 {
-		for _, inst := range instList {
-			if err := helxapp_operations.CreateDerivatives(&inst, r.Client, r.Scheme, req, ctx); err != nil {
-				return ctrl.Result{}, err
+	return r.updateStatus(ctx, helxUser, helxUser.Generation)
+}
+
+// finalize applies the deletion policy to the instances bound to the user and
+// releases the finalizer once nothing holds the deletion.
+func (r *HelxUserReconciler) finalize(ctx context.Context, req ctrl.Request, helxUser *helxv1.HelxUser) (ctrl.Result, error) {
+	if !controllerutil.ContainsFinalizer(helxUser, helxapp_operations.Finalizer) {
+		return ctrl.Result{}, nil
+	}
+
+	userName := helxapp_operations.GetNamespacedName(helxUser)
+	insts, err := helxapp_operations.ListBoundInsts(ctx, r.Client, helxapp_operations.UserNameIndex, userName)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	blocked, err := r.Operations.FinalizeInsts(ctx, r.Client, r.Recorder, req, helxUser.Spec.DeletionPolicy,
+		"UserDeleted", fmt.Sprintf("HelxUser %s was deleted", userName), insts)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if blocked {
+		r.Recorder.Eventf(helxUser, corev1.EventTypeWarning, "DeletionBlocked", "%d HelxInsts still reference this user", len(insts))
+		return ctrl.Result{RequeueAfter: deletionBlockedRetry}, nil
+	}
+
+	controllerutil.RemoveFinalizer(helxUser, helxapp_operations.Finalizer)
+	return ctrl.Result{}, r.Update(ctx, helxUser)
+}
+
+// updateStatus refreshes the resolved identity when it is due and the active
+// instance count, writing the status back only when something changed. The
+// returned result requeues the next lookup.
+func (r *HelxUserReconciler) updateStatus(ctx context.Context, helxUser *helxv1.HelxUser, observedGeneration int64) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	status := *helxUser.Status.DeepCopy()
+	result := ctrl.Result{}
+
+	insts, err := helxapp_operations.ListBoundInsts(ctx, r.Client, helxapp_operations.UserNameIndex, helxapp_operations.GetNamespacedName(helxUser))
+	if err != nil {
+		return result, err
+	}
+
+	if helxUser.Spec.UserHandle == nil {
+		status.SecurityContext = nil
+		status.UserInfo = nil
+		status.LastLookupTime = nil
+		status.LastError = ""
+	} else {
+		due := observedGeneration != helxUser.Status.ObservedGeneration ||
+			status.LastError != "" ||
+			status.LastLookupTime == nil ||
+			time.Since(status.LastLookupTime.Time) >= userLookupInterval
+		if due {
+			if sc, info, err := helxapp_operations.ResolveUser(helxUser); err != nil {
+				logger.Error(err, "unable to resolve user identity", "userHandle", *helxUser.Spec.UserHandle)
+				if err.Error() != status.LastError {
+					r.recordLookupFailure(helxUser, insts, err)
+				}
+				status.LastError = err.Error()
+			} else {
+				now := metav1.Now()
+				status.SecurityContext = sc
+				if raw, err := json.Marshal(info); err == nil {
+					status.UserInfo = &runtime.RawExtension{Raw: raw}
+				}
+				status.LastLookupTime = &now
+				status.LastError = ""
 			}
 		}
+		if status.LastError != "" {
+			result.RequeueAfter = userLookupRetry
+		} else {
+			result.RequeueAfter = userLookupInterval - time.Since(status.LastLookupTime.Time)
+		}
+	}
+	status.ObservedGeneration = observedGeneration
+	status.ActiveInstances = 0
+	for _, inst := range insts {
+		if !inst.Spec.Suspended {
+			status.ActiveInstances++
+		}
+	}
+
+	if equality.Semantic.DeepEqual(status, helxUser.Status) {
+		return result, nil
+	}
+	helxUser.Status = status
+	return result, r.Status().Update(ctx, helxUser)
+}
+
+// recordLookupFailure reports a failed identity lookup on the HelxUser and on
+// every instance that renders with it.
+func (r *HelxUserReconciler) recordLookupFailure(helxUser *helxv1.HelxUser, insts []helxv1.HelxInst, lookupErr error) {
+	r.Recorder.Eventf(helxUser, corev1.EventTypeWarning, "UserLookupFailed", "unable to resolve identity from %s: %v", *helxUser.Spec.UserHandle, lookupErr)
+	for i := range insts {
+		r.Recorder.Eventf(&insts[i], corev1.EventTypeWarning, "UserLookupFailed", "unable to resolve identity for HelxUser %s: %v", helxUser.Name, lookupErr)
+	}
+}
+
+// findUserForInst maps a HelxInst to the HelxUser it references so the
+// active instance count stays current.
+func (r *HelxUserReconciler) findUserForInst(obj client.Object) []reconcile.Request {
+	inst, ok := obj.(*helxv1.HelxInst)
+	if !ok {
+		return nil
+	}
+	userName := helxapp_operations.GetUserNameFromInst(inst)
+	if userName == "" {
+		return nil
 	}
-	return ctrl.Result{}, nil
+	return []reconcile.Request{{NamespacedName: helxapp_operations.ParseNamespacedName(userName)}}
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *HelxUserReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&helxv1.HelxUser{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
+		Watches(&source.Kind{Type: &helxv1.HelxInst{}}, handler.EnqueueRequestsFromMapFunc(r.findUserForInst)).
 		Complete(r)
 }
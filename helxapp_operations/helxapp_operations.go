@@ -4,9 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
+	"time"
 
 	"github.com/go-logr/logr"
 	helxv1 "github.com/helxplatform/helxapp-controller/api/v1"
@@ -15,13 +20,48 @@ import (
 	"gomodules.xyz/jsonpatch/v2"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"k8s.io/apimachinery/pkg/util/yaml"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	sigsyaml "sigs.k8s.io/yaml"
+)
+
+// Finalizer holds HelxApps and HelxUsers until their bound instances have
+// been handled according to the deletion policy.
+const Finalizer = "helx.renci.org/finalizer"
+
+const (
+	// AppNameIndex indexes HelxInsts by the namespaced name of the HelxApp they reference
+	AppNameIndex = "spec.appName"
+	// UserNameIndex indexes HelxInsts by the namespaced name of the HelxUser they reference
+	UserNameIndex = "spec.userName"
+	// UUIDIndex indexes HelxInsts by the UUID stamped on their derived objects
+	UUIDIndex = "status.uuid"
+)
+
+const (
+	// IDLabel carries the owning HelxInst's UUID on every derived object, and
+	// on the HelxInst itself once the defaulting webhook has assigned it
+	IDLabel = "helx.renci.org/id"
+	// RetainLabel marks derived objects that outlive their HelxInst and so
+	// carry no owner reference
+	RetainLabel = "helx.renci.org/retain"
+	// ContainerLabel names the HelxApp service a rendered Service routes to
+	ContainerLabel = "helx.renci.org/container"
 )
 
 type RenderArtifact struct {
@@ -33,26 +73,30 @@ type Artifacts struct {
 	Deployment RenderArtifact
 	PVCs       map[string]RenderArtifact
 	Services   map[string]RenderArtifact
+	// Routes are the Ingresses or HTTPRoutes, keyed by name
+	Routes map[string]RenderArtifact
 }
 
-type InstTableElement struct {
-	Inst helxv1.HelxInst
+// Operations owns the parsed templates, the render scratch storage and the
+// loggers shared by the reconcilers. The templates record values into storage
+// while they render, so rendering is serialized by mu; everything else is
+// read-only after NewOperations and safe to use from concurrent reconciles.
+type Operations struct {
+	// AllowedServiceTypes are the service types apps may ask for; nil means
+	// DefaultServiceTypes
+	AllowedServiceTypes []helxv1.ServiceType
+	// RouteClasses are the route classes keyed by appClassName, with
+	// DefaultRouteClass as the fallback; nil renders no routes
+	RouteClasses map[string]RouteClass
+
+	mu                sync.Mutex
+	xformer           *template.Template
+	storage           map[string][]string
+	simpleDebugLogger func(string)
+	simpleInfoLogger  func(string)
+	simpleErrorLogger func(error, string)
 }
 
-type TableElement[T any] struct {
-	Obj     *T
-	InstSet map[string]bool
-}
-
-var appTable = make(map[string]TableElement[helxv1.HelxApp])
-var userTable = make(map[string]TableElement[helxv1.HelxUser])
-var instanceTable = make(map[string]InstTableElement)
-var xformer *template.Template
-var storage map[string][]string
-var simpleDebugLogger func(string)
-var simpleInfoLogger func(string)
-var simpleErrorLogger func(error, string)
-
 func newSimpleDebugLogger(logger logr.Logger) func(message string) {
 	return func(message string) {
 		logger.V(1).Info(message)
@@ -70,25 +114,29 @@ func newSimpleErrorLogger(logger logr.Logger) func(err error, message string) {
 	}
 }
 
-func Initalize(logger logr.Logger) error {
+// NewOperations parses the templates in templateDir and returns an
+// Operations that logs through logger.
+func NewOperations(logger logr.Logger, templateDir string) (*Operations, error) {
 	var err error
 
-	simpleDebugLogger = newSimpleDebugLogger(logger)
-	simpleInfoLogger = newSimpleInfoLogger(logger)
-	simpleErrorLogger = newSimpleErrorLogger(logger)
-	xformer, storage, err = template_io.ParseTemplates("templates", simpleDebugLogger)
+	o := &Operations{
+		simpleDebugLogger: newSimpleDebugLogger(logger),
+		simpleInfoLogger:  newSimpleInfoLogger(logger),
+		simpleErrorLogger: newSimpleErrorLogger(logger),
+	}
+	o.xformer, o.storage, err = template_io.ParseTemplates(templateDir, o.simpleDebugLogger)
 	if err != nil {
-		simpleErrorLogger(err, "failed to initialize xformer template")
-		return err
-	} else {
-		simpleInfoLogger("helxapp_operations initialized")
-		return nil
+		o.simpleErrorLogger(err, "failed to initialize xformer template")
+		return nil, err
 	}
+	o.simpleInfoLogger("helxapp_operations initialized")
+	return o, nil
 }
 
-func clearStorage() {
-	for k := range storage {
-		delete(storage, k)
+// clearStorage empties the render scratch storage; callers must hold o.mu.
+func (o *Operations) clearStorage() {
+	for k := range o.storage {
+		delete(o.storage, k)
 	}
 }
 
@@ -120,154 +168,166 @@ func GetUserNameFromInst(inst *helxv1.HelxInst) string {
 	}
 }
 
-func addInstToMap(m map[string]InstTableElement, instName string, inst *helxv1.HelxInst) {
-	simpleDebugLogger(fmt.Sprintf("storing Inst using name '%s'", instName))
-	m[instName] = InstTableElement{Inst: *inst}
+// ParseNamespacedName splits a "namespace/name" string as produced by
+// GetNamespacedName.
+func ParseNamespacedName(name string) types.NamespacedName {
+	if parts := strings.SplitN(name, "/", 2); len(parts) == 2 {
+		return types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+	}
+	return types.NamespacedName{Name: name}
 }
 
-// AddToMap adds the given HelxAppSpec instance to the map
-func addObjToMap[T any](m map[string]TableElement[T], objName string, obj *T) []helxv1.HelxInst {
-	var instNames []string
-	var instList []helxv1.HelxInst
-
-	simpleDebugLogger(fmt.Sprintf("storing Object using name '%s'", objName))
-	if element, found := m[objName]; !found {
-		element = TableElement[T]{Obj: obj, InstSet: make(map[string]bool)}
-		m[objName] = element
-	} else {
-		element.Obj = obj
-		m[objName] = element
-		for k := range element.InstSet {
-			instNames = append(instNames, k)
-		}
+// IndexInstByApp is the field indexer behind AppNameIndex.
+func IndexInstByApp(obj client.Object) []string {
+	if appName := GetAppNameFromInst(obj.(*helxv1.HelxInst)); appName != "" {
+		return []string{appName}
 	}
+	return nil
+}
 
-	for _, instName := range instNames {
-		if element, found := instanceTable[instName]; found {
-			instList = append(instList, element.Inst)
-		}
+// IndexInstByUser is the field indexer behind UserNameIndex.
+func IndexInstByUser(obj client.Object) []string {
+	if userName := GetUserNameFromInst(obj.(*helxv1.HelxInst)); userName != "" {
+		return []string{userName}
 	}
-	return instList
+	return nil
 }
 
-// AddToMap adds the given HelxAppSpec instance to the map
-func connectObj[T any](m map[string]TableElement[T], objName string, instName string) {
-	simpleDebugLogger(fmt.Sprintf("associating '%s' and '%s'", objName, instName))
-	if element, found := m[objName]; !found {
-		element = TableElement[T]{Obj: nil, InstSet: make(map[string]bool)}
-		element.InstSet[instName] = true
-		m[objName] = element
-	} else {
-		element.InstSet[instName] = true
+// IndexInstByUUID is the field indexer behind UUIDIndex.
+func IndexInstByUUID(obj client.Object) []string {
+	if uuid := obj.(*helxv1.HelxInst).Status.UUID; uuid != "" {
+		return []string{uuid}
 	}
+	return nil
 }
 
-func AddApp(app *helxv1.HelxApp) []helxv1.HelxInst {
-	appName := GetNamespacedName(app)
-
-	return addObjToMap[helxv1.HelxApp](appTable, appName, app)
+// SetupIndexes registers the HelxInst field indexes with the manager cache.
+// It must run before the reconcilers start.
+func SetupIndexes(ctx context.Context, indexer client.FieldIndexer) error {
+	if err := indexer.IndexField(ctx, &helxv1.HelxInst{}, AppNameIndex, IndexInstByApp); err != nil {
+		return err
+	}
+	if err := indexer.IndexField(ctx, &helxv1.HelxInst{}, UserNameIndex, IndexInstByUser); err != nil {
+		return err
+	}
+	return indexer.IndexField(ctx, &helxv1.HelxInst{}, UUIDIndex, IndexInstByUUID)
 }
 
-func AddInst(inst *helxv1.HelxInst) {
-	appName := GetAppNameFromInst(inst)
-	instName := GetNamespacedName(inst)
-	userName := GetUserNameFromInst(inst)
-
-	addInstToMap(instanceTable, instName, inst)
-	connectObj(appTable, appName, instName)
-	connectObj(userTable, userName, instName)
+// IsRetained reports whether a derived object carries the retain label.
+func IsRetained(obj client.Object) bool {
+	return obj.GetLabels()[RetainLabel] == "true"
 }
 
-func AddUser(user *helxv1.HelxUser) []helxv1.HelxInst {
-	userName := GetNamespacedName(user)
-
-	return addObjToMap[helxv1.HelxUser](userTable, userName, user)
+// getObj fetches the named object, reporting false when it does not exist.
+func getObj(ctx context.Context, c client.Client, objName string, obj client.Object) (bool, error) {
+	if err := c.Get(ctx, ParseNamespacedName(objName), obj); err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
 }
 
-func GetInstFromMap(m map[string]InstTableElement, appName string) (helxv1.HelxInst, bool) {
-	if value, found := m[appName]; found {
-		return value.Inst, found
-	} else {
-		return helxv1.HelxInst{}, false
+// GetApp fetches the named HelxApp, returning nil when it does not exist.
+func GetApp(ctx context.Context, c client.Client, appName string) (*helxv1.HelxApp, error) {
+	app := &helxv1.HelxApp{}
+	if found, err := getObj(ctx, c, appName, app); !found {
+		return nil, err
 	}
+	return app, nil
 }
 
-func GetObjFromMap[T any](m map[string]TableElement[T], objName string) *T {
-	if value, found := m[objName]; found {
-		return value.Obj
-	} else {
-		return nil
+// GetUser fetches the named HelxUser, returning nil when it does not exist.
+func GetUser(ctx context.Context, c client.Client, userName string) (*helxv1.HelxUser, error) {
+	user := &helxv1.HelxUser{}
+	if found, err := getObj(ctx, c, userName, user); !found {
+		return nil, err
 	}
+	return user, nil
 }
 
-func GetApp(appName string) *helxv1.HelxApp {
-	return GetObjFromMap[helxv1.HelxApp](appTable, appName)
-}
+// InstNames returns the sorted namespaced names of the given instances.
+func InstNames(insts []helxv1.HelxInst) []string {
+	var instNames []string
 
-func GetInst(instName string) (helxv1.HelxInst, bool) {
-	return GetInstFromMap(instanceTable, instName)
+	for i := range insts {
+		instNames = append(instNames, GetNamespacedName(&insts[i]))
+	}
+	sort.Strings(instNames)
+	return instNames
 }
 
-func GetUser(userName string) *helxv1.HelxUser {
-	return GetObjFromMap[helxv1.HelxUser](userTable, userName)
+// identityValue converts a user handle field, sent either as a JSON string or
+// a JSON number, to an int64.
+func identityValue(value interface{}) (int64, error) {
+	switch v := value.(type) {
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case float64:
+		return int64(v), nil
+	default:
+		return 0, fmt.Errorf("unexpected type %T", value)
+	}
 }
 
-func DeleteObjFromMap[T any](m map[string]TableElement[T], objName string) []helxv1.HelxInst {
-	instList := []helxv1.HelxInst{}
+// ResolveUser fetches the identity behind the user handle and returns it as a
+// SecurityContext, along with the handle's whole response, which the templates
+// see as .system.UserInfo. A handle that answers without any identity field is
+// reported as an error, since the pod would otherwise run without one.
+func ResolveUser(user *helxv1.HelxUser) (*helxv1.SecurityContext, map[string]interface{}, error) {
+	if user.Spec.UserHandle == nil {
+		return nil, nil, nil
+	}
+	info, err := connect.FetchData(*user.Spec.UserHandle)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	if element, found := m[objName]; found {
-		for k := range element.InstSet {
-			if inst, found := GetInst(k); found {
-				instList = append(instList, inst)
+	sc := &helxv1.SecurityContext{}
+	empty := true
+	for key, field := range map[string]**int64{
+		"runAsUser":  &sc.RunAsUser,
+		"runAsGroup": &sc.RunAsGroup,
+		"fsGroup":    &sc.FSGroup,
+	} {
+		if raw, found := info[key]; found {
+			value, err := identityValue(raw)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid %s: %v", key, err)
 			}
+			*field = &value
+			empty = false
 		}
 	}
-	return instList
-}
-
-func DeleteApp(appName string) []helxv1.HelxInst {
-	return DeleteObjFromMap[helxv1.HelxApp](appTable, appName)
-}
-
-func DeleteInst(instName string) {
-	if instElement, found := instanceTable[instName]; found {
-		appName := instElement.Inst.Spec.AppName
-		if appElement, found := appTable[appName]; found {
-			delete(appElement.InstSet, appName)
-		}
-		userName := instElement.Inst.Spec.UserName
-		if userElement, found := userTable[userName]; found {
-			delete(userElement.InstSet, userName)
+	if rawArray, ok := info["supplementalGroups"].([]interface{}); ok {
+		for _, raw := range rawArray {
+			value, err := identityValue(raw)
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid supplementalGroups: %v", err)
+			}
+			sc.SupplementalGroups = append(sc.SupplementalGroups, value)
 		}
-		delete(instanceTable, instName)
+		empty = false
 	}
+	if empty {
+		return nil, nil, fmt.Errorf("user handle %s returned no identity", *user.Spec.UserHandle)
+	}
+	return sc, info, nil
 }
 
-func DeleteUser(userName string) []helxv1.HelxInst {
-	return DeleteObjFromMap[helxv1.HelxUser](userTable, userName)
-}
-
-/*
-func CheckInit(ctx context.Context) error {
-	var err error
-
-	initLock.Lock()
-	defer initLock.Unlock()
-	if !initialized {
-		simpleInfoLogger = newSimpleInfoLogger(ctx)
-		simpleErrorLogger = newSimpleErrorLogger(ctx)
-		xformer, storage, err = template_io.ParseTemplates("templates", simpleInfoLogger)
-		if err != nil {
-			simpleErrorLogger(err, "failed to initialize xformer template")
-			return err
-		} else {
-			simpleInfoLogger("helxapp_operations initialized")
-			initialized = true
-		}
+// StoredUserInfo decodes the userHandle response the HelxUser reconciler
+// stored in status, or returns nil when there is none.
+func StoredUserInfo(user *helxv1.HelxUser) map[string]interface{} {
+	if user.Status.UserInfo == nil || len(user.Status.UserInfo.Raw) == 0 {
+		return nil
 	}
-	return nil
+	var info map[string]interface{}
+	if err := json.Unmarshal(user.Status.UserInfo.Raw, &info); err != nil {
+		return nil
+	}
+	return info
 }
-*/
 
 /*
 ProcessVolume parses a volume string according to the following BNF specification:
@@ -411,8 +471,10 @@ func transformPorts(srcPorts []helxv1.PortMap) ([]template_io.PortMap, bool) {
 
 	for _, srcMap := range srcPorts {
 		dstMap := template_io.PortMap{
+			Name:          PortName(srcMap),
 			ContainerPort: int(srcMap.ContainerPort),
-			Protocol:      "TCP",
+			Protocol:      PortProtocol(srcMap),
+			AppProtocol:   srcMap.AppProtocol,
 			Port:          int(srcMap.Port),
 		}
 		dstPorts = append(dstPorts, dstMap)
@@ -424,172 +486,1384 @@ func transformPorts(srcPorts []helxv1.PortMap) ([]template_io.PortMap, bool) {
 	return dstPorts, hasService
 }
 
-func transformVolumes(service helxv1.Service, volumeSourceMap map[string]*template_io.Volume) ([]*template_io.VolumeMount, error) {
-	var details []*template_io.VolumeMount
+// DefaultServiceTypes keep instances reachable only from inside the cluster.
+var DefaultServiceTypes = []helxv1.ServiceType{helxv1.ServiceTypeClusterIP, helxv1.ServiceTypeHeadless}
 
-	for volumeName, volume := range service.Volumes {
-		templateVolume, templateVolumeMount, err := processVolume(volumeName, volume)
-		if err != nil {
-			return nil, err
+// ParseServiceTypes parses a comma-separated list of service types such as
+// "ClusterIP,Headless,NodePort".
+func ParseServiceTypes(s string) ([]helxv1.ServiceType, error) {
+	var types []helxv1.ServiceType
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
 		}
-		if _, found := volumeSourceMap[volumeName]; !found {
-			volumeSourceMap[volumeName] = templateVolume
+		switch serviceType := helxv1.ServiceType(entry); serviceType {
+		case helxv1.ServiceTypeClusterIP, helxv1.ServiceTypeHeadless, helxv1.ServiceTypeNodePort, helxv1.ServiceTypeLoadBalancer:
+			types = append(types, serviceType)
+		default:
+			return nil, fmt.Errorf("unknown service type %q", entry)
 		}
-		details = append(details, templateVolumeMount)
 	}
-
-	return details, nil
+	return types, nil
 }
 
-// getResourceLimits returns the resource limits and requests if available.
-func transformResources(serviceName string, resources map[string]helxv1.Resources) template_io.Resources {
-	if resource, found := resources[serviceName]; found {
-		return template_io.Resources{
-			Limits:   resource.Limits,
-			Requests: resource.Requests,
+// ValidateServiceTypes reports the services of app whose serviceType is not
+// among allowed, or DefaultServiceTypes when allowed is nil. Init services
+// get no Service and are not checked.
+func ValidateServiceTypes(app *helxv1.HelxApp, allowed []helxv1.ServiceType) field.ErrorList {
+	if allowed == nil {
+		allowed = DefaultServiceTypes
+	}
+	supported := make([]string, 0, len(allowed))
+	for _, serviceType := range allowed {
+		supported = append(supported, string(serviceType))
+	}
+	var errs field.ErrorList
+	for i, service := range app.Spec.Services {
+		if service.Init {
+			continue
+		}
+		serviceType := service.ServiceType
+		if serviceType == "" {
+			serviceType = helxv1.ServiceTypeClusterIP
+		}
+		found := false
+		for _, allowedType := range allowed {
+			found = found || allowedType == serviceType
+		}
+		if !found {
+			errs = append(errs, field.NotSupported(field.NewPath("spec", "services").Index(i).Child("serviceType"), serviceType, supported))
 		}
 	}
-
-	return template_io.Resources{}
+	return errs
 }
 
-func transFormImage(imageString string) template_io.Image {
-	imageName, attr := processImageAndOptions(imageString)
-	return template_io.Image{
-		ImageName: imageName,
-		Attr:      attr,
+// ValidateServiceTypes checks app against the operations' allowed service
+// types; a nil Operations allows the defaults.
+func (o *Operations) ValidateServiceTypes(app *helxv1.HelxApp) field.ErrorList {
+	if o == nil {
+		return ValidateServiceTypes(app, nil)
 	}
+	return ValidateServiceTypes(app, o.AllowedServiceTypes)
 }
 
-// ServiceProcessor processes the services from the application spec and returns containers.
-func transformApp(instance *helxv1.HelxInst, app helxv1.HelxApp) ([]template_io.Container, map[string]*template_io.Volume, error) {
-	containers := []template_io.Container{}
-	sourceMap := make(map[string]*template_io.Volume)
+// RouteKind is the kind of object that exposes an instance's ports outside
+// the cluster.
+type RouteKind string
 
-	for _, service := range app.Spec.Services {
-		ports, hasService := transformPorts(service.Ports)
-		volumeList, err := transformVolumes(service, sourceMap)
-		if err != nil {
-			simpleErrorLogger(err, "parse volume sources failed")
-			continue
-		}
+const (
+	RouteKindIngress   RouteKind = "Ingress"
+	RouteKindHTTPRoute RouteKind = "HTTPRoute"
+)
 
-		resources := transformResources(service.Name, instance.Spec.Resources)
-		container := template_io.Container{
-			Name:            service.Name,
-			Command:         service.Command[:],
-			Environment:     service.Environment,
-			HasService:      hasService,
-			Image:           transFormImage(service.Image),
-			Ports:           ports,
-			Resources:       resources,
-			SecurityContext: template_io.ExtractSCFromCR(service.SecurityContext),
-			VolumeMounts:    volumeList,
+// RouteClass configures the Ingress or HTTPRoute rendered for each exposed
+// port of the instances of one app class. Host and Path are patterns that
+// may use {{appClassName}}, {{appName}}, {{user}}, {{uuid}}, {{instanceName}}
+// and {{namespace}}, e.g. /private/{{appName}}/{{user}}/{{uuid}}.
+type RouteClass struct {
+	// Kind defaults to Ingress
+	Kind RouteKind `json:"kind,omitempty"`
+	Host string    `json:"host,omitempty"`
+	// Path defaults to /
+	Path             string            `json:"path,omitempty"`
+	IngressClassName string            `json:"ingressClassName,omitempty"`
+	Annotations      map[string]string `json:"annotations,omitempty"`
+	TLSSecretName    string            `json:"tlsSecretName,omitempty"`
+	// Gateway is required for HTTPRoute
+	Gateway *GatewayRef `json:"gateway,omitempty"`
+}
+
+// GatewayRef is the Gateway, and optionally the listener, HTTPRoutes attach to.
+type GatewayRef struct {
+	Name        string `json:"name"`
+	Namespace   string `json:"namespace,omitempty"`
+	SectionName string `json:"sectionName,omitempty"`
+}
+
+// DefaultRouteClass is the key of the RouteClass used for app classes that
+// have none of their own.
+const DefaultRouteClass = "*"
+
+// LoadRouteClasses reads the route classes, keyed by appClassName, from a
+// YAML file such as
+//
+//	Jupyter:
+//	  host: apps.example.org
+//	  path: /private/{{appName}}/{{user}}/{{uuid}}
+//	  ingressClassName: nginx
+func LoadRouteClasses(path string) (map[string]RouteClass, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var classes map[string]RouteClass
+	if err := sigsyaml.UnmarshalStrict(data, &classes); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for name, class := range classes {
+		if err := checkRouteClass(class); err != nil {
+			return nil, fmt.Errorf("%s: route class %s: %v", path, name, err)
 		}
+	}
+	return classes, nil
+}
 
-		containers = append(containers, container)
+// checkRouteClass verifies that a route class has a known kind, parseable
+// patterns and, for HTTPRoute, a Gateway.
+func checkRouteClass(class RouteClass) error {
+	switch class.Kind {
+	case "", RouteKindIngress:
+	case RouteKindHTTPRoute:
+		if class.Gateway == nil || class.Gateway.Name == "" {
+			return fmt.Errorf("HTTPRoute requires gateway.name")
+		}
+	default:
+		return fmt.Errorf("unknown kind %q, expected Ingress or HTTPRoute", class.Kind)
 	}
+	for _, pattern := range []string{class.Host, class.Path} {
+		if _, err := expandRoutePattern(pattern, nil, nil, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	return containers, sourceMap, nil
+// expandRoutePattern fills a host or path pattern in from the instance; with
+// a nil instance it only checks that the pattern parses.
+func expandRoutePattern(pattern string, instance *helxv1.HelxInst, app *helxv1.HelxApp, user *helxv1.HelxUser) (string, error) {
+	value := func(f func() string) func() string {
+		return func() string {
+			if instance == nil {
+				return ""
+			}
+			return f()
+		}
+	}
+	tmpl, err := template.New("route").Funcs(template.FuncMap{
+		"appClassName": value(func() string { return app.Spec.AppClassName }),
+		"appName":      value(func() string { return app.Name }),
+		"user":         value(func() string { return user.Name }),
+		"uuid":         value(func() string { return instance.Status.UUID }),
+		"instanceName": value(func() string { return instance.Name }),
+		"namespace":    value(func() string { return instance.Namespace }),
+	}).Parse(pattern)
+	if err != nil {
+		return "", fmt.Errorf("pattern %q: %v", pattern, err)
+	}
+	var out strings.Builder
+	if err := tmpl.Execute(&out, nil); err != nil {
+		return "", fmt.Errorf("pattern %q: %v", pattern, err)
+	}
+	return out.String(), nil
 }
 
-// stabilizeRender performs re-renders until the output stabilizes.
-func renderObject(system template_io.System, templateName string, objID string, obj interface{}, postRender func(string)) error {
-	vars := make(map[string]interface{})
+// UsesRouteKind reports whether any route class renders routes of kind.
+func (o *Operations) UsesRouteKind(kind RouteKind) bool {
+	if o == nil {
+		return false
+	}
+	for _, class := range o.RouteClasses {
+		if class.Kind == kind || (class.Kind == "" && kind == RouteKindIngress) {
+			return true
+		}
+	}
+	return false
+}
 
-	vars["system"] = system
-	if obj != nil {
-		vars[objID] = obj
+// RouteClass is the route class for app, or nil when instances of its app
+// class are not exposed.
+func (o *Operations) RouteClass(app *helxv1.HelxApp) *RouteClass {
+	if o == nil {
+		return nil
+	}
+	if class, found := o.RouteClasses[app.Spec.AppClassName]; found {
+		return &class
+	}
+	if class, found := o.RouteClasses[DefaultRouteClass]; found {
+		return &class
 	}
+	return nil
+}
 
-	if initialRender, err := template_io.RenderGoTemplate(xformer, templateName, vars); err != nil {
-		simpleErrorLogger(err, "RenderGoTemplate failed")
-		return err
-	} else {
-		current := initialRender
-		previous := initialRender
+// instRoutes lists a route for every TCP Service port of containers. The
+// first is served at the class's path, the others below it at
+// <path>/<container>/<port name>.
+func instRoutes(class *RouteClass, instance *helxv1.HelxInst, app *helxv1.HelxApp, user *helxv1.HelxUser, containers []template_io.Container) ([]template_io.Route, error) {
+	host, err := expandRoutePattern(class.Host, instance, app, user)
+	if err != nil {
+		return nil, err
+	}
+	basePath, err := expandRoutePattern(class.Path, instance, app, user)
+	if err != nil {
+		return nil, err
+	}
+	basePath = "/" + strings.Trim(basePath, "/")
+	kind := class.Kind
+	if kind == "" {
+		kind = RouteKindIngress
+	}
+	var gateway *template_io.GatewayRef
+	if class.Gateway != nil {
+		gateway = &template_io.GatewayRef{Name: class.Gateway.Name, Namespace: class.Gateway.Namespace, SectionName: class.Gateway.SectionName}
+	}
 
-		for {
-			var err error
-			current, err = template_io.ReRender(previous, vars)
-			if err != nil {
-				simpleErrorLogger(err, "ReRender failed")
-				return err
+	var routes []template_io.Route
+	for _, container := range containers {
+		if !container.HasService {
+			continue
+		}
+		for _, port := range container.Ports {
+			if port.Port == 0 || port.Protocol != "TCP" {
+				continue
 			}
-			if current == previous {
-				break
+			path := basePath
+			if len(routes) != 0 {
+				path = strings.TrimSuffix(basePath, "/") + "/" + container.Name + "/" + port.Name
 			}
-			previous = current
+			routes = append(routes, template_io.Route{
+				Name:      fmt.Sprintf("%s-%s-%s", container.Name, port.Name, instance.Status.UUID),
+				Kind:      string(kind),
+				Container: container.Name,
+				// the name service.tmpl gives the container's Service
+				ServiceName:      container.Name + "-" + instance.Status.UUID,
+				PortName:         port.Name,
+				Port:             port.Port,
+				Host:             host,
+				Path:             path,
+				IngressClassName: class.IngressClassName,
+				Annotations:      class.Annotations,
+				TLSSecretName:    class.TLSSecretName,
+				Gateway:          gateway,
+			})
 		}
+	}
+	return routes, nil
+}
 
-		postRender(current)
-		return nil
+// PortName is the name of a container port and of the Service port that
+// targets it: the given name, or else port-<containerPort>, with udp or
+// sctp in place of port for those protocols.
+func PortName(port helxv1.PortMap) string {
+	if port.Name != "" {
+		return port.Name
 	}
+	if protocol := PortProtocol(port); protocol != "TCP" {
+		return fmt.Sprintf("%s-%d", strings.ToLower(protocol), port.ContainerPort)
+	}
+	return fmt.Sprintf("port-%d", port.ContainerPort)
 }
 
-func GenerateArtifacts(instance *helxv1.HelxInst) (*Artifacts, error) {
-	appName := GetAppNameFromInst(instance)
-	userName := GetUserNameFromInst(instance)
+// PortProtocol is the protocol of a port, TCP when none is given.
+func PortProtocol(port helxv1.PortMap) string {
+	if port.Protocol == "" {
+		return "TCP"
+	}
+	return port.Protocol
+}
 
-	simpleDebugLogger(fmt.Sprintf("retrieving (app,user) via (%s,%s)", appName, userName))
+// maxServiceNameLength leaves room for the "-<uuid>" suffix of the Service
+// name within the 63 characters of a DNS label.
+const maxServiceNameLength = 63 - 37
 
-	app := GetApp(appName)
-	user := GetUser(userName)
+// checkServiceName verifies that a service name can name both its container
+// and its Service, <name>-<uuid>.
+func checkServiceName(name string) error {
+	if len(name) > maxServiceNameLength {
+		return fmt.Errorf("name %q is longer than %d characters", name, maxServiceNameLength)
+	}
+	if msgs := validation.IsDNS1035Label(name); len(msgs) != 0 {
+		return fmt.Errorf("name %q: %s", name, strings.Join(msgs, "; "))
+	}
+	return nil
+}
 
-	if app != nil && user != nil {
-		containers, volumeSourceMap, error := transformApp(instance, *app)
-		if error == nil && len(containers) >= 1 {
-			volumes := make(map[string]template_io.Volume)
+// checkPortName verifies that a port name is a valid IANA service name.
+func checkPortName(port helxv1.PortMap) error {
+	if msgs := validation.IsValidPortName(PortName(port)); len(msgs) != 0 {
+		return fmt.Errorf("port name %q: %s", PortName(port), strings.Join(msgs, "; "))
+	}
+	return nil
+}
 
-			for name, value := range volumeSourceMap {
-				volumes[name] = *value
-			}
+// checkPorts verifies that every container port is a valid port number with
+// a unique valid name and that service ports, when given, are valid as well.
+func checkPorts(srcPorts []helxv1.PortMap) error {
+	names := make(map[string]bool)
+	for _, srcMap := range srcPorts {
+		if srcMap.ContainerPort < 1 || srcMap.ContainerPort > 65535 {
+			return fmt.Errorf("containerPort %d is out of range", srcMap.ContainerPort)
+		}
+		if srcMap.Port < 0 || srcMap.Port > 65535 {
+			return fmt.Errorf("port %d is out of range", srcMap.Port)
+		}
+		switch srcMap.Protocol {
+		case "", "TCP", "UDP", "SCTP":
+		default:
+			return fmt.Errorf("port %d: protocol must be TCP, UDP or SCTP", srcMap.ContainerPort)
+		}
+		if err := checkPortName(srcMap); err != nil {
+			return err
+		}
+		if names[PortName(srcMap)] {
+			return fmt.Errorf("port name %s is used twice", PortName(srcMap))
+		}
+		names[PortName(srcMap)] = true
+	}
+	return nil
+}
 
-			systemEnv := make(map[string]string)
-			systemEnv["GUID"] = instance.Status.UUID
-			systemEnv["USER"] = instance.Spec.UserName
-			systemEnv["HOST"] = ""
-			systemEnv["APP_CLASS_NAME"] = app.Spec.AppClassName
-			systemEnv["APP_NAME"] = instance.Spec.AppName
-			systemEnv["INSTANCE_NAME"] = instance.GetNamespace() + "/" + instance.GetName()
+// ActivityPort is the Service port an activity probe is sent to: the probe's
+// own port, or else the first service port. It is 0 when there is none.
+func ActivityPort(service helxv1.Service) int32 {
+	if service.Activity != nil && service.Activity.Port != 0 {
+		return service.Activity.Port
+	}
+	for _, port := range service.Ports {
+		if port.Port != 0 {
+			return port.Port
+		}
+	}
+	return 0
+}
 
-			system := template_io.System{
-				AppClassName: app.Spec.AppClassName,
-				AppName:      instance.Spec.AppName,
-				InstanceName: instance.Name,
-				Containers:   containers,
-				Environment:  systemEnv,
-				Host:         "",
-				UUID:         instance.Status.UUID,
-				UserName:     instance.Spec.UserName,
-				Volumes:      volumes,
-			}
+// checkActivity verifies that an activity probe names a path and a port the
+// service exposes. Init services have no Service to probe through.
+func checkActivity(service helxv1.Service) error {
+	if service.Activity == nil {
+		return nil
+	}
+	if service.Init {
+		return fmt.Errorf("an init service cannot have an activity probe")
+	}
+	if !strings.HasPrefix(service.Activity.Path, "/") {
+		return fmt.Errorf("activity path %q must start with /", service.Activity.Path)
+	}
+	port := ActivityPort(service)
+	for _, srcMap := range service.Ports {
+		if port != 0 && srcMap.Port == port {
+			return nil
+		}
+	}
+	return fmt.Errorf("activity port %d is not a service port", port)
+}
 
-			if instance.Spec.SecurityContext != nil {
-				system.SecurityContext = template_io.ExtractSCFromCR(instance.Spec.SecurityContext)
-			} else if user.Spec.UserHandle != nil {
-				if info, err := connect.FetchData(*user.Spec.UserHandle); err != nil {
-					simpleErrorLogger(err, fmt.Sprintf("unable to fetch user info from %s ", *user.Spec.UserHandle))
-				} else {
-					system.UserInfo = info
-					system.SecurityContext = template_io.ExtractSCFromMap(info)
-				}
-			}
+// checkImage verifies that an image string names an image before its options.
+func checkImage(imageString string) error {
+	imageName, _ := processImageAndOptions(imageString)
+	if strings.TrimSpace(imageName) == "" {
+		return fmt.Errorf("image name is empty")
+	}
+	if strings.ContainsAny(imageName, " \t\n") {
+		return fmt.Errorf("image name %q contains whitespace", imageName)
+	}
+	return nil
+}
 
-			simpleInfoLogger("applying templates")
-			clearStorage()
+// checkEnvVar verifies that a variable has a name and exactly one complete
+// source.
+func checkEnvVar(env helxv1.EnvVar) error {
+	if env.Name == "" {
+		return fmt.Errorf("env name is empty")
+	}
+	sources := 0
+	for _, ref := range []*helxv1.KeySelector{env.ValueFrom.SecretKeyRef, env.ValueFrom.ConfigMapKeyRef} {
+		if ref != nil {
+			sources++
+			if ref.Name == "" || ref.Key == "" {
+				return fmt.Errorf("env %s: name and key are required", env.Name)
+			}
+		}
+	}
+	if env.ValueFrom.FieldRef != nil {
+		sources++
+		if env.ValueFrom.FieldRef.FieldPath == "" {
+			return fmt.Errorf("env %s: fieldPath is required", env.Name)
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("env %s: exactly one of secretKeyRef, configMapKeyRef and fieldRef must be set", env.Name)
+	}
+	return nil
+}
 
-			artifacts := Artifacts{}
+// checkEnvFrom verifies that a source names exactly one Secret or ConfigMap.
+func checkEnvFrom(src helxv1.EnvFromSource) error {
+	if (src.SecretRef == nil) == (src.ConfigMapRef == nil) {
+		return fmt.Errorf("envFrom: exactly one of secretRef and configMapRef must be set")
+	}
+	if (src.SecretRef != nil && src.SecretRef.Name == "") || (src.ConfigMapRef != nil && src.ConfigMapRef.Name == "") {
+		return fmt.Errorf("envFrom: name is required")
+	}
+	return nil
+}
 
-			if err := renderObject(system, "deployment", "", nil, func(render string) {
-				artifacts.Deployment = RenderArtifact{Render: render, Attr: make(map[string]string)}
-			}); err != nil {
-				return nil, err
-			}
+// checkEnv runs checkEnvVar and checkEnvFrom over a list of each.
+func checkEnv(env []helxv1.EnvVar, envFrom []helxv1.EnvFromSource) error {
+	for _, entry := range env {
+		if err := checkEnvVar(entry); err != nil {
+			return err
+		}
+	}
+	for _, src := range envFrom {
+		if err := checkEnvFrom(src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			for _, volume := range system.Volumes {
+// systemEnvNames are the variables GenerateArtifacts sets in every container.
+var systemEnvNames = map[string]bool{"GUID": true, "USER": true, "HOST": true, "APP_CLASS_NAME": true, "APP_NAME": true, "INSTANCE_NAME": true}
+
+// checkEnvNames verifies that no variable is set twice in env, both in env
+// and in the literal environment, or in env and by the system, which would
+// render two entries of the same name of which the API server silently keeps
+// the last.
+func checkEnvNames(environment map[string]string, env []helxv1.EnvVar) error {
+	seen := make(map[string]bool)
+	for _, entry := range env {
+		if systemEnvNames[entry.Name] {
+			return fmt.Errorf("env %s is set by the system", entry.Name)
+		}
+		if _, found := environment[entry.Name]; found {
+			return fmt.Errorf("env %s is also set in environment", entry.Name)
+		}
+		if seen[entry.Name] {
+			return fmt.Errorf("env %s is set more than once", entry.Name)
+		}
+		seen[entry.Name] = true
+	}
+	return nil
+}
+
+// transformEnvironment copies the app's literal variables, leaving out those
+// the instance's env replaces.
+func transformEnvironment(environment map[string]string, instEnv []helxv1.EnvVar) map[string]string {
+	if len(instEnv) == 0 {
+		return environment
+	}
+	dst := make(map[string]string, len(environment))
+	for name, value := range environment {
+		dst[name] = value
+	}
+	for _, env := range instEnv {
+		delete(dst, env.Name)
+	}
+	return dst
+}
+
+// transformEnv copies the app's variables and then the instance's into their
+// template form; an instance variable replaces an app variable of the same
+// name in place.
+func transformEnv(appEnv, instEnv []helxv1.EnvVar) []template_io.EnvVar {
+	var dst []template_io.EnvVar
+	index := make(map[string]int)
+	for _, env := range append(append([]helxv1.EnvVar{}, appEnv...), instEnv...) {
+		dstEnv := template_io.EnvVar{Name: env.Name}
+		if ref := env.ValueFrom.SecretKeyRef; ref != nil {
+			dstEnv.SecretKeyRef = &template_io.KeyRef{Name: ref.Name, Key: ref.Key, Optional: ref.Optional}
+		} else if ref := env.ValueFrom.ConfigMapKeyRef; ref != nil {
+			dstEnv.ConfigMapKeyRef = &template_io.KeyRef{Name: ref.Name, Key: ref.Key, Optional: ref.Optional}
+		} else if env.ValueFrom.FieldRef != nil {
+			dstEnv.FieldPath = env.ValueFrom.FieldRef.FieldPath
+		}
+		if i, found := index[env.Name]; found {
+			dst[i] = dstEnv
+		} else {
+			index[env.Name] = len(dst)
+			dst = append(dst, dstEnv)
+		}
+	}
+	return dst
+}
+
+// transformEnvFrom copies the app's sources and then the instance's into
+// their template form; keys of later sources win.
+func transformEnvFrom(appEnvFrom, instEnvFrom []helxv1.EnvFromSource) []template_io.EnvFrom {
+	var dst []template_io.EnvFrom
+	for _, src := range append(append([]helxv1.EnvFromSource{}, appEnvFrom...), instEnvFrom...) {
+		dstSrc := template_io.EnvFrom{Prefix: src.Prefix}
+		if src.SecretRef != nil {
+			dstSrc.SecretRef = &template_io.EnvRef{Name: src.SecretRef.Name, Optional: src.SecretRef.Optional}
+		} else if src.ConfigMapRef != nil {
+			dstSrc.ConfigMapRef = &template_io.EnvRef{Name: src.ConfigMapRef.Name, Optional: src.ConfigMapRef.Optional}
+		}
+		dst = append(dst, dstSrc)
+	}
+	return dst
+}
+
+// checkToleration verifies the operator and effect of a toleration.
+func checkToleration(toleration corev1.Toleration) error {
+	switch toleration.Operator {
+	case "", corev1.TolerationOpEqual:
+	case corev1.TolerationOpExists:
+		if toleration.Value != "" {
+			return fmt.Errorf("toleration %s: value must be empty with operator Exists", toleration.Key)
+		}
+	default:
+		return fmt.Errorf("toleration %s: operator must be Equal or Exists", toleration.Key)
+	}
+	switch toleration.Effect {
+	case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+	default:
+		return fmt.Errorf("toleration %s: effect must be NoSchedule, PreferNoSchedule or NoExecute", toleration.Key)
+	}
+	if toleration.TolerationSeconds != nil && toleration.Effect != corev1.TaintEffectNoExecute {
+		return fmt.Errorf("toleration %s: tolerationSeconds requires effect NoExecute", toleration.Key)
+	}
+	return nil
+}
+
+// checkTopologySpread verifies the fields of a spread constraint the API
+// server would otherwise reject only when the Deployment is applied.
+func checkTopologySpread(constraint corev1.TopologySpreadConstraint) error {
+	if constraint.TopologyKey == "" {
+		return fmt.Errorf("topology spread: topologyKey is required")
+	}
+	if constraint.MaxSkew < 1 {
+		return fmt.Errorf("topology spread %s: maxSkew must be at least 1", constraint.TopologyKey)
+	}
+	switch constraint.WhenUnsatisfiable {
+	case corev1.DoNotSchedule, corev1.ScheduleAnyway:
+	default:
+		return fmt.Errorf("topology spread %s: whenUnsatisfiable must be DoNotSchedule or ScheduleAnyway", constraint.TopologyKey)
+	}
+	return nil
+}
+
+// checkScheduling runs checkToleration and checkTopologySpread over a
+// Scheduling.
+func checkScheduling(scheduling helxv1.Scheduling) error {
+	for _, toleration := range scheduling.Tolerations {
+		if err := checkToleration(toleration); err != nil {
+			return err
+		}
+	}
+	for _, constraint := range scheduling.TopologySpreadConstraints {
+		if err := checkTopologySpread(constraint); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeScheduling lays the instance's scheduling over the app's: node
+// selector keys and the priority class of the instance win, its tolerations
+// are added, each kind of affinity it sets replaces the app's, and its spread
+// constraints replace app constraints with the same topologyKey.
+func mergeScheduling(app, inst helxv1.Scheduling) helxv1.Scheduling {
+	merged := *app.DeepCopy()
+
+	for key, value := range inst.NodeSelector {
+		if merged.NodeSelector == nil {
+			merged.NodeSelector = make(map[string]string)
+		}
+		merged.NodeSelector[key] = value
+	}
+
+	for _, toleration := range inst.Tolerations {
+		found := false
+		for _, existing := range merged.Tolerations {
+			if existing.MatchToleration(&toleration) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged.Tolerations = append(merged.Tolerations, *toleration.DeepCopy())
+		}
+	}
+
+	if inst.Affinity != nil {
+		if merged.Affinity == nil {
+			merged.Affinity = &corev1.Affinity{}
+		}
+		if inst.Affinity.NodeAffinity != nil {
+			merged.Affinity.NodeAffinity = inst.Affinity.NodeAffinity.DeepCopy()
+		}
+		if inst.Affinity.PodAffinity != nil {
+			merged.Affinity.PodAffinity = inst.Affinity.PodAffinity.DeepCopy()
+		}
+		if inst.Affinity.PodAntiAffinity != nil {
+			merged.Affinity.PodAntiAffinity = inst.Affinity.PodAntiAffinity.DeepCopy()
+		}
+	}
+
+	for _, constraint := range inst.TopologySpreadConstraints {
+		replaced := false
+		for i := range merged.TopologySpreadConstraints {
+			if merged.TopologySpreadConstraints[i].TopologyKey == constraint.TopologyKey {
+				merged.TopologySpreadConstraints[i] = *constraint.DeepCopy()
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged.TopologySpreadConstraints = append(merged.TopologySpreadConstraints, *constraint.DeepCopy())
+		}
+	}
+
+	if inst.PriorityClassName != "" {
+		merged.PriorityClassName = inst.PriorityClassName
+	}
+	return merged
+}
+
+// namedProbe is a probe set on a service together with its field name.
+type namedProbe struct {
+	field string
+	probe *helxv1.Probe
+}
+
+// serviceProbes lists the probes a service sets.
+func serviceProbes(service helxv1.Service) []namedProbe {
+	var probes []namedProbe
+	for _, named := range []namedProbe{
+		{"livenessProbe", service.LivenessProbe},
+		{"readinessProbe", service.ReadinessProbe},
+		{"startupProbe", service.StartupProbe},
+	} {
+		if named.probe != nil {
+			probes = append(probes, named)
+		}
+	}
+	return probes
+}
+
+// checkProbe verifies that a probe has exactly one handler aimed at a valid
+// port. Init containers run to completion, so Kubernetes allows them none.
+func checkProbe(probe *helxv1.Probe, init bool) error {
+	if init {
+		return fmt.Errorf("an init service cannot have probes")
+	}
+	handlers := 0
+	if probe.Exec != nil {
+		handlers++
+		if len(probe.Exec.Command) == 0 {
+			return fmt.Errorf("exec command is empty")
+		}
+	}
+	if probe.HTTPGet != nil {
+		handlers++
+		if probe.HTTPGet.Port < 1 || probe.HTTPGet.Port > 65535 {
+			return fmt.Errorf("httpGet port %d is out of range", probe.HTTPGet.Port)
+		}
+	}
+	if probe.TCPSocket != nil {
+		handlers++
+		if probe.TCPSocket.Port < 1 || probe.TCPSocket.Port > 65535 {
+			return fmt.Errorf("tcpSocket port %d is out of range", probe.TCPSocket.Port)
+		}
+	}
+	if handlers != 1 {
+		return fmt.Errorf("exactly one of exec, httpGet and tcpSocket must be set")
+	}
+	if probe.InitialDelaySeconds < 0 || probe.PeriodSeconds < 0 || probe.TimeoutSeconds < 0 || probe.FailureThreshold < 0 {
+		return fmt.Errorf("timings must not be negative")
+	}
+	return nil
+}
+
+// checkProbes runs checkProbe on every probe of a service.
+func checkProbes(service helxv1.Service) error {
+	for _, named := range serviceProbes(service) {
+		if err := checkProbe(named.probe, service.Init); err != nil {
+			return fmt.Errorf("%s: %v", named.field, err)
+		}
+	}
+	return nil
+}
+
+// transformProbe copies a probe into its template form.
+func transformProbe(probe *helxv1.Probe) *template_io.Probe {
+	if probe == nil {
+		return nil
+	}
+	dst := &template_io.Probe{
+		InitialDelaySeconds: probe.InitialDelaySeconds,
+		PeriodSeconds:       probe.PeriodSeconds,
+		TimeoutSeconds:      probe.TimeoutSeconds,
+		FailureThreshold:    probe.FailureThreshold,
+	}
+	if probe.Exec != nil {
+		dst.Exec = &template_io.ExecAction{Command: probe.Exec.Command}
+	}
+	if probe.HTTPGet != nil {
+		dst.HTTPGet = &template_io.HTTPGetAction{
+			Path:        probe.HTTPGet.Path,
+			Port:        probe.HTTPGet.Port,
+			Scheme:      probe.HTTPGet.Scheme,
+			HttpHeaders: probe.HTTPGet.HTTPHeaders,
+		}
+	}
+	if probe.TCPSocket != nil {
+		dst.TCPSocket = &template_io.TCPSocketAction{Port: probe.TCPSocket.Port}
+	}
+	return dst
+}
+
+func transformVolumes(service helxv1.Service, volumeSourceMap map[string]*template_io.Volume) ([]*template_io.VolumeMount, error) {
+	var details []*template_io.VolumeMount
+
+	for volumeName, volume := range service.Volumes {
+		templateVolume, templateVolumeMount, err := processVolume(volumeName, volume)
+		if err != nil {
+			return nil, err
+		}
+		if _, found := volumeSourceMap[volumeName]; !found {
+			volumeSourceMap[volumeName] = templateVolume
+		}
+		details = append(details, templateVolumeMount)
+	}
+
+	return details, nil
+}
+
+// getResourceLimits returns the resource limits and requests if available.
+func transformResources(serviceName string, resources map[string]helxv1.Resources) template_io.Resources {
+	if resource, found := resources[serviceName]; found {
+		return template_io.Resources{
+			Limits:   resource.Limits,
+			Requests: resource.Requests,
+		}
+	}
+
+	return template_io.Resources{}
+}
+
+// hasResourceBounds reports whether any service of app declares bounds.
+func hasResourceBounds(app *helxv1.HelxApp) bool {
+	for _, service := range app.Spec.Services {
+		if len(service.ResourceBounds) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBoundary parses the min and max of a boundary; a missing side is nil.
+func parseBoundary(boundary helxv1.ResourceBoundary) (*resource.Quantity, *resource.Quantity, error) {
+	var bounds [2]*resource.Quantity
+	for i, value := range []string{boundary.Min, boundary.Max} {
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%q: %v", value, err)
+		}
+		bounds[i] = &quantity
+	}
+	if bounds[0] != nil && bounds[1] != nil && bounds[0].Cmp(*bounds[1]) > 0 {
+		return nil, nil, fmt.Errorf("min %s is greater than max %s", boundary.Min, boundary.Max)
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// instProfile returns the app hardware profile the instance names, or nil
+// when it names none.
+func instProfile(instance *helxv1.HelxInst, app *helxv1.HelxApp) (*helxv1.HardwareProfile, error) {
+	if instance.Spec.Profile == "" {
+		return nil, nil
+	}
+	profile, found := app.Spec.Profiles[instance.Spec.Profile]
+	if !found {
+		return nil, fmt.Errorf("app %s has no profile %s", app.Name, instance.Spec.Profile)
+	}
+	return &profile, nil
+}
+
+// instResources returns the resources the instance asks for: those of its
+// profile, if any, with spec.resources laid over them value by value.
+func instResources(instance *helxv1.HelxInst, app *helxv1.HelxApp) map[string]helxv1.Resources {
+	resources := make(map[string]helxv1.Resources, len(instance.Spec.Resources))
+	if profile, err := instProfile(instance, app); err == nil && profile != nil {
+		for name, value := range profile.Resources {
+			resources[name] = *value.DeepCopy()
+		}
+	}
+	for name, value := range instance.Spec.Resources {
+		merged, found := resources[name]
+		if !found {
+			resources[name] = *value.DeepCopy()
+			continue
+		}
+		for key, quantity := range value.Requests {
+			if merged.Requests == nil {
+				merged.Requests = make(map[string]string)
+			}
+			merged.Requests[key] = quantity
+		}
+		for key, quantity := range value.Limits {
+			if merged.Limits == nil {
+				merged.Limits = make(map[string]string)
+			}
+			merged.Limits[key] = quantity
+		}
+		resources[name] = merged
+	}
+	return resources
+}
+
+// validateProfiles checks that every profile of the app sets resources only
+// for its services, with quantities inside their resourceBounds, and has
+// well-formed scheduling.
+func validateProfiles(app *helxv1.HelxApp) field.ErrorList {
+	var errs field.ErrorList
+	services := make(map[string]helxv1.Service, len(app.Spec.Services))
+	for _, service := range app.Spec.Services {
+		services[service.Name] = service
+	}
+
+	profileNames := make([]string, 0, len(app.Spec.Profiles))
+	for name := range app.Spec.Profiles {
+		profileNames = append(profileNames, name)
+	}
+	sort.Strings(profileNames)
+	for _, profileName := range profileNames {
+		profile := app.Spec.Profiles[profileName]
+		path := field.NewPath("spec", "profiles").Key(profileName)
+
+		serviceNames := make([]string, 0, len(profile.Resources))
+		for name := range profile.Resources {
+			serviceNames = append(serviceNames, name)
+		}
+		sort.Strings(serviceNames)
+		for _, serviceName := range serviceNames {
+			resourcesPath := path.Child("resources").Key(serviceName)
+			service, found := services[serviceName]
+			if !found {
+				errs = append(errs, field.NotFound(resourcesPath, serviceName))
+				continue
+			}
+			for _, side := range []struct {
+				kind   string
+				values map[string]string
+			}{
+				{"request", profile.Resources[serviceName].Requests},
+				{"limit", profile.Resources[serviceName].Limits},
+			} {
+				names := make([]string, 0, len(side.values))
+				for name := range side.values {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				for _, name := range names {
+					value := side.values[name]
+					valuePath := resourcesPath.Child(side.kind).Key(name)
+					quantity, err := resource.ParseQuantity(value)
+					if err != nil {
+						errs = append(errs, field.Invalid(valuePath, value, err.Error()))
+						continue
+					}
+					boundary, found := service.ResourceBounds[name]
+					if !found {
+						continue
+					}
+					// malformed bounds are reported against the service
+					min, max, err := parseBoundary(boundary)
+					if err != nil {
+						continue
+					}
+					if min != nil && quantity.Cmp(*min) < 0 {
+						errs = append(errs, field.Invalid(valuePath, value, fmt.Sprintf("below min %s of service %s", boundary.Min, serviceName)))
+					} else if max != nil && quantity.Cmp(*max) > 0 {
+						errs = append(errs, field.Invalid(valuePath, value, fmt.Sprintf("above max %s of service %s", boundary.Max, serviceName)))
+					}
+				}
+			}
+		}
+
+		for i, toleration := range profile.Tolerations {
+			if err := checkToleration(toleration); err != nil {
+				errs = append(errs, field.Invalid(path.Child("tolerations").Index(i), field.OmitValueType{}, err.Error()))
+			}
+		}
+		for i, constraint := range profile.TopologySpreadConstraints {
+			if err := checkTopologySpread(constraint); err != nil {
+				errs = append(errs, field.Invalid(path.Child("topologySpreadConstraints").Index(i), field.OmitValueType{}, err.Error()))
+			}
+		}
+	}
+	return errs
+}
+
+// BoundResources holds the instance requests and limits, including those of
+// its profile, to the resourceBounds of the app's services under the app's
+// resourcePolicy. It returns the
+// resources to render together with one message per adjustment made and,
+// when the policy refuses the instance, one message per violation.
+func BoundResources(instance *helxv1.HelxInst, app *helxv1.HelxApp) (map[string]helxv1.Resources, []string, []string) {
+	resources := instResources(instance, app)
+	policy := app.Spec.ResourcePolicy
+	if policy == "" {
+		policy = helxv1.ResourcePolicyReject
+	}
+	var adjustments, violations []string
+
+	for _, service := range app.Spec.Services {
+		if len(service.ResourceBounds) == 0 {
+			continue
+		}
+		bounded := resources[service.Name]
+		if bounded.Requests == nil {
+			bounded.Requests = make(map[string]string)
+		}
+		if bounded.Limits == nil {
+			bounded.Limits = make(map[string]string)
+		}
+		names := make([]string, 0, len(service.ResourceBounds))
+		for name := range service.ResourceBounds {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			boundary := service.ResourceBounds[name]
+			min, max, err := parseBoundary(boundary)
+			if err != nil {
+				violations = append(violations, fmt.Sprintf("service %s: %s bounds %v", service.Name, name, err))
+				continue
+			}
+			for _, side := range []struct {
+				kind     string
+				values   map[string]string
+				fallback string
+			}{
+				{"request", bounded.Requests, boundary.Min},
+				{"limit", bounded.Limits, boundary.Max},
+			} {
+				value, found := side.values[name]
+				if !found {
+					if policy == helxv1.ResourcePolicyDefault && side.fallback != "" {
+						side.values[name] = side.fallback
+						adjustments = append(adjustments, fmt.Sprintf("service %s: %s %s defaulted to %s", service.Name, name, side.kind, side.fallback))
+					}
+					continue
+				}
+				quantity, err := resource.ParseQuantity(value)
+				if err != nil {
+					violations = append(violations, fmt.Sprintf("service %s: %s %s %q: %v", service.Name, name, side.kind, value, err))
+					continue
+				}
+				var bound, relation string
+				if min != nil && quantity.Cmp(*min) < 0 {
+					bound, relation = boundary.Min, "below min"
+				} else if max != nil && quantity.Cmp(*max) > 0 {
+					bound, relation = boundary.Max, "above max"
+				} else {
+					continue
+				}
+				if policy == helxv1.ResourcePolicyClamp {
+					side.values[name] = bound
+					adjustments = append(adjustments, fmt.Sprintf("service %s: %s %s %s clamped to %s", service.Name, name, side.kind, value, bound))
+				} else {
+					violations = append(violations, fmt.Sprintf("service %s: %s %s %s is %s %s", service.Name, name, side.kind, value, relation, bound))
+				}
+			}
+		}
+		if len(bounded.Requests) == 0 {
+			bounded.Requests = nil
+		}
+		if len(bounded.Limits) == 0 {
+			bounded.Limits = nil
+		}
+		if bounded.Requests != nil || bounded.Limits != nil {
+			resources[service.Name] = bounded
+		}
+	}
+	return resources, adjustments, violations
+}
+
+// DefaultResources fills the requests and limits the instance leaves out
+// from the resourceBounds of the app's services, as ResourcePolicyDefault
+// does, whatever the app's policy. Values that are present are kept.
+func DefaultResources(instance *helxv1.HelxInst, app *helxv1.HelxApp) map[string]helxv1.Resources {
+	defaulting := *app
+	defaulting.Spec.ResourcePolicy = helxv1.ResourcePolicyDefault
+	resources, _, _ := BoundResources(instance, &defaulting)
+	return resources
+}
+
+func transFormImage(imageString string) template_io.Image {
+	imageName, attr := processImageAndOptions(imageString)
+	return template_io.Image{
+		ImageName: imageName,
+		Attr:      attr,
+	}
+}
+
+// ServiceProcessor processes the services from the application spec and returns containers.
+// Init services are returned separately, in app order; they never get a
+// Service, and their volumes join the same pod volumes as everyone else's.
+// Services that fail to parse are left out of the result and reported in the
+// returned error, one entry per service.
+func transformApp(instance *helxv1.HelxInst, app helxv1.HelxApp) ([]template_io.Container, []template_io.Container, map[string]*template_io.Volume, error) {
+	containers := []template_io.Container{}
+	initContainers := []template_io.Container{}
+	sourceMap := make(map[string]*template_io.Volume)
+	// callers refuse instances the bounds reject before rendering
+	bounded, _, _ := BoundResources(instance, &app)
+	var errs []error
+
+	for _, service := range app.Spec.Services {
+		if err := checkServiceName(service.Name); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %v", service.Name, err))
+			continue
+		}
+		if err := checkImage(service.Image); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %v", service.Name, err))
+			continue
+		}
+		if err := checkPorts(service.Ports); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %v", service.Name, err))
+			continue
+		}
+		if err := checkActivity(service); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %v", service.Name, err))
+			continue
+		}
+		if err := checkProbes(service); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %v", service.Name, err))
+			continue
+		}
+		if err := checkEnv(service.Env, service.EnvFrom); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %v", service.Name, err))
+			continue
+		}
+		if err := checkEnvNames(service.Environment, service.Env); err != nil {
+			errs = append(errs, fmt.Errorf("service %s: %v", service.Name, err))
+			continue
+		}
+		ports, hasService := transformPorts(service.Ports)
+		volumeList, err := transformVolumes(service, sourceMap)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("service %s: parse volume sources failed: %v", service.Name, err))
+			continue
+		}
+
+		resources := transformResources(service.Name, bounded)
+		container := template_io.Container{
+			Name:            service.Name,
+			Command:         service.Command[:],
+			Environment:     transformEnvironment(service.Environment, instance.Spec.Env),
+			ValueFrom:       transformEnv(service.Env, instance.Spec.Env),
+			EnvFrom:         transformEnvFrom(service.EnvFrom, instance.Spec.EnvFrom),
+			HasService:      hasService,
+			ServiceType:     string(service.ServiceType),
+			Image:           transFormImage(service.Image),
+			Ports:           ports,
+			Resources:       resources,
+			SecurityContext: template_io.ExtractSCFromCR(service.SecurityContext),
+			VolumeMounts:    volumeList,
+			LivenessProbe:   transformProbe(service.LivenessProbe),
+			ReadinessProbe:  transformProbe(service.ReadinessProbe),
+			StartupProbe:    transformProbe(service.StartupProbe),
+		}
+
+		if service.Init {
+			container.HasService = false
+			initContainers = append(initContainers, container)
+		} else {
+			containers = append(containers, container)
+		}
+	}
+
+	return containers, initContainers, sourceMap, utilerrors.NewAggregate(errs)
+}
+
+// ValidateApp dry-runs transformApp against an empty instance and returns one
+// message per service that would fail to render.
+func ValidateApp(app *helxv1.HelxApp) []string {
+	var messages []string
+
+	if _, _, _, err := transformApp(&helxv1.HelxInst{}, *app); err != nil {
+		if agg, ok := err.(utilerrors.Aggregate); ok {
+			for _, e := range agg.Errors() {
+				messages = append(messages, e.Error())
+			}
+		} else {
+			messages = append(messages, err.Error())
+		}
+	}
+	if err := checkScheduling(app.Spec.Scheduling); err != nil {
+		messages = append(messages, err.Error())
+	}
+	for _, err := range validateProfiles(app) {
+		messages = append(messages, err.Error())
+	}
+	return messages
+}
+
+// ValidateAppSpec checks a HelxApp the way the admission webhook sees it:
+// every service must pass the checks transformApp applies, service names
+// and container ports must be unique across the app, since the services
+// share one pod, tolerations and spread constraints must be well formed, and
+// hardware profiles must fit the services' resourceBounds.
+// Errors carry the field path of the offending value.
+func ValidateAppSpec(app *helxv1.HelxApp) field.ErrorList {
+	var errs field.ErrorList
+	names := make(map[string]bool)
+	// the same number may be used once per protocol
+	containerPorts := make(map[string]bool)
+	portNames := make(map[string]bool)
+
+	for i, service := range app.Spec.Services {
+		path := field.NewPath("spec", "services").Index(i)
+
+		if service.Name == "" {
+			errs = append(errs, field.Required(path.Child("name"), "service name is required"))
+		} else if names[service.Name] {
+			errs = append(errs, field.Duplicate(path.Child("name"), service.Name))
+		} else if err := checkServiceName(service.Name); err != nil {
+			errs = append(errs, field.Invalid(path.Child("name"), service.Name, err.Error()))
+		}
+		names[service.Name] = true
+
+		if strings.TrimSpace(service.Image) == "" {
+			errs = append(errs, field.Required(path.Child("image"), "image is required"))
+		} else if err := checkImage(service.Image); err != nil {
+			errs = append(errs, field.Invalid(path.Child("image"), service.Image, err.Error()))
+		}
+
+		for j, port := range service.Ports {
+			portPath := path.Child("ports").Index(j)
+			if port.ContainerPort < 1 || port.ContainerPort > 65535 {
+				errs = append(errs, field.Invalid(portPath.Child("containerPort"), port.ContainerPort, "must be between 1 and 65535"))
+			} else if key := fmt.Sprintf("%d/%s", port.ContainerPort, PortProtocol(port)); containerPorts[key] {
+				errs = append(errs, field.Duplicate(portPath.Child("containerPort"), port.ContainerPort))
+			}
+			containerPorts[fmt.Sprintf("%d/%s", port.ContainerPort, PortProtocol(port))] = true
+			switch port.Protocol {
+			case "", "TCP", "UDP", "SCTP":
+			default:
+				errs = append(errs, field.NotSupported(portPath.Child("protocol"), port.Protocol, []string{"TCP", "UDP", "SCTP"}))
+			}
+			if port.Port < 0 || port.Port > 65535 {
+				errs = append(errs, field.Invalid(portPath.Child("port"), port.Port, "must be between 0 and 65535"))
+			}
+			if err := checkPortName(port); err != nil {
+				errs = append(errs, field.Invalid(portPath.Child("name"), port.Name, err.Error()))
+			} else if port.Name != "" && portNames[port.Name] {
+				errs = append(errs, field.Duplicate(portPath.Child("name"), port.Name))
+			}
+			portNames[PortName(port)] = true
+		}
+
+		if err := checkActivity(service); err != nil {
+			errs = append(errs, field.Invalid(path.Child("activity"), field.OmitValueType{}, err.Error()))
+		}
+
+		for _, named := range serviceProbes(service) {
+			if err := checkProbe(named.probe, service.Init); err != nil {
+				errs = append(errs, field.Invalid(path.Child(named.field), field.OmitValueType{}, err.Error()))
+			}
+		}
+
+		envNames := make(map[string]bool)
+		for j, env := range service.Env {
+			if err := checkEnvVar(env); err != nil {
+				errs = append(errs, field.Invalid(path.Child("env").Index(j), field.OmitValueType{}, err.Error()))
+			}
+			if systemEnvNames[env.Name] {
+				errs = append(errs, field.Invalid(path.Child("env").Index(j).Child("name"), env.Name, "set by the system"))
+			} else if _, found := service.Environment[env.Name]; found {
+				errs = append(errs, field.Invalid(path.Child("env").Index(j).Child("name"), env.Name, "also set in environment"))
+			} else if envNames[env.Name] {
+				errs = append(errs, field.Duplicate(path.Child("env").Index(j).Child("name"), env.Name))
+			}
+			envNames[env.Name] = true
+		}
+		for j, src := range service.EnvFrom {
+			if err := checkEnvFrom(src); err != nil {
+				errs = append(errs, field.Invalid(path.Child("envFrom").Index(j), field.OmitValueType{}, err.Error()))
+			}
+		}
+
+		boundNames := make([]string, 0, len(service.ResourceBounds))
+		for name := range service.ResourceBounds {
+			boundNames = append(boundNames, name)
+		}
+		sort.Strings(boundNames)
+		for _, name := range boundNames {
+			if _, _, err := parseBoundary(service.ResourceBounds[name]); err != nil {
+				errs = append(errs, field.Invalid(path.Child("resourceBounds").Key(name), field.OmitValueType{}, err.Error()))
+			}
+		}
+
+		volumeNames := make([]string, 0, len(service.Volumes))
+		for volumeName := range service.Volumes {
+			volumeNames = append(volumeNames, volumeName)
+		}
+		sort.Strings(volumeNames)
+		for _, volumeName := range volumeNames {
+			volumeStr := service.Volumes[volumeName]
+			if _, _, err := processVolume(volumeName, volumeStr); err != nil {
+				errs = append(errs, field.Invalid(path.Child("volumes").Key(volumeName), volumeStr, err.Error()))
+			}
+		}
+	}
+
+	for i, toleration := range app.Spec.Tolerations {
+		if err := checkToleration(toleration); err != nil {
+			errs = append(errs, field.Invalid(field.NewPath("spec", "tolerations").Index(i), field.OmitValueType{}, err.Error()))
+		}
+	}
+	for i, constraint := range app.Spec.TopologySpreadConstraints {
+		if err := checkTopologySpread(constraint); err != nil {
+			errs = append(errs, field.Invalid(field.NewPath("spec", "topologySpreadConstraints").Index(i), field.OmitValueType{}, err.Error()))
+		}
+	}
+	return append(errs, validateProfiles(app)...)
+}
+
+// stabilizeRender performs re-renders until the output stabilizes.
+func (o *Operations) renderObject(system template_io.System, templateName string, objID string, obj interface{}, postRender func(string)) error {
+	vars := make(map[string]interface{})
+
+	vars["system"] = system
+	if obj != nil {
+		vars[objID] = obj
+	}
+
+	if initialRender, err := template_io.RenderGoTemplate(o.xformer, templateName, vars); err != nil {
+		o.simpleErrorLogger(err, "RenderGoTemplate failed")
+		return err
+	} else {
+		current := initialRender
+		previous := initialRender
+
+		for {
+			var err error
+			current, err = template_io.ReRender(previous, vars)
+			if err != nil {
+				o.simpleErrorLogger(err, "ReRender failed")
+				return err
+			}
+			if current == previous {
+				break
+			}
+			previous = current
+		}
+
+		postRender(current)
+		return nil
+	}
+}
+
+// GenerateArtifacts renders the instance against its resolved app and user.
+// Nothing is rendered until both are present.
+func (o *Operations) GenerateArtifacts(instance *helxv1.HelxInst, app *helxv1.HelxApp, user *helxv1.HelxUser) (*Artifacts, error) {
+	if app != nil && user != nil {
+		if _, _, violations := BoundResources(instance, app); len(violations) != 0 {
+			return nil, fmt.Errorf("resources out of bounds: %s", strings.Join(violations, "; "))
+		}
+		if err := checkEnv(instance.Spec.Env, instance.Spec.EnvFrom); err != nil {
+			return nil, err
+		}
+		if err := checkEnvNames(nil, instance.Spec.Env); err != nil {
+			return nil, err
+		}
+		if errs := o.ValidateServiceTypes(app); len(errs) != 0 {
+			return nil, errs.ToAggregate()
+		}
+		scheduling := app.Spec.Scheduling
+		if profile, err := instProfile(instance, app); err != nil {
+			return nil, err
+		} else if profile != nil {
+			scheduling = mergeScheduling(scheduling, profile.Scheduling)
+		}
+		scheduling = mergeScheduling(scheduling, instance.Spec.Scheduling)
+		if err := checkScheduling(scheduling); err != nil {
+			return nil, err
+		}
+		containers, initContainers, volumeSourceMap, err := transformApp(instance, *app)
+		if err != nil {
+			return nil, err
+		}
+		if len(containers) >= 1 {
+			volumes := make(map[string]template_io.Volume)
+
+			for name, value := range volumeSourceMap {
+				volumes[name] = *value
+			}
+
+			var routes []template_io.Route
+			host, path := "", ""
+			if class := o.RouteClass(app); class != nil {
+				if routes, err = instRoutes(class, instance, app, user, containers); err != nil {
+					return nil, err
+				}
+				if len(routes) != 0 {
+					host, path = routes[0].Host, routes[0].Path
+				}
+			}
+
+			// the names are listed in systemEnvNames
+			systemEnv := make(map[string]string)
+			systemEnv["GUID"] = instance.Status.UUID
+			systemEnv["USER"] = user.Name
+			systemEnv["HOST"] = host
+			systemEnv["APP_CLASS_NAME"] = app.Spec.AppClassName
+			systemEnv["APP_NAME"] = app.Name
+			systemEnv["INSTANCE_NAME"] = instance.GetNamespace() + "/" + instance.GetName()
+
+			system := template_io.System{
+				AppClassName:   app.Spec.AppClassName,
+				AppName:        app.Name,
+				InstanceName:   instance.Name,
+				Containers:     containers,
+				InitContainers: initContainers,
+				Environment:    systemEnv,
+				Host:           host,
+				Path:           path,
+				UUID:           instance.Status.UUID,
+				UserName:       user.Name,
+				Volumes:        volumes,
+				Suspended:      instance.Spec.Suspended,
+
+				NodeSelector:              scheduling.NodeSelector,
+				Tolerations:               scheduling.Tolerations,
+				Affinity:                  scheduling.Affinity,
+				TopologySpreadConstraints: scheduling.TopologySpreadConstraints,
+				PriorityClassName:         scheduling.PriorityClassName,
+			}
+			if instance.Spec.RestartedAt != nil {
+				system.RestartedAt = instance.Spec.RestartedAt.UTC().Format(time.RFC3339)
+			}
+
+			if instance.Spec.SecurityContext != nil {
+				system.SecurityContext = template_io.ExtractSCFromCR(instance.Spec.SecurityContext)
+			} else if user.Spec.UserHandle != nil {
+				if user.Status.LastLookupTime != nil {
+					// the HelxUser reconciler keeps the resolved identity current
+					system.SecurityContext = template_io.ExtractSCFromCR(user.Status.SecurityContext)
+					system.UserInfo = StoredUserInfo(user)
+				} else if sc, info, err := ResolveUser(user); err != nil {
+					o.simpleErrorLogger(err, fmt.Sprintf("unable to fetch user info from %s ", *user.Spec.UserHandle))
+				} else {
+					system.UserInfo = info
+					system.SecurityContext = template_io.ExtractSCFromCR(sc)
+				}
+			}
+
+			o.simpleInfoLogger("applying templates")
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			o.clearStorage()
+
+			artifacts := Artifacts{}
+
+			if err := o.renderObject(system, "deployment", "", nil, func(render string) {
+				artifacts.Deployment = RenderArtifact{Render: render, Attr: make(map[string]string)}
+			}); err != nil {
+				return nil, err
+			}
+
+			for _, volume := range system.Volumes {
 				if volume.Scheme == "pvc" {
-					if err := renderObject(system, "pvc", "volume", volume, func(render string) {
+					if err := o.renderObject(system, "pvc", "volume", volume, func(render string) {
 						if artifacts.PVCs == nil {
 							artifacts.PVCs = make(map[string]RenderArtifact)
 						}
@@ -604,18 +1878,29 @@ func GenerateArtifacts(instance *helxv1.HelxInst) (*Artifacts, error) {
 			}
 
 			for _, container := range system.Containers {
-				if err := renderObject(system, "service", "container", container, func(render string) {
+				if err := o.renderObject(system, "service", "container", container, func(render string) {
 					if artifacts.Services == nil {
 						artifacts.Services = make(map[string]RenderArtifact)
 					}
-					simpleDebugLogger(fmt.Sprintf("processing service %s", container.Name))
-					simpleDebugLogger(fmt.Sprintf("render = %s", render))
+					o.simpleDebugLogger(fmt.Sprintf("processing service %s", container.Name))
+					o.simpleDebugLogger(fmt.Sprintf("render = %s", render))
 					artifacts.Services[container.Name] = RenderArtifact{Render: render, Attr: make(map[string]string)}
 				}); err != nil {
 					return nil, err
 				}
 			}
 
+			for _, route := range routes {
+				if err := o.renderObject(system, "ingress", "route", route, func(render string) {
+					if artifacts.Routes == nil {
+						artifacts.Routes = make(map[string]RenderArtifact)
+					}
+					artifacts.Routes[route.Name] = RenderArtifact{Render: render, Attr: map[string]string{"kind": route.Kind}}
+				}); err != nil {
+					return nil, err
+				}
+			}
+
 			return &artifacts, nil
 		}
 	}
@@ -623,6 +1908,7 @@ func GenerateArtifacts(instance *helxv1.HelxInst) (*Artifacts, error) {
 }
 
 func CreateOrUpdateResource[T client.Object](
+	o *Operations,
 	ctx context.Context,
 	c client.Client,
 	scheme *runtime.Scheme,
@@ -630,12 +1916,12 @@ func CreateOrUpdateResource[T client.Object](
 	instance *helxv1.HelxInst,
 	src string,
 	getTarget func() (T, error),
-	acceptablePatchOp func(jsonpatch.JsonPatchOperation) bool) error {
+	acceptablePatchOp func(jsonpatch.JsonPatchOperation) bool) (controllerutil.OperationResult, error) {
 
 	target, err := getTarget()
 
 	if err != nil {
-		return err
+		return controllerutil.OperationResultNone, err
 	}
 	// Set the Namespace and Name for the Resource if it's not set
 	if target.GetNamespace() == "" {
@@ -645,74 +1931,151 @@ func CreateOrUpdateResource[T client.Object](
 		target.SetName(req.NamespacedName.Name)
 	}
 
+	// Retained objects outlive the HelxInst, so they are not owned by it
+	if IsRetained(target) {
+		o.simpleInfoLogger(fmt.Sprintf("Skipping setting controller reference for %s as it has the retain label set to true", GetNamespacedName(target)))
+	} else if err := ctrl.SetControllerReference(instance, target, scheme); err != nil {
+		// Set the controller reference so that the Resource will be deleted when the HelxInst is deleted
+		return controllerutil.OperationResultNone, err
+	}
+
 	// Check if the resource already exists
 	existing := target.DeepCopyObject().(T)
 
 	err = c.Get(ctx, types.NamespacedName{Name: target.GetName(), Namespace: target.GetNamespace()}, existing)
 	if err != nil && errors.IsNotFound(err) {
 		// Resource does not exist, create it
-		simpleInfoLogger(fmt.Sprintf("creating resource %s", GetNamespacedName(target)))
-
-		// Check for the retain label before setting the controller reference
-		labels := target.GetLabels()
-		if retain, exists := labels["helx.renci.org/retain"]; !exists || retain != "true" {
-			// Set the controller reference so that the Resource will be deleted when the HelxInst is deleted
-			if err := ctrl.SetControllerReference(instance, target, scheme); err != nil {
-				return err
-			}
-		} else {
-			// Optionally, log or handle the case where the retain label is set to true
-			simpleInfoLogger(fmt.Sprintf("Skipping setting controller reference for %s as it has the retain label set to true", GetNamespacedName(target)))
-		}
+		o.simpleInfoLogger(fmt.Sprintf("creating resource %s", GetNamespacedName(target)))
 		if err := c.Create(ctx, target); err != nil {
-			return err
+			return controllerutil.OperationResultNone, err
 		}
+		return controllerutil.OperationResultCreated, nil
 	} else if err != nil {
-		return err
-	} else {
-		simpleInfoLogger(fmt.Sprintf("patching resource %s", GetNamespacedName(existing)))
+		return controllerutil.OperationResultNone, err
+	}
 
-		// Marshal both objects to JSON
-		existingJSON, err := json.Marshal(existing)
-		if err != nil {
-			return fmt.Errorf("failed to marshal existing object: %v", err)
-		}
-		simpleDebugLogger(fmt.Sprintf("existingJSON:\n%s", existingJSON))
-		targetJSON, err := json.Marshal(target)
-		if err != nil {
-			return fmt.Errorf("failed to marshal target object: %v", err)
-		}
-		simpleDebugLogger(fmt.Sprintf("targetJSON:\n%s", targetJSON))
+	// Marshal both objects to JSON
+	existingJSON, err := json.Marshal(existing)
+	if err != nil {
+		return controllerutil.OperationResultNone, fmt.Errorf("failed to marshal existing object: %v", err)
+	}
+	o.simpleDebugLogger(fmt.Sprintf("existingJSON:\n%s", existingJSON))
+	targetJSON, err := json.Marshal(target)
+	if err != nil {
+		return controllerutil.OperationResultNone, fmt.Errorf("failed to marshal target object: %v", err)
+	}
+	o.simpleDebugLogger(fmt.Sprintf("targetJSON:\n%s", targetJSON))
 
-		// Compute the JSON Patch
-		patch, err := jsonpatch.CreatePatch(existingJSON, targetJSON)
-		if err != nil {
-			return fmt.Errorf("failed to create JSON patch: %v", err)
-		}
+	// Compute the JSON Patch
+	patch, err := jsonpatch.CreatePatch(existingJSON, targetJSON)
+	if err != nil {
+		return controllerutil.OperationResultNone, fmt.Errorf("failed to create JSON patch: %v", err)
+	}
 
-		var filteredPatch []jsonpatch.JsonPatchOperation
+	var live interface{}
+	if err := json.Unmarshal(existingJSON, &live); err != nil {
+		return controllerutil.OperationResultNone, fmt.Errorf("failed to decode existing object: %v", err)
+	}
 
-		for _, op := range patch {
-			if found := acceptablePatchOp(op); found {
-				filteredPatch = append(filteredPatch, op)
-			}
-		}
+	var filteredPatch []jsonpatch.JsonPatchOperation
 
-		// Apply the JSON Patch
-		patchBytes, err := json.Marshal(filteredPatch)
-		if err != nil {
-			return fmt.Errorf("failed to marshal JSON patch: %v", err)
+	for _, op := range patch {
+		if isDrift(op) && !sameValue(live, op) && acceptablePatchOp(op) {
+			filteredPatch = append(filteredPatch, op)
 		}
-		simpleDebugLogger(fmt.Sprintf("patch:\n%s", patchBytes))
-		if err := c.Patch(ctx, existing, client.RawPatch(types.JSONPatchType, patchBytes)); err != nil {
-			return fmt.Errorf("failed to apply patch: %v", err)
+	}
+
+	// The live object still matches the render
+	if len(filteredPatch) == 0 {
+		return controllerutil.OperationResultNone, nil
+	}
+
+	// Apply the JSON Patch
+	o.simpleInfoLogger(fmt.Sprintf("patching resource %s", GetNamespacedName(existing)))
+	patchBytes, err := json.Marshal(filteredPatch)
+	if err != nil {
+		return controllerutil.OperationResultNone, fmt.Errorf("failed to marshal JSON patch: %v", err)
+	}
+	o.simpleDebugLogger(fmt.Sprintf("patch:\n%s", patchBytes))
+	if err := c.Patch(ctx, existing, client.RawPatch(types.JSONPatchType, patchBytes)); err != nil {
+		return controllerutil.OperationResultNone, fmt.Errorf("failed to apply patch: %v", err)
+	}
+
+	o.simpleInfoLogger("Resource updated successfully")
+	return controllerutil.OperationResultUpdated, nil
+}
+
+// driftPaths are the parts of a derived object the render owns. Everything
+// else (status, server-managed metadata) belongs to the API server or the
+// workload controllers.
+var driftPaths = []string{"/spec", "/data", "/metadata/labels", "/metadata/annotations", "/metadata/ownerReferences"}
+
+// isDrift reports whether a patch operation from the live object to the
+// render repairs drift: something the render sets is missing or different.
+// Removing a map key only strips a server default or a field another
+// controller added, so it is not drift; removing a list element is.
+func isDrift(op jsonpatch.JsonPatchOperation) bool {
+	owned := false
+	for _, prefix := range driftPaths {
+		if op.Path == prefix || strings.HasPrefix(op.Path, prefix+"/") {
+			owned = true
+			break
 		}
+	}
+	if !owned {
+		return false
+	}
+	if op.Operation == "remove" {
+		_, err := strconv.Atoi(op.Path[strings.LastIndex(op.Path, "/")+1:])
+		return err == nil
+	}
+	return true
+}
 
-		simpleInfoLogger("Resource updated successfully")
-		return nil
+// sameValue reports whether a replace operation only respells the live
+// value, such as a quantity the API server normalized (1000m and 1, 1Gi and
+// 1024Mi), so that it is not re-patched on every reconcile.
+func sameValue(live interface{}, op jsonpatch.JsonPatchOperation) bool {
+	if op.Operation != "replace" {
+		return false
+	}
+	current := live
+	for _, token := range strings.Split(op.Path, "/")[1:] {
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch value := current.(type) {
+		case map[string]interface{}:
+			current = value[token]
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(value) {
+				return false
+			}
+			current = value[index]
+		default:
+			return false
+		}
 	}
+	liveQuantity, ok := quantityValue(current)
+	if !ok {
+		return false
+	}
+	renderQuantity, ok := quantityValue(op.Value)
+	return ok && liveQuantity.Cmp(renderQuantity) == 0
+}
 
-	return nil
+// quantityValue reads a JSON string or number as a resource.Quantity.
+func quantityValue(value interface{}) (resource.Quantity, bool) {
+	var text string
+	switch value := value.(type) {
+	case string:
+		text = value
+	case float64:
+		text = strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return resource.Quantity{}, false
+	}
+	quantity, err := resource.ParseQuantity(text)
+	return quantity, err == nil
 }
 
 func DeleteDeployments(ctx context.Context, c client.Client, instance *helxv1.HelxInst) error {
@@ -720,7 +2083,7 @@ func DeleteDeployments(ctx context.Context, c client.Client, instance *helxv1.He
 
 	listOpts := []client.ListOption{
 		client.InNamespace(instance.ObjectMeta.Namespace),
-		client.MatchingLabels{"helx.renci.org/id": instance.Status.UUID},
+		client.MatchingLabels{IDLabel: instance.Status.UUID},
 	}
 
 	if err := c.List(ctx, deployments, listOpts...); err != nil {
@@ -728,7 +2091,7 @@ func DeleteDeployments(ctx context.Context, c client.Client, instance *helxv1.He
 	}
 
 	for _, deployment := range deployments.Items {
-		if retain, found := deployment.ObjectMeta.Labels["helx.renci.org/retain"]; !found || retain != "true" {
+		if retain, found := deployment.ObjectMeta.Labels[RetainLabel]; !found || retain != "true" {
 			if err := c.Delete(ctx, &deployment, client.PropagationPolicy(metav1.DeletePropagationForeground)); err != nil {
 				return fmt.Errorf("failed to delete deployment: %v", err)
 			}
@@ -742,7 +2105,7 @@ func DeletePVCs(ctx context.Context, c client.Client, instance *helxv1.HelxInst)
 
 	listOpts := []client.ListOption{
 		client.InNamespace(instance.ObjectMeta.Namespace),
-		client.MatchingLabels{"helx.renci.org/id": instance.Status.UUID},
+		client.MatchingLabels{IDLabel: instance.Status.UUID},
 	}
 
 	if err := c.List(ctx, pvcs, listOpts...); err != nil {
@@ -750,7 +2113,7 @@ func DeletePVCs(ctx context.Context, c client.Client, instance *helxv1.HelxInst)
 	}
 
 	for _, pvc := range pvcs.Items {
-		if retain, found := pvc.ObjectMeta.Labels["helx.renci.org/retain"]; !found || retain != "true" {
+		if retain, found := pvc.ObjectMeta.Labels[RetainLabel]; !found || retain != "true" {
 			if err := c.Delete(ctx, &pvc, client.PropagationPolicy(metav1.DeletePropagationForeground)); err != nil {
 				return fmt.Errorf("failed to delete pvc: %v", err)
 			}
@@ -760,11 +2123,18 @@ func DeletePVCs(ctx context.Context, c client.Client, instance *helxv1.HelxInst)
 }
 
 func DeleteServices(ctx context.Context, c client.Client, instance *helxv1.HelxInst) error {
+	return deleteServicesExcept(ctx, c, instance, nil)
+}
+
+// deleteServicesExcept deletes the instance's Services other than those
+// named in keep, such as ones a rename of the app's services left behind.
+// Retained Services are kept.
+func deleteServicesExcept(ctx context.Context, c client.Client, instance *helxv1.HelxInst, keep map[string]bool) error {
 	var services *corev1.ServiceList = new(corev1.ServiceList)
 
 	listOpts := []client.ListOption{
 		client.InNamespace(instance.ObjectMeta.Namespace),
-		client.MatchingLabels{"helx.renci.org/id": instance.Status.UUID},
+		client.MatchingLabels{IDLabel: instance.Status.UUID},
 	}
 
 	if err := c.List(ctx, services, listOpts...); err != nil {
@@ -772,7 +2142,10 @@ func DeleteServices(ctx context.Context, c client.Client, instance *helxv1.HelxI
 	}
 
 	for _, service := range services.Items {
-		if retain, found := service.ObjectMeta.Labels["helx.renci.org/retain"]; !found || retain != "true" {
+		if keep[service.Name] {
+			continue
+		}
+		if retain, found := service.ObjectMeta.Labels[RetainLabel]; !found || retain != "true" {
 			if err := c.Delete(ctx, &service, client.PropagationPolicy(metav1.DeletePropagationForeground)); err != nil {
 				return fmt.Errorf("failed to delete service: %v", err)
 			}
@@ -781,13 +2154,61 @@ func DeleteServices(ctx context.Context, c client.Client, instance *helxv1.HelxI
 	return nil
 }
 
-func DeploymentFromYAML(ctx context.Context, c client.Client, scheme *runtime.Scheme, req ctrl.Request, instance *helxv1.HelxInst, artifact RenderArtifact) error {
-	return CreateOrUpdateResource(ctx, c, scheme, req, instance, artifact.Render,
+// HTTPRouteGVK is the Gateway API HTTPRoute, which is handled as
+// unstructured so that clusters without the Gateway API CRDs need nothing.
+var HTTPRouteGVK = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1", Kind: "HTTPRoute"}
+
+func DeleteRoutes(ctx context.Context, c client.Client, instance *helxv1.HelxInst) error {
+	return deleteRoutesExcept(ctx, c, instance, nil)
+}
+
+// deleteRoutesExcept deletes the instance's Ingresses and HTTPRoutes other
+// than those named in keep. Retained routes are kept, and HTTPRoutes are
+// skipped on clusters that do not serve the Gateway API.
+func deleteRoutesExcept(ctx context.Context, c client.Client, instance *helxv1.HelxInst, keep map[string]bool) error {
+	var ingresses *networkingv1.IngressList = new(networkingv1.IngressList)
+	httpRoutes := &unstructured.UnstructuredList{}
+	httpRoutes.SetGroupVersionKind(HTTPRouteGVK.GroupVersion().WithKind(HTTPRouteGVK.Kind + "List"))
+
+	listOpts := []client.ListOption{
+		client.InNamespace(instance.ObjectMeta.Namespace),
+		client.MatchingLabels{IDLabel: instance.Status.UUID},
+	}
+
+	if err := c.List(ctx, ingresses, listOpts...); err != nil {
+		return fmt.Errorf("failed to get ingress list: %v", err)
+	}
+	var routes []client.Object
+	for i := range ingresses.Items {
+		routes = append(routes, &ingresses.Items[i])
+	}
+	if err := c.List(ctx, httpRoutes, listOpts...); err != nil && !meta.IsNoMatchError(err) {
+		return fmt.Errorf("failed to get httproute list: %v", err)
+	}
+	for i := range httpRoutes.Items {
+		routes = append(routes, &httpRoutes.Items[i])
+	}
+
+	for _, route := range routes {
+		if keep[route.GetName()] {
+			continue
+		}
+		if retain, found := route.GetLabels()[RetainLabel]; !found || retain != "true" {
+			if err := c.Delete(ctx, route, client.PropagationPolicy(metav1.DeletePropagationForeground)); err != nil {
+				return fmt.Errorf("failed to delete route: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (o *Operations) DeploymentFromYAML(ctx context.Context, c client.Client, scheme *runtime.Scheme, req ctrl.Request, instance *helxv1.HelxInst, artifact RenderArtifact) (controllerutil.OperationResult, error) {
+	return CreateOrUpdateResource(o, ctx, c, scheme, req, instance, artifact.Render,
 		func() (*appsv1.Deployment, error) {
 			decode := yaml.NewYAMLOrJSONDecoder(strings.NewReader(artifact.Render), 100)
 			var deployment appsv1.Deployment
 
-			simpleInfoLogger("creating deployment from string")
+			o.simpleInfoLogger("creating deployment from string")
 			if err := decode.Decode(&deployment); err != nil {
 				return nil, err
 			}
@@ -798,13 +2219,13 @@ func DeploymentFromYAML(ctx context.Context, c client.Client, scheme *runtime.Sc
 		})
 }
 
-func PVCFromYAML(ctx context.Context, c client.Client, scheme *runtime.Scheme, req ctrl.Request, instance *helxv1.HelxInst, artifact RenderArtifact) error {
-	return CreateOrUpdateResource(ctx, c, scheme, req, instance, artifact.Render,
+func (o *Operations) PVCFromYAML(ctx context.Context, c client.Client, scheme *runtime.Scheme, req ctrl.Request, instance *helxv1.HelxInst, artifact RenderArtifact) (controllerutil.OperationResult, error) {
+	return CreateOrUpdateResource(o, ctx, c, scheme, req, instance, artifact.Render,
 		func() (*corev1.PersistentVolumeClaim, error) {
 			decode := yaml.NewYAMLOrJSONDecoder(strings.NewReader(artifact.Render), 100)
 			var pvc corev1.PersistentVolumeClaim
 
-			simpleInfoLogger("creating pvc from string")
+			o.simpleInfoLogger("creating pvc from string")
 			if err := decode.Decode(&pvc); err != nil {
 				return nil, err
 			}
@@ -819,16 +2240,22 @@ func PVCFromYAML(ctx context.Context, c client.Client, scheme *runtime.Scheme, r
 		})
 }
 
-func ServiceFromYAML(ctx context.Context, c client.Client, scheme *runtime.Scheme, req ctrl.Request, instance *helxv1.HelxInst, artifact RenderArtifact) error {
-	return CreateOrUpdateResource(ctx, c, scheme, req, instance, artifact.Render,
+func (o *Operations) ServiceFromYAML(ctx context.Context, c client.Client, scheme *runtime.Scheme, req ctrl.Request, instance *helxv1.HelxInst, artifact RenderArtifact) (controllerutil.OperationResult, error) {
+	return CreateOrUpdateResource(o, ctx, c, scheme, req, instance, artifact.Render,
 		func() (*corev1.Service, error) {
 			decode := yaml.NewYAMLOrJSONDecoder(strings.NewReader(artifact.Render), 100)
 			var service corev1.Service
 
-			simpleInfoLogger("creating service from string")
+			o.simpleInfoLogger("creating service from string")
 			if err := decode.Decode(&service); err != nil {
 				return nil, err
 			}
+			if service.Namespace == "" {
+				service.Namespace = req.Namespace
+			}
+			if err := deleteReplacedService(ctx, c, &service); err != nil {
+				return nil, err
+			}
 			return &service, nil
 		},
 		func(op jsonpatch.JsonPatchOperation) bool {
@@ -836,52 +2263,737 @@ func ServiceFromYAML(ctx context.Context, c client.Client, scheme *runtime.Schem
 		})
 }
 
-func CreateDerivatives(instance *helxv1.HelxInst, c client.Client, scheme *runtime.Scheme, req ctrl.Request, ctx context.Context) error {
-	if artifacts, err := GenerateArtifacts(instance); err == nil {
-		if artifacts != nil && artifacts.Deployment.Render != "" {
-			simpleInfoLogger("generated Deployment YAML")
-			simpleDebugLogger(artifacts.Deployment.Render)
-			if err = DeploymentFromYAML(ctx, c, scheme, req, instance, artifacts.Deployment); err != nil {
-				simpleErrorLogger(err, fmt.Sprintf("unable to create or update deployment NamespacedName: %s", req.NamespacedName))
-			} else {
-				for name, PVC := range artifacts.PVCs {
-					if PVC.Render != "" {
-						simpleInfoLogger("generated PVC YAML")
-						simpleDebugLogger(PVC.Render)
-						if err = PVCFromYAML(ctx, c, scheme, req, instance, PVC); err != nil {
-							simpleErrorLogger(err, fmt.Sprintf("unable to create or update pvc PVCName: %s NamespacedName: %s ", name, req.NamespacedName))
-						}
-					}
+// deleteReplacedService deletes the live Service when the render changes its
+// type or switches it between a cluster IP and headless. spec.clusterIP cannot
+// be changed, and dropping it is not drift, so such a Service is recreated
+// rather than patched.
+func deleteReplacedService(ctx context.Context, c client.Client, service *corev1.Service) error {
+	live := &corev1.Service{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(service), live); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if live.DeletionTimestamp != nil {
+		return fmt.Errorf("service %s is still being deleted", service.Name)
+	}
+	if live.Spec.Type == service.Spec.Type && isHeadless(live) == isHeadless(service) {
+		return nil
+	}
+	return client.IgnoreNotFound(c.Delete(ctx, live))
+}
+
+// isHeadless reports whether a Service has no cluster IP.
+func isHeadless(service *corev1.Service) bool {
+	return service.Spec.ClusterIP == corev1.ClusterIPNone
+}
+
+// RouteFromYAML applies a rendered Ingress, or an HTTPRoute when the
+// artifact's kind attribute says so.
+func (o *Operations) RouteFromYAML(ctx context.Context, c client.Client, scheme *runtime.Scheme, req ctrl.Request, instance *helxv1.HelxInst, artifact RenderArtifact) (controllerutil.OperationResult, error) {
+	if artifact.Attr["kind"] == string(RouteKindHTTPRoute) {
+		return CreateOrUpdateResource(o, ctx, c, scheme, req, instance, artifact.Render,
+			func() (*unstructured.Unstructured, error) {
+				var route unstructured.Unstructured
+
+				o.simpleInfoLogger("creating httproute from string")
+				data, err := sigsyaml.YAMLToJSON([]byte(artifact.Render))
+				if err != nil {
+					return nil, err
 				}
-				for name, service := range artifacts.Services {
-					if service.Render != "" {
-						simpleInfoLogger("generated Service YAML:")
-						simpleDebugLogger(service.Render)
-						if err = ServiceFromYAML(ctx, c, scheme, req, instance, service); err != nil {
-							simpleErrorLogger(err, fmt.Sprintf("unable to create or update service Service Name: %s NamespacedName: %s", name, req.NamespacedName))
-						}
-					}
+				if err := route.UnmarshalJSON(data); err != nil {
+					return nil, err
 				}
+				return &route, nil
+			},
+			func(op jsonpatch.JsonPatchOperation) bool {
+				return true
+			})
+	}
+	return CreateOrUpdateResource(o, ctx, c, scheme, req, instance, artifact.Render,
+		func() (*networkingv1.Ingress, error) {
+			decode := yaml.NewYAMLOrJSONDecoder(strings.NewReader(artifact.Render), 100)
+			var ingress networkingv1.Ingress
+
+			o.simpleInfoLogger("creating ingress from string")
+			if err := decode.Decode(&ingress); err != nil {
+				return nil, err
+			}
+			return &ingress, nil
+		},
+		func(op jsonpatch.JsonPatchOperation) bool {
+			return true
+		})
+}
+
+// setInstCondition records a condition on the instance status, stamped with
+// the generation it was computed from.
+func setInstCondition(instance *helxv1.HelxInst, condType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&instance.Status.Conditions, metav1.Condition{
+		Type:               condType,
+		Status:             status,
+		ObservedGeneration: instance.Generation,
+		Reason:             reason,
+		Message:            message,
+	})
+}
+
+// updateInstPhase derives the summary phase from the instance conditions.
+func updateInstPhase(instance *helxv1.HelxInst) {
+	conditions := instance.Status.Conditions
+
+	switch {
+	case !meta.IsStatusConditionTrue(conditions, helxv1.HelxInstConditionAppResolved),
+		!meta.IsStatusConditionTrue(conditions, helxv1.HelxInstConditionUserResolved),
+		meta.IsStatusConditionTrue(conditions, helxv1.HelxInstConditionQuotaExceeded):
+		instance.Status.Phase = helxv1.HelxInstPhasePending
+	case meta.IsStatusConditionFalse(conditions, helxv1.HelxInstConditionResourcesBounded),
+		meta.IsStatusConditionFalse(conditions, helxv1.HelxInstConditionRendered),
+		meta.IsStatusConditionFalse(conditions, helxv1.HelxInstConditionApplied):
+		instance.Status.Phase = helxv1.HelxInstPhaseFailed
+	case instance.Spec.Suspended:
+		instance.Status.Phase = helxv1.HelxInstPhaseSuspended
+	case meta.IsStatusConditionTrue(conditions, helxv1.HelxInstConditionReady):
+		instance.Status.Phase = helxv1.HelxInstPhaseRunning
+	default:
+		instance.Status.Phase = helxv1.HelxInstPhaseDeploying
+	}
+}
+
+// observeWorkload records the state of the Deployments and newest pod
+// carrying the instance id on the instance status, and reports whether any
+// Deployment has an available replica.
+func observeWorkload(ctx context.Context, c client.Client, instance *helxv1.HelxInst) (bool, error) {
+	var deployments *appsv1.DeploymentList = new(appsv1.DeploymentList)
+	var pods *corev1.PodList = new(corev1.PodList)
+
+	listOpts := []client.ListOption{
+		client.InNamespace(instance.ObjectMeta.Namespace),
+		client.MatchingLabels{IDLabel: instance.Status.UUID},
+	}
+
+	if err := c.List(ctx, deployments, listOpts...); err != nil {
+		return false, fmt.Errorf("failed to get deployment list: %v", err)
+	}
+	instance.Status.AvailableReplicas = 0
+	for _, deployment := range deployments.Items {
+		instance.Status.AvailableReplicas += deployment.Status.AvailableReplicas
+	}
+
+	if err := c.List(ctx, pods, listOpts...); err != nil {
+		return false, fmt.Errorf("failed to get pod list: %v", err)
+	}
+	var newest *corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil {
+			continue
+		}
+		if newest == nil || newest.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			newest = pod
+		}
+	}
+	instance.Status.PodName, instance.Status.PodPhase, instance.Status.PodIP, instance.Status.Containers = "", "", "", nil
+	if newest != nil {
+		instance.Status.PodName = newest.Name
+		instance.Status.PodPhase = string(newest.Status.Phase)
+		instance.Status.PodIP = newest.Status.PodIP
+		for _, cs := range newest.Status.InitContainerStatuses {
+			status := helxv1.HelxInstContainerStatus{Name: cs.Name, Init: true, Ready: cs.Ready, RestartCount: cs.RestartCount}
+			if cs.State.Waiting != nil {
+				status.Reason, status.Message = cs.State.Waiting.Reason, cs.State.Waiting.Message
+			} else if cs.State.Terminated != nil && cs.State.Terminated.ExitCode != 0 {
+				// an init container that completed is not a problem
+				status.Reason, status.Message = cs.State.Terminated.Reason, cs.State.Terminated.Message
+			}
+			instance.Status.Containers = append(instance.Status.Containers, status)
+		}
+		for _, cs := range newest.Status.ContainerStatuses {
+			status := helxv1.HelxInstContainerStatus{Name: cs.Name, Ready: cs.Ready, RestartCount: cs.RestartCount}
+			if cs.State.Waiting != nil {
+				status.Reason, status.Message = cs.State.Waiting.Reason, cs.State.Waiting.Message
+			} else if cs.State.Terminated != nil {
+				status.Reason, status.Message = cs.State.Terminated.Reason, cs.State.Terminated.Message
+			}
+			instance.Status.Containers = append(instance.Status.Containers, status)
+		}
+	}
+	return instance.Status.AvailableReplicas > 0, nil
+}
+
+// InstDeadline resolves when the instance expires: the earlier of
+// creationTimestamp+spec.ttl and spec.expiresAt, or nil if neither is set.
+func InstDeadline(instance *helxv1.HelxInst) *metav1.Time {
+	var deadline *metav1.Time
+	if instance.Spec.TTL != nil {
+		deadline = &metav1.Time{Time: instance.CreationTimestamp.Add(instance.Spec.TTL.Duration)}
+	}
+	if instance.Spec.ExpiresAt != nil && (deadline == nil || instance.Spec.ExpiresAt.Before(deadline)) {
+		deadline = instance.Spec.ExpiresAt.DeepCopy()
+	}
+	return deadline
+}
+
+// ObserveExpiry records the instance deadline on its status and sets the
+// Expiring condition once now is within warning of it, emitting a warning
+// Event the first time. It reports whether the deadline has passed and,
+// if not, how long until the next point the instance must be looked at again.
+func ObserveExpiry(recorder record.EventRecorder, instance *helxv1.HelxInst, now time.Time, warning time.Duration) (bool, time.Duration) {
+	deadline := InstDeadline(instance)
+	instance.Status.ExpiresAt = deadline
+	if deadline == nil {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, helxv1.HelxInstConditionExpiring)
+		return false, 0
+	}
+
+	remaining := deadline.Sub(now)
+	if remaining <= 0 {
+		recordEvent(recorder, instance, corev1.EventTypeWarning, "Expired", "instance expired at %s and is being deleted", deadline.UTC().Format(time.RFC3339))
+		return true, 0
+	}
+	if remaining > warning {
+		setInstCondition(instance, helxv1.HelxInstConditionExpiring, metav1.ConditionFalse, "Scheduled", fmt.Sprintf("instance expires at %s", deadline.UTC().Format(time.RFC3339)))
+		return false, remaining - warning
+	}
+	if !meta.IsStatusConditionTrue(instance.Status.Conditions, helxv1.HelxInstConditionExpiring) {
+		recordEvent(recorder, instance, corev1.EventTypeWarning, "ExpiringSoon", "instance will be deleted at %s", deadline.UTC().Format(time.RFC3339))
+	}
+	setInstCondition(instance, helxv1.HelxInstConditionExpiring, metav1.ConditionTrue, "ExpiringSoon", fmt.Sprintf("instance will be deleted at %s", deadline.UTC().Format(time.RFC3339)))
+	return false, remaining
+}
+
+// containerProblems describes the containers of the instance's pod that are
+// waiting or terminated, for the Ready condition message.
+func containerProblems(instance *helxv1.HelxInst) string {
+	var problems []string
+	for _, status := range instance.Status.Containers {
+		if status.Reason != "" {
+			kind := "container"
+			if status.Init {
+				kind = "init container"
+			}
+			problems = append(problems, fmt.Sprintf("%s %s %s", kind, status.Name, status.Reason))
+		}
+	}
+	return strings.Join(problems, ", ")
+}
+
+// serviceEndpoints lists every port of every rendered Service with its
+// in-cluster address and the container it routes to, sorted so the status
+// does not change with map order.
+func serviceEndpoints(namespace string, services map[string]RenderArtifact) ([]helxv1.HelxInstEndpoint, error) {
+	var endpoints []helxv1.HelxInstEndpoint
+	seen := make(map[string]bool)
+	for _, artifact := range services {
+		if artifact.Render == "" {
+			continue
+		}
+		var service corev1.Service
+		if err := yaml.NewYAMLOrJSONDecoder(strings.NewReader(artifact.Render), 100).Decode(&service); err != nil {
+			return nil, err
+		}
+		if service.Namespace != "" {
+			namespace = service.Namespace
+		}
+		host := fmt.Sprintf("%s.%s.svc", service.Name, namespace)
+		for _, port := range service.Spec.Ports {
+			key := fmt.Sprintf("%s:%d/%s", host, port.Port, port.Protocol)
+			if seen[key] {
+				continue
 			}
+			seen[key] = true
+			endpoints = append(endpoints, helxv1.HelxInstEndpoint{
+				Service:   service.Name,
+				Container: service.Labels[ContainerLabel],
+				Name:      port.Name,
+				Host:      host,
+				Port:      port.Port,
+				Protocol:  string(port.Protocol),
+			})
 		}
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		if endpoints[i].Host != endpoints[j].Host {
+			return endpoints[i].Host < endpoints[j].Host
+		}
+		return endpoints[i].Port < endpoints[j].Port
+	})
+	return endpoints, nil
+}
+
+// recordEvent emits an event on obj; a nil recorder discards it.
+func recordEvent(recorder record.EventRecorder, obj runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	if recorder != nil {
+		recorder.Eventf(obj, eventType, reason, messageFmt, args...)
+	}
+}
+
+// recordApply emits an event describing what an apply did to a derived object.
+func recordApply(recorder record.EventRecorder, instance *helxv1.HelxInst, kind, name string, result controllerutil.OperationResult) {
+	switch result {
+	case controllerutil.OperationResultCreated:
+		recordEvent(recorder, instance, corev1.EventTypeNormal, "Created", "created %s %s", kind, name)
+	case controllerutil.OperationResultUpdated:
+		recordEvent(recorder, instance, corev1.EventTypeNormal, "Patched", "patched %s %s", kind, name)
+	}
+}
+
+func (o *Operations) CreateDerivatives(instance *helxv1.HelxInst, c client.Client, scheme *runtime.Scheme, recorder record.EventRecorder, req ctrl.Request, ctx context.Context) error {
+	defer updateInstPhase(instance)
+
+	appName := GetAppNameFromInst(instance)
+	userName := GetUserNameFromInst(instance)
+
+	app, err := GetApp(ctx, c, appName)
+	if err != nil {
+		return err
+	}
+	user, err := GetUser(ctx, c, userName)
+	if err != nil {
 		return err
+	}
+
+	if app == nil {
+		if !meta.IsStatusConditionFalse(instance.Status.Conditions, helxv1.HelxInstConditionAppResolved) {
+			recordEvent(recorder, instance, corev1.EventTypeNormal, "WaitingForApp", "waiting for HelxApp %s", appName)
+		}
+		setInstCondition(instance, helxv1.HelxInstConditionAppResolved, metav1.ConditionFalse, "AppNotFound", fmt.Sprintf("waiting for HelxApp %s", appName))
+	} else {
+		setInstCondition(instance, helxv1.HelxInstConditionAppResolved, metav1.ConditionTrue, "AppFound", fmt.Sprintf("HelxApp %s found", appName))
+	}
+	if user == nil {
+		if !meta.IsStatusConditionFalse(instance.Status.Conditions, helxv1.HelxInstConditionUserResolved) {
+			recordEvent(recorder, instance, corev1.EventTypeNormal, "WaitingForUser", "waiting for HelxUser %s", userName)
+		}
+		setInstCondition(instance, helxv1.HelxInstConditionUserResolved, metav1.ConditionFalse, "UserNotFound", fmt.Sprintf("waiting for HelxUser %s", userName))
+	} else {
+		setInstCondition(instance, helxv1.HelxInstConditionUserResolved, metav1.ConditionTrue, "UserFound", fmt.Sprintf("HelxUser %s found", userName))
+	}
+
+	if app != nil && hasResourceBounds(app) {
+		resources, adjustments, violations := BoundResources(instance, app)
+		instance.Status.Resources = resources
+		switch {
+		case len(violations) != 0:
+			message := strings.Join(violations, "; ")
+			if !meta.IsStatusConditionFalse(instance.Status.Conditions, helxv1.HelxInstConditionResourcesBounded) {
+				recordEvent(recorder, instance, corev1.EventTypeWarning, "OutOfBounds", "resources outside HelxApp %s resourceBounds: %s", appName, message)
+			}
+			setInstCondition(instance, helxv1.HelxInstConditionResourcesBounded, metav1.ConditionFalse, "OutOfBounds", message)
+			return nil
+		case len(adjustments) == 0:
+			setInstCondition(instance, helxv1.HelxInstConditionResourcesBounded, metav1.ConditionTrue, "WithinBounds", fmt.Sprintf("within HelxApp %s resourceBounds", appName))
+		case app.Spec.ResourcePolicy == helxv1.ResourcePolicyClamp:
+			setInstCondition(instance, helxv1.HelxInstConditionResourcesBounded, metav1.ConditionTrue, "Clamped", strings.Join(adjustments, "; "))
+		default:
+			setInstCondition(instance, helxv1.HelxInstConditionResourcesBounded, metav1.ConditionTrue, "Defaulted", strings.Join(adjustments, "; "))
+		}
+	} else {
+		instance.Status.Resources = nil
+		meta.RemoveStatusCondition(&instance.Status.Conditions, helxv1.HelxInstConditionResourcesBounded)
+	}
+
+	if user != nil && user.Spec.Quota != nil && app != nil {
+		message, err := CheckQuota(ctx, c, instance, user)
+		if err != nil {
+			return err
+		}
+		if message != "" {
+			if !meta.IsStatusConditionTrue(instance.Status.Conditions, helxv1.HelxInstConditionQuotaExceeded) {
+				recordEvent(recorder, instance, corev1.EventTypeWarning, "QuotaExceeded", "HelxUser %s quota exceeded: %s", userName, message)
+			}
+			setInstCondition(instance, helxv1.HelxInstConditionQuotaExceeded, metav1.ConditionTrue, "QuotaExceeded", message)
+			return nil
+		}
+		setInstCondition(instance, helxv1.HelxInstConditionQuotaExceeded, metav1.ConditionFalse, "WithinQuota", fmt.Sprintf("within HelxUser %s quota", userName))
 	} else {
+		meta.RemoveStatusCondition(&instance.Status.Conditions, helxv1.HelxInstConditionQuotaExceeded)
+	}
+
+	artifacts, err := o.GenerateArtifacts(instance, app, user)
+	if err != nil {
+		setInstCondition(instance, helxv1.HelxInstConditionRendered, metav1.ConditionFalse, "RenderFailed", err.Error())
+		recordEvent(recorder, instance, corev1.EventTypeWarning, "RenderFailed", "unable to render HelxApp %s: %v", appName, err)
+		return err
+	}
+	if artifacts == nil || artifacts.Deployment.Render == "" {
+		if app != nil && user != nil {
+			setInstCondition(instance, helxv1.HelxInstConditionRendered, metav1.ConditionFalse, "NoContainers", "HelxApp produced no containers")
+			recordEvent(recorder, instance, corev1.EventTypeWarning, "NoContainers", "HelxApp %s produced no containers", appName)
+		}
+		return nil
+	}
+	setInstCondition(instance, helxv1.HelxInstConditionRendered, metav1.ConditionTrue, "Rendered", "artifacts rendered")
+	if instance.Status.Endpoints, err = serviceEndpoints(instance.Namespace, artifacts.Services); err != nil {
+		o.simpleErrorLogger(err, fmt.Sprintf("unable to read service endpoints NamespacedName: %s", req.NamespacedName))
+	}
+
+	o.simpleInfoLogger("generated Deployment YAML")
+	o.simpleDebugLogger(artifacts.Deployment.Render)
+	result, err := o.DeploymentFromYAML(ctx, c, scheme, req, instance, artifacts.Deployment)
+	if err != nil {
+		o.simpleErrorLogger(err, fmt.Sprintf("unable to create or update deployment NamespacedName: %s", req.NamespacedName))
+		setInstCondition(instance, helxv1.HelxInstConditionApplied, metav1.ConditionFalse, "DeploymentFailed", err.Error())
+		recordEvent(recorder, instance, corev1.EventTypeWarning, "DeploymentFailed", "unable to create or update deployment: %v", err)
 		return err
 	}
+	recordApply(recorder, instance, "deployment", req.Name, result)
+	if restartedAt := instance.Spec.RestartedAt; restartedAt != nil && !restartedAt.Equal(instance.Status.LastRestartedAt) {
+		instance.Status.LastRestartedAt = restartedAt.DeepCopy()
+		recordEvent(recorder, instance, corev1.EventTypeNormal, "Restarted", "rolling restart requested at %s", restartedAt.UTC().Format(time.RFC3339))
+	}
+
+	var failures []string
+	for name, PVC := range artifacts.PVCs {
+		if PVC.Render != "" {
+			o.simpleInfoLogger("generated PVC YAML")
+			o.simpleDebugLogger(PVC.Render)
+			if result, err = o.PVCFromYAML(ctx, c, scheme, req, instance, PVC); err != nil {
+				o.simpleErrorLogger(err, fmt.Sprintf("unable to create or update pvc PVCName: %s NamespacedName: %s ", name, req.NamespacedName))
+				recordEvent(recorder, instance, corev1.EventTypeWarning, "PVCFailed", "unable to create or update pvc %s: %v", name, err)
+				failures = append(failures, fmt.Sprintf("pvc %s: %v", name, err))
+			} else {
+				recordApply(recorder, instance, "pvc", name, result)
+			}
+		}
+	}
+	if instance.Spec.Suspended {
+		// the Services go away while suspended; the PVCs and the UUID stay
+		if err := DeleteServices(ctx, c, instance); err != nil {
+			o.simpleErrorLogger(err, fmt.Sprintf("unable to delete services NamespacedName: %s", req.NamespacedName))
+			recordEvent(recorder, instance, corev1.EventTypeWarning, "ServiceFailed", "unable to delete services: %v", err)
+			failures = append(failures, fmt.Sprintf("services: %v", err))
+		}
+		if len(o.RouteClasses) != 0 {
+			if err := DeleteRoutes(ctx, c, instance); err != nil {
+				o.simpleErrorLogger(err, fmt.Sprintf("unable to delete routes NamespacedName: %s", req.NamespacedName))
+				recordEvent(recorder, instance, corev1.EventTypeWarning, "RouteFailed", "unable to delete routes: %v", err)
+				failures = append(failures, fmt.Sprintf("routes: %v", err))
+			}
+		}
+		instance.Status.Endpoints = nil
+	} else {
+		for name, service := range artifacts.Services {
+			if service.Render != "" {
+				o.simpleInfoLogger("generated Service YAML:")
+				o.simpleDebugLogger(service.Render)
+				if result, err = o.ServiceFromYAML(ctx, c, scheme, req, instance, service); err != nil {
+					o.simpleErrorLogger(err, fmt.Sprintf("unable to create or update service Service Name: %s NamespacedName: %s", name, req.NamespacedName))
+					recordEvent(recorder, instance, corev1.EventTypeWarning, "ServiceFailed", "unable to create or update service %s: %v", name, err)
+					failures = append(failures, fmt.Sprintf("service %s: %v", name, err))
+				} else {
+					recordApply(recorder, instance, "service", name, result)
+				}
+			}
+		}
+		keep := make(map[string]bool)
+		for _, endpoint := range instance.Status.Endpoints {
+			keep[endpoint.Service] = true
+		}
+		if err := deleteServicesExcept(ctx, c, instance, keep); err != nil {
+			o.simpleErrorLogger(err, fmt.Sprintf("unable to delete stale services NamespacedName: %s", req.NamespacedName))
+			recordEvent(recorder, instance, corev1.EventTypeWarning, "ServiceFailed", "unable to delete stale services: %v", err)
+			failures = append(failures, fmt.Sprintf("services: %v", err))
+		}
+		for name, route := range artifacts.Routes {
+			o.simpleInfoLogger("generated route YAML:")
+			o.simpleDebugLogger(route.Render)
+			if result, err = o.RouteFromYAML(ctx, c, scheme, req, instance, route); err != nil {
+				o.simpleErrorLogger(err, fmt.Sprintf("unable to create or update route Name: %s NamespacedName: %s", name, req.NamespacedName))
+				recordEvent(recorder, instance, corev1.EventTypeWarning, "RouteFailed", "unable to create or update %s %s: %v", strings.ToLower(route.Attr["kind"]), name, err)
+				failures = append(failures, fmt.Sprintf("%s %s: %v", strings.ToLower(route.Attr["kind"]), name, err))
+			} else {
+				recordApply(recorder, instance, strings.ToLower(route.Attr["kind"]), name, result)
+			}
+		}
+		if len(o.RouteClasses) != 0 {
+			keep := make(map[string]bool)
+			for name := range artifacts.Routes {
+				keep[name] = true
+			}
+			if err := deleteRoutesExcept(ctx, c, instance, keep); err != nil {
+				o.simpleErrorLogger(err, fmt.Sprintf("unable to delete stale routes NamespacedName: %s", req.NamespacedName))
+				recordEvent(recorder, instance, corev1.EventTypeWarning, "RouteFailed", "unable to delete stale routes: %v", err)
+				failures = append(failures, fmt.Sprintf("routes: %v", err))
+			}
+		}
+	}
+	if len(failures) != 0 {
+		setInstCondition(instance, helxv1.HelxInstConditionApplied, metav1.ConditionFalse, "ApplyFailed", strings.Join(failures, "; "))
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	setInstCondition(instance, helxv1.HelxInstConditionApplied, metav1.ConditionTrue, "Applied", "deployment, pvcs and services applied")
+	if suspended := instance.Status.Phase == helxv1.HelxInstPhaseSuspended; instance.Spec.Suspended && !suspended {
+		recordEvent(recorder, instance, corev1.EventTypeNormal, "Suspended", "scaled to zero and removed services")
+	} else if !instance.Spec.Suspended && suspended {
+		recordEvent(recorder, instance, corev1.EventTypeNormal, "Resumed", "restored deployment and services")
+	}
+
+	updateReadiness(ctx, c, instance)
+	return nil
+}
+
+// updateReadiness records the workload state and the Ready condition on the
+// instance status.
+func updateReadiness(ctx context.Context, c client.Client, instance *helxv1.HelxInst) {
+	if ready, err := observeWorkload(ctx, c, instance); err != nil {
+		setInstCondition(instance, helxv1.HelxInstConditionReady, metav1.ConditionUnknown, "DeploymentUnknown", err.Error())
+	} else if instance.Spec.Suspended {
+		setInstCondition(instance, helxv1.HelxInstConditionReady, metav1.ConditionFalse, "Suspended", "instance is suspended")
+	} else if ready {
+		setInstCondition(instance, helxv1.HelxInstConditionReady, metav1.ConditionTrue, "DeploymentAvailable", "deployment has available replicas")
+	} else if problems := containerProblems(instance); problems != "" {
+		setInstCondition(instance, helxv1.HelxInstConditionReady, metav1.ConditionFalse, "ContainersNotReady", "deployment has no available replicas: "+problems)
+	} else {
+		setInstCondition(instance, helxv1.HelxInstConditionReady, metav1.ConditionFalse, "DeploymentUnavailable", "deployment has no available replicas")
+	}
+}
+
+// RefreshWorkload updates the pod, container and readiness state on the
+// status of an instance whose artifacts are applied, without rendering or
+// applying anything. Pod events only need this.
+func RefreshWorkload(ctx context.Context, c client.Client, instance *helxv1.HelxInst) {
+	if instance.Status.UUID == "" || !meta.IsStatusConditionTrue(instance.Status.Conditions, helxv1.HelxInstConditionApplied) {
+		return
+	}
+	updateReadiness(ctx, c, instance)
+	updateInstPhase(instance)
 }
 
-func DeleteDerivatives(instance *helxv1.HelxInst, c client.Client, req ctrl.Request, ctx context.Context) error {
+func (o *Operations) DeleteDerivatives(instance *helxv1.HelxInst, c client.Client, recorder record.EventRecorder, req ctrl.Request, ctx context.Context) error {
+	recordEvent(recorder, instance, corev1.EventTypeNormal, "Deleting", "deleting deployments, pvcs and services")
 	if err := DeleteDeployments(ctx, c, instance); err != nil {
-		simpleErrorLogger(err, fmt.Sprintf("unable to delete deployments NamespacedName: %s", req.NamespacedName))
+		o.simpleErrorLogger(err, fmt.Sprintf("unable to delete deployments NamespacedName: %s", req.NamespacedName))
+		recordEvent(recorder, instance, corev1.EventTypeWarning, "DeleteFailed", "unable to delete deployments: %v", err)
 		return err
 	}
 	if err := DeletePVCs(ctx, c, instance); err != nil {
-		simpleErrorLogger(err, fmt.Sprintf("unable to delete pvcs NamespacedName: %s", req.NamespacedName))
+		o.simpleErrorLogger(err, fmt.Sprintf("unable to delete pvcs NamespacedName: %s", req.NamespacedName))
+		recordEvent(recorder, instance, corev1.EventTypeWarning, "DeleteFailed", "unable to delete pvcs: %v", err)
 		return err
 	}
 	if err := DeleteServices(ctx, c, instance); err != nil {
-		simpleErrorLogger(err, fmt.Sprintf("unable to delete services NamespacedName: %s", req.NamespacedName))
+		o.simpleErrorLogger(err, fmt.Sprintf("unable to delete services NamespacedName: %s", req.NamespacedName))
+		recordEvent(recorder, instance, corev1.EventTypeWarning, "DeleteFailed", "unable to delete services: %v", err)
 		return err
 	}
+	if len(o.RouteClasses) != 0 {
+		if err := DeleteRoutes(ctx, c, instance); err != nil {
+			o.simpleErrorLogger(err, fmt.Sprintf("unable to delete routes NamespacedName: %s", req.NamespacedName))
+			recordEvent(recorder, instance, corev1.EventTypeWarning, "DeleteFailed", "unable to delete routes: %v", err)
+			return err
+		}
+	}
 	return nil
 }
+
+// ListBoundInsts lists the HelxInsts whose index value (AppNameIndex or
+// UserNameIndex) names the given object. The index is built from cluster
+// state, so the result does not depend on reconcile order or restarts.
+func ListBoundInsts(ctx context.Context, c client.Client, index string, objName string) ([]helxv1.HelxInst, error) {
+	instList := &helxv1.HelxInstList{}
+	if err := c.List(ctx, instList, client.MatchingFields{index: objName}); err != nil {
+		return nil, fmt.Errorf("failed to get helxinst list: %v", err)
+	}
+	return instList.Items, nil
+}
+
+// quotaUsage is what one instance, or a set of admitted instances, counts
+// against a user quota. Claims are keyed by resolved claim name so that a PVC
+// shared by several instances is counted once.
+type quotaUsage struct {
+	instances   int32
+	cpu, memory resource.Quantity
+	claims      map[string]resource.Quantity
+}
+
+// instUsage computes the usage of an instance of app from its spec: the
+// container requests in spec.resources, as held to the app's resourceBounds,
+// and the sizes of the app's PVCs.
+func instUsage(instance *helxv1.HelxInst, app *helxv1.HelxApp) (quotaUsage, error) {
+	usage := quotaUsage{claims: make(map[string]resource.Quantity)}
+
+	if !instance.Spec.Suspended {
+		usage.instances = 1
+		resources, _, _ := BoundResources(instance, app)
+		for _, service := range app.Spec.Services {
+			if service.Init {
+				continue
+			}
+			requests := resources[service.Name].Requests
+			for name, total := range map[string]*resource.Quantity{"cpu": &usage.cpu, "memory": &usage.memory} {
+				if value, found := requests[name]; found {
+					quantity, err := resource.ParseQuantity(value)
+					if err != nil {
+						return usage, fmt.Errorf("service %s: %s request %q: %v", service.Name, name, value, err)
+					}
+					total.Add(quantity)
+				}
+			}
+		}
+	}
+
+	// services that fail to parse are not rendered, so they use no storage
+	_, _, volumes, _ := transformApp(instance, *app)
+	system := map[string]interface{}{"system": template_io.System{
+		AppClassName: app.Spec.AppClassName,
+		AppName:      app.Name,
+		InstanceName: instance.Name,
+		UUID:         instance.Status.UUID,
+		UserName:     ParseNamespacedName(GetUserNameFromInst(instance)).Name,
+	}}
+	for _, volume := range volumes {
+		if volume.Scheme != "pvc" {
+			continue
+		}
+		claim, err := template_io.ReRender(volume.Attr["claim"], system)
+		if err != nil {
+			claim = volume.Attr["claim"]
+		}
+		size := "1G"
+		if value, found := volume.Attr["size"]; found {
+			size = value
+		}
+		quantity, err := resource.ParseQuantity(size)
+		if err != nil {
+			return usage, fmt.Errorf("volume %s: size %q: %v", claim, size, err)
+		}
+		usage.claims[claim] = quantity
+	}
+	return usage, nil
+}
+
+// exceeds reports, as a message, which limits of quota the usage plus more
+// would go over; it is empty when more fits. Only growth is refused, so an
+// instance that adds nothing to a limit is never held by it.
+func (usage quotaUsage) exceeds(more quotaUsage, quota *helxv1.UserQuota) string {
+	var over []string
+	if quota.MaxInstances != nil && more.instances != 0 && usage.instances+more.instances > *quota.MaxInstances {
+		over = append(over, fmt.Sprintf("instances %d > %d", usage.instances+more.instances, *quota.MaxInstances))
+	}
+	check := func(name string, before, after resource.Quantity, max *resource.Quantity) {
+		if max != nil && after.Cmp(before) > 0 && after.Cmp(*max) > 0 {
+			over = append(over, fmt.Sprintf("%s %s > %s", name, after.String(), max.String()))
+		}
+	}
+	cpu := usage.cpu.DeepCopy()
+	cpu.Add(more.cpu)
+	memory := usage.memory.DeepCopy()
+	memory.Add(more.memory)
+	check("cpu", usage.cpu, cpu, quota.CPU)
+	check("memory", usage.memory, memory, quota.Memory)
+	check("storage", usage.storage(nil), usage.storage(more.claims), quota.Storage)
+	return strings.Join(over, ", ")
+}
+
+// storage sums the distinct claims of usage together with extra.
+func (usage quotaUsage) storage(extra map[string]resource.Quantity) resource.Quantity {
+	var total resource.Quantity
+	for claim, quantity := range usage.claims {
+		if _, found := extra[claim]; !found {
+			total.Add(quantity)
+		}
+	}
+	for _, quantity := range extra {
+		total.Add(quantity)
+	}
+	return total
+}
+
+// add folds an admitted instance's usage in.
+func (usage *quotaUsage) add(more quotaUsage) {
+	usage.instances += more.instances
+	usage.cpu.Add(more.cpu)
+	usage.memory.Add(more.memory)
+	for claim, quantity := range more.claims {
+		usage.claims[claim] = quantity
+	}
+}
+
+// CheckQuota reports why rendering the instance would exceed its user's
+// quota, or "" when it fits. The user's instances are admitted oldest first
+// and any that do not fit are left out of the usage seen by younger ones, so
+// the answer does not depend on reconcile order. Instances refused by their
+// resource bounds or that failed to render run nothing and are not counted.
+func CheckQuota(ctx context.Context, c client.Client, instance *helxv1.HelxInst, user *helxv1.HelxUser) (string, error) {
+	quota := user.Spec.Quota
+	if quota == nil {
+		return "", nil
+	}
+	insts, err := ListBoundInsts(ctx, c, UserNameIndex, GetNamespacedName(user))
+	if err != nil {
+		return "", err
+	}
+	sort.Slice(insts, func(i, j int) bool {
+		if !insts[i].CreationTimestamp.Equal(&insts[j].CreationTimestamp) {
+			return insts[i].CreationTimestamp.Before(&insts[j].CreationTimestamp)
+		}
+		return GetNamespacedName(&insts[i]) < GetNamespacedName(&insts[j])
+	})
+
+	apps := make(map[string]*helxv1.HelxApp)
+	admitted := quotaUsage{claims: make(map[string]resource.Quantity)}
+	for i := range insts {
+		inst := &insts[i]
+		if inst.Namespace == instance.Namespace && inst.Name == instance.Name {
+			inst = instance
+		} else if inst.DeletionTimestamp != nil ||
+			meta.IsStatusConditionFalse(inst.Status.Conditions, helxv1.HelxInstConditionResourcesBounded) ||
+			meta.IsStatusConditionFalse(inst.Status.Conditions, helxv1.HelxInstConditionRendered) {
+			continue
+		}
+		appName := GetAppNameFromInst(inst)
+		app, found := apps[appName]
+		if !found {
+			if app, err = GetApp(ctx, c, appName); err != nil {
+				return "", err
+			}
+			apps[appName] = app
+		}
+		if app == nil {
+			continue
+		}
+		usage, err := instUsage(inst, app)
+		if err != nil {
+			if inst == instance {
+				return err.Error(), nil
+			}
+			continue
+		}
+		message := admitted.exceeds(usage, quota)
+		if inst == instance {
+			return message, nil
+		}
+		if message == "" {
+			admitted.add(usage)
+		}
+	}
+	return "", nil
+}
+
+// FinalizeInsts applies a deletion policy to the instances bound to a HelxApp
+// or HelxUser that is being deleted. It reports whether the deletion must be
+// held because instances remain under the Block policy.
+func (o *Operations) FinalizeInsts(ctx context.Context, c client.Client, recorder record.EventRecorder, req ctrl.Request, policy helxv1.DeletionPolicy, reason, message string, insts []helxv1.HelxInst) (bool, error) {
+	switch policy {
+	case helxv1.DeletionPolicyOrphan:
+		for i := range insts {
+			recordEvent(recorder, &insts[i], corev1.EventTypeWarning, reason, "%s; instance orphaned", message)
+		}
+		return false, nil
+	case helxv1.DeletionPolicyBlock:
+		return len(insts) != 0, nil
+	}
+
+	var errs []error
+	for i := range insts {
+		inst := &insts[i]
+		recordEvent(recorder, inst, corev1.EventTypeWarning, reason, message)
+		if err := o.DeleteDerivatives(inst, c, recorder, req, ctx); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := c.Delete(ctx, inst); err != nil && !errors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("failed to delete helxinst %s: %v", GetNamespacedName(inst), err))
+		}
+	}
+	return false, utilerrors.NewAggregate(errs)
+}
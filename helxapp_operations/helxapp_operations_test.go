@@ -1,31 +1,46 @@
 package helxapp_operations
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-logr/logr"
 	helxv1 "github.com/helxplatform/helxapp-controller/api/v1"
 	"github.com/helxplatform/helxapp-controller/template_io"
+	"gomodules.xyz/jsonpatch/v2"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/apimachinery/pkg/util/yaml"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
 
-func resetTables() {
-	appTable = make(map[string]TableElement[helxv1.HelxApp])
-	userTable = make(map[string]TableElement[helxv1.HelxUser])
-	instanceTable = make(map[string]InstTableElement)
-}
+// ops is shared by the tests; tests that need isolated state build their own
+var ops *Operations
 
 func TestMain(m *testing.M) {
-	logger := logr.Discard()
-	simpleDebugLogger = newSimpleDebugLogger(logger)
-	simpleInfoLogger = newSimpleInfoLogger(logger)
-	simpleErrorLogger = newSimpleErrorLogger(logger)
-
 	var err error
-	xformer, storage, err = template_io.ParseTemplates("../templates", nil)
+	ops, err = NewOperations(logr.Discard(), "../templates")
 	if err != nil {
 		panic("failed to parse templates: " + err.Error())
 	}
@@ -78,6 +93,27 @@ func makeInst(namespace, name, appName, userName, uuid string) *helxv1.HelxInst
 	}
 }
 
+func newTestScheme() *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = helxv1.AddToScheme(scheme)
+	return scheme
+}
+
+func newFakeClient(scheme *runtime.Scheme, objs ...client.Object) client.Client {
+	return fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithObjects(objs...).
+		WithIndex(&helxv1.HelxInst{}, AppNameIndex, IndexInstByApp).
+		WithIndex(&helxv1.HelxInst{}, UserNameIndex, IndexInstByUser).
+		WithIndex(&helxv1.HelxInst{}, UUIDIndex, IndexInstByUUID).
+		Build()
+}
+
+func instRequest(inst *helxv1.HelxInst) ctrl.Request {
+	return ctrl.Request{NamespacedName: types.NamespacedName{Namespace: inst.Namespace, Name: inst.Name}}
+}
+
 func makeInstWithResources(namespace, name, appName, userName, uuid string, resources map[string]helxv1.Resources) *helxv1.HelxInst {
 	inst := makeInst(namespace, name, appName, userName, uuid)
 	inst.Spec.Resources = resources
@@ -91,15 +127,16 @@ func makeInstWithSC(namespace, name, appName, userName, uuid string, sc *helxv1.
 }
 
 // ---------------------------------------------------------------------------
-// 1-3: Basic Add/Get for App, User, Inst
+// 1-3: Get App and User from the cluster
 // ---------------------------------------------------------------------------
 
-func TestAddAndGetApp(t *testing.T) {
-	resetTables()
-	app := makeApp("ns", "myapp", "AppClass1", nil)
-	AddApp(app)
+func TestGetApp(t *testing.T) {
+	c := newFakeClient(newTestScheme(), makeApp("ns", "myapp", "AppClass1", nil))
 
-	got := GetApp("ns/myapp")
+	got, err := GetApp(context.Background(), c, "ns/myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
 	if got == nil {
 		t.Fatal("expected app, got nil")
 	}
@@ -108,12 +145,13 @@ func TestAddAndGetApp(t *testing.T) {
 	}
 }
 
-func TestAddAndGetUser(t *testing.T) {
-	resetTables()
-	user := makeUser("ns", "alice", nil)
-	AddUser(user)
+func TestGetUser(t *testing.T) {
+	c := newFakeClient(newTestScheme(), makeUser("ns", "alice", nil))
 
-	got := GetUser("ns/alice")
+	got, err := GetUser(context.Background(), c, "ns/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
 	if got == nil {
 		t.Fatal("expected user, got nil")
 	}
@@ -122,85 +160,67 @@ func TestAddAndGetUser(t *testing.T) {
 	}
 }
 
-func TestAddAndGetInst(t *testing.T) {
-	resetTables()
-	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
-	AddInst(inst)
-
-	got, found := GetInst("ns/inst1")
-	if !found {
-		t.Fatal("expected inst, not found")
-	}
-	if got.Name != "inst1" {
-		t.Errorf("expected name inst1, got %s", got.Name)
+func TestParseNamespacedName(t *testing.T) {
+	got := ParseNamespacedName("ns/inst1")
+	if got.Namespace != "ns" || got.Name != "inst1" {
+		t.Errorf("expected ns/inst1, got %v", got)
 	}
 }
 
 // ---------------------------------------------------------------------------
-// 4: AddInst connects App and User
+// 4: Indexes connect instances to their App and User
 // ---------------------------------------------------------------------------
 
-func TestAddInstConnectsAppAndUser(t *testing.T) {
-	resetTables()
-	app := makeApp("ns", "myapp", "cls", nil)
-	user := makeUser("ns", "alice", nil)
-	AddApp(app)
-	AddUser(user)
-
-	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
-	AddInst(inst)
+func TestIndexInstConnectsAppAndUser(t *testing.T) {
+	inst := makeInst("ns", "inst1", "myapp", "other/alice", "uuid-1")
 
-	// appTable entry for ns/myapp should have inst in its InstSet
-	appElem, ok := appTable["ns/myapp"]
-	if !ok {
-		t.Fatal("app not in table")
+	if got := IndexInstByApp(inst); len(got) != 1 || got[0] != "ns/myapp" {
+		t.Errorf("expected [ns/myapp], got %v", got)
 	}
-	if !appElem.InstSet["ns/inst1"] {
-		t.Error("inst not in app's InstSet")
+	if got := IndexInstByUser(inst); len(got) != 1 || got[0] != "other/alice" {
+		t.Errorf("expected [other/alice], got %v", got)
 	}
-
-	userElem, ok := userTable["ns/alice"]
-	if !ok {
-		t.Fatal("user not in table")
+	if got := IndexInstByApp(makeInst("ns", "inst2", "", "alice", "uuid-2")); len(got) != 0 {
+		t.Errorf("expected no index value without an app, got %v", got)
 	}
-	if !userElem.InstSet["ns/inst1"] {
-		t.Error("inst not in user's InstSet")
+	if got := IndexInstByUUID(inst); len(got) != 1 || got[0] != "uuid-1" {
+		t.Errorf("expected [uuid-1], got %v", got)
+	}
+	if got := IndexInstByUUID(makeInst("ns", "inst3", "myapp", "alice", "")); len(got) != 0 {
+		t.Errorf("expected no index value without a uuid, got %v", got)
 	}
 }
 
 // ---------------------------------------------------------------------------
-// 5-6: AddApp/AddUser returns existing instances
+// 5-6: Bound instances are found regardless of creation order
 // ---------------------------------------------------------------------------
 
-func TestAddAppReturnsExistingInstances(t *testing.T) {
-	resetTables()
-	// Add inst first (creates placeholder in appTable)
-	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
-	AddInst(inst)
+func TestListBoundInsts_InstBeforeApp(t *testing.T) {
+	// the instance exists before the app; nothing depends on reconcile order
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, makeInst("ns", "inst1", "myapp", "alice", "uuid-1"))
+	if err := c.Create(context.Background(), makeApp("ns", "myapp", "cls", nil)); err != nil {
+		t.Fatal(err)
+	}
 
-	// Now add the app -- should return the existing instance
-	app := makeApp("ns", "myapp", "cls", nil)
-	instList := AddApp(app)
-	if len(instList) != 1 {
-		t.Fatalf("expected 1 inst, got %d", len(instList))
+	insts, err := ListBoundInsts(context.Background(), c, AppNameIndex, "ns/myapp")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if instList[0].Name != "inst1" {
-		t.Errorf("expected inst1, got %s", instList[0].Name)
+	if len(insts) != 1 || insts[0].Name != "inst1" {
+		t.Errorf("expected [inst1], got %+v", insts)
 	}
 }
 
-func TestAddUserReturnsExistingInstances(t *testing.T) {
-	resetTables()
-	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
-	AddInst(inst)
+func TestListBoundInsts_User(t *testing.T) {
+	c := newFakeClient(newTestScheme(), makeInst("ns", "inst1", "myapp", "alice", "uuid-1"))
 
-	user := makeUser("ns", "alice", nil)
-	instList := AddUser(user)
-	if len(instList) != 1 {
-		t.Fatalf("expected 1 inst, got %d", len(instList))
+	insts, err := ListBoundInsts(context.Background(), c, UserNameIndex, "ns/alice")
+	if err != nil {
+		t.Fatal(err)
 	}
-	if instList[0].Name != "inst1" {
-		t.Errorf("expected inst1, got %s", instList[0].Name)
+	if len(insts) != 1 || insts[0].Name != "inst1" {
+		t.Errorf("expected [inst1], got %+v", insts)
 	}
 }
 
@@ -208,41 +228,44 @@ func TestAddUserReturnsExistingInstances(t *testing.T) {
 // 7-9: Delete operations
 // ---------------------------------------------------------------------------
 
-func TestDeleteApp(t *testing.T) {
-	resetTables()
-	app := makeApp("ns", "myapp", "cls", nil)
-	AddApp(app)
-	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
-	AddInst(inst)
+func TestListBoundInsts_AfterAppDeleted(t *testing.T) {
+	// instances stay bound by name after the app is gone, so finalizers can
+	// still find them
+	c := newFakeClient(newTestScheme(), makeInst("ns", "inst1", "myapp", "alice", "uuid-1"))
 
-	instList := DeleteApp("ns/myapp")
-	if len(instList) != 1 {
-		t.Fatalf("expected 1 associated inst, got %d", len(instList))
+	insts, err := ListBoundInsts(context.Background(), c, AppNameIndex, "ns/myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insts) != 1 {
+		t.Fatalf("expected 1 associated inst, got %d", len(insts))
 	}
 }
 
-func TestDeleteUser(t *testing.T) {
-	resetTables()
-	user := makeUser("ns", "alice", nil)
-	AddUser(user)
+func TestListBoundInsts_AfterInstDeleted(t *testing.T) {
 	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
-	AddInst(inst)
+	c := newFakeClient(newTestScheme(), inst)
+	if err := c.Delete(context.Background(), inst); err != nil {
+		t.Fatal(err)
+	}
 
-	instList := DeleteUser("ns/alice")
-	if len(instList) != 1 {
-		t.Fatalf("expected 1 associated inst, got %d", len(instList))
+	insts, err := ListBoundInsts(context.Background(), c, UserNameIndex, "ns/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insts) != 0 {
+		t.Errorf("expected no instances after delete, got %d", len(insts))
 	}
 }
 
-func TestDeleteInst(t *testing.T) {
-	resetTables()
-	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
-	AddInst(inst)
-
-	DeleteInst("ns/inst1")
-	_, found := GetInst("ns/inst1")
-	if found {
-		t.Error("inst should have been deleted")
+func TestInstNames(t *testing.T) {
+	insts := []helxv1.HelxInst{
+		*makeInst("ns", "inst2", "myapp", "alice", "uuid-2"),
+		*makeInst("ns", "inst1", "myapp", "alice", "uuid-1"),
+	}
+	got := InstNames(insts)
+	if len(got) != 2 || got[0] != "ns/inst1" || got[1] != "ns/inst2" {
+		t.Errorf("expected [ns/inst1 ns/inst2], got %v", got)
 	}
 }
 
@@ -591,7 +614,7 @@ func TestTransformApp_SingleService(t *testing.T) {
 	}
 	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
 
-	containers, sourceMap, err := transformApp(inst, app)
+	containers, _, sourceMap, err := transformApp(inst, app)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -623,7 +646,7 @@ func TestTransformApp_MultiService(t *testing.T) {
 	}
 	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
 
-	containers, _, err := transformApp(inst, app)
+	containers, _, _, err := transformApp(inst, app)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -651,7 +674,7 @@ func TestTransformApp_WithEnvironment(t *testing.T) {
 	}
 	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
 
-	containers, _, err := transformApp(inst, app)
+	containers, _, _, err := transformApp(inst, app)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -678,7 +701,7 @@ func TestTransformApp_WithCommand(t *testing.T) {
 	}
 	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
 
-	containers, _, err := transformApp(inst, app)
+	containers, _, _, err := transformApp(inst, app)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -689,16 +712,6 @@ func TestTransformApp_WithCommand(t *testing.T) {
 }
 
 // ---------------------------------------------------------------------------
-// Helper to set up graph state for artifact tests
-// ---------------------------------------------------------------------------
-
-func setupGraphForArtifacts(app *helxv1.HelxApp, user *helxv1.HelxUser, inst *helxv1.HelxInst) {
-	resetTables()
-	AddApp(app)
-	AddUser(user)
-	AddInst(inst)
-}
-
 // ---------------------------------------------------------------------------
 // 39-52: GenerateArtifacts tests
 // ---------------------------------------------------------------------------
@@ -715,8 +728,7 @@ func TestGenerateArtifacts_NginxMinimal(t *testing.T) {
 	user := makeUser("ns", "alice", nil)
 	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-1")
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -759,8 +771,7 @@ func TestGenerateArtifacts_WithPVC(t *testing.T) {
 	user := makeUser("ns", "alice", nil)
 	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-2")
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -792,8 +803,7 @@ func TestGenerateArtifacts_WithNFS(t *testing.T) {
 	user := makeUser("ns", "alice", nil)
 	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-3")
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -823,8 +833,7 @@ func TestGenerateArtifacts_RetainLabel(t *testing.T) {
 	user := makeUser("ns", "alice", nil)
 	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-4")
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -844,13 +853,10 @@ func TestGenerateArtifacts_RetainLabel(t *testing.T) {
 }
 
 func TestGenerateArtifacts_MissingApp(t *testing.T) {
-	resetTables()
 	user := makeUser("ns", "alice", nil)
-	AddUser(user)
 	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-5")
-	AddInst(inst)
 
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, nil, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -860,15 +866,12 @@ func TestGenerateArtifacts_MissingApp(t *testing.T) {
 }
 
 func TestGenerateArtifacts_MissingUser(t *testing.T) {
-	resetTables()
 	app := makeApp("ns", "myapp", "Nginx", []helxv1.Service{
 		{Name: "main", Image: "nginx", Command: []string{"nginx"}, Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80}}},
 	})
-	AddApp(app)
 	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-6")
-	AddInst(inst)
 
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -896,8 +899,7 @@ func TestGenerateArtifacts_WithResources(t *testing.T) {
 		},
 	)
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -935,8 +937,7 @@ func TestGenerateArtifacts_WithSecurityContext(t *testing.T) {
 		},
 	)
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -965,8 +966,7 @@ func TestGenerateArtifacts_TemplateInterpolation(t *testing.T) {
 	user := makeUser("ns", "alice", nil)
 	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-9")
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -992,8 +992,7 @@ func TestGenerateArtifacts_SystemEnvironment(t *testing.T) {
 	user := makeUser("ns", "alice", nil)
 	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-10")
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1036,8 +1035,7 @@ func TestGenerateArtifacts_Filebrowser(t *testing.T) {
 		},
 	)
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1098,8 +1096,7 @@ func TestGenerateArtifacts_PVCAccessModes(t *testing.T) {
 	user := makeUser("ns", "alice", nil)
 	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-rwx")
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1125,8 +1122,7 @@ func TestGenerateArtifacts_PVCStorageSize(t *testing.T) {
 	user := makeUser("ns", "alice", nil)
 	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-size")
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1152,8 +1148,7 @@ func TestGenerateArtifacts_NoServicePort(t *testing.T) {
 	user := makeUser("ns", "alice", nil)
 	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-nosvc")
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1188,83 +1183,57 @@ func TestGetUserNameFromInst_EmptyUserName(t *testing.T) {
 	}
 }
 
-// 3. GetObjFromMap — not found case via GetApp
+// 3. GetApp — not found case
 func TestGetApp_NotFound(t *testing.T) {
-	resetTables()
-	got := GetApp("nonexistent")
+	got, err := GetApp(context.Background(), newFakeClient(newTestScheme()), "ns/nonexistent")
+	if err != nil {
+		t.Fatal(err)
+	}
 	if got != nil {
 		t.Errorf("expected nil for nonexistent app, got %+v", got)
 	}
 }
 
-// 4. GetObjFromMap — not found case via GetUser
+// 4. GetUser — not found case
 func TestGetUser_NotFound(t *testing.T) {
-	resetTables()
-	got := GetUser("nonexistent")
+	got, err := GetUser(context.Background(), newFakeClient(newTestScheme()), "ns/nonexistent")
+	if err != nil {
+		t.Fatal(err)
+	}
 	if got != nil {
 		t.Errorf("expected nil for nonexistent user, got %+v", got)
 	}
 }
 
-// 5. DeleteInst — verify associations are cleaned up from appTable and userTable
-func TestDeleteInst_CleansAssociations(t *testing.T) {
-	resetTables()
-	app := makeApp("ns", "myapp", "cls", nil)
-	user := makeUser("ns", "alice", nil)
-	AddApp(app)
-	AddUser(user)
-
-	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
-	AddInst(inst)
-
-	// Verify associations exist before delete
-	appElem, ok := appTable["ns/myapp"]
-	if !ok {
-		t.Fatal("app not in table before delete")
-	}
-	if !appElem.InstSet["ns/inst1"] {
-		t.Error("inst not in app's InstSet before delete")
-	}
-
-	userElem, ok := userTable["ns/alice"]
-	if !ok {
-		t.Fatal("user not in table before delete")
-	}
-	if !userElem.InstSet["ns/inst1"] {
-		t.Error("inst not in user's InstSet before delete")
-	}
-
-	// Delete the inst
-	DeleteInst("ns/inst1")
-
-	// Verify inst is gone
-	_, found := GetInst("ns/inst1")
-	if found {
-		t.Error("inst should have been deleted from instanceTable")
+// 5. ParseNamespacedName — a bare name has no namespace
+func TestParseNamespacedName_Bare(t *testing.T) {
+	got := ParseNamespacedName("inst1")
+	if got.Namespace != "" || got.Name != "inst1" {
+		t.Errorf("expected bare inst1, got %v", got)
 	}
 }
 
-// 6. DeleteInst — deleting a nonexistent inst should not panic
-func TestDeleteInst_Nonexistent(t *testing.T) {
-	resetTables()
-	// Should not panic
-	DeleteInst("ns/nonexistent")
+// 6. IndexInstByUser — an instance without a user is not indexed
+func TestIndexInstByUser_Empty(t *testing.T) {
+	if got := IndexInstByUser(makeInst("ns", "inst1", "myapp", "", "uuid-1")); len(got) != 0 {
+		t.Errorf("expected no index value without a user, got %v", got)
+	}
 }
 
 // 7. clearStorage — test that it clears the storage map
 func TestClearStorage(t *testing.T) {
 	// Seed storage with some data
-	storage["testkey1"] = []string{"a", "b"}
-	storage["testkey2"] = []string{"c"}
+	ops.storage["testkey1"] = []string{"a", "b"}
+	ops.storage["testkey2"] = []string{"c"}
 
-	if len(storage) == 0 {
+	if len(ops.storage) == 0 {
 		t.Fatal("storage should have entries before clearing")
 	}
 
-	clearStorage()
+	ops.clearStorage()
 
-	if len(storage) != 0 {
-		t.Errorf("expected storage to be empty after clearStorage, got %d entries", len(storage))
+	if len(ops.storage) != 0 {
+		t.Errorf("expected storage to be empty after clearStorage, got %d entries", len(ops.storage))
 	}
 }
 
@@ -1369,7 +1338,7 @@ func TestTransformApp_WithVolumes(t *testing.T) {
 	}
 	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
 
-	containers, sourceMap, err := transformApp(inst, app)
+	containers, _, sourceMap, err := transformApp(inst, app)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1404,8 +1373,7 @@ func TestGenerateArtifacts_MultiplePVCs(t *testing.T) {
 	user := makeUser("ns", "alice", nil)
 	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-multipvc")
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1489,8 +1457,7 @@ func TestGenerateArtifacts_DuplicateVolumeAcrossServices(t *testing.T) {
 	user := makeUser("ns", "alice", nil)
 	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-dupvol")
 
-	setupGraphForArtifacts(app, user, inst)
-	artifacts, err := GenerateArtifacts(inst)
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -1505,3 +1472,2107 @@ func TestGenerateArtifacts_DuplicateVolumeAcrossServices(t *testing.T) {
 		t.Error("expected PVC with claim 'sharedvol'")
 	}
 }
+
+// 19. GenerateArtifacts with namespace-qualified app and user names renders the bare names
+func TestGenerateArtifacts_QualifiedNames(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "web", Image: "nginx", Command: []string{"nginx"}, Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80}}},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "ns/myapp", "ns/alice", "test-uuid-qualified")
+
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{`"helx.renci.org/app-name": myapp`, `"helx.renci.org/username": alice`} {
+		if !strings.Contains(artifacts.Deployment.Render, expected) {
+			t.Errorf("expected %s in deployment:\n%s", expected, artifacts.Deployment.Render)
+		}
+	}
+	if strings.Contains(artifacts.Deployment.Render, "ns/myapp") {
+		t.Errorf("expected no qualified name in deployment:\n%s", artifacts.Deployment.Render)
+	}
+}
+
+// 20. GenerateArtifacts routes init services into initContainers, in order
+func TestGenerateArtifacts_InitContainers(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "stage", Image: "busybox", Command: []string{"cp"}, Init: true, Ports: []helxv1.PortMap{{ContainerPort: 9000, Port: 9000}}, Volumes: map[string]string{"data": "data-{{ .system.UUID }}:/staging"}},
+		{Name: "web", Image: "nginx", Command: []string{"nginx"}, Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80}}, Volumes: map[string]string{"data": "data-{{ .system.UUID }}:/data"}},
+		{Name: "fix", Image: "busybox", Command: []string{"chown"}, Init: true},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-init")
+
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment := &appsv1.Deployment{}
+	if err := yaml.Unmarshal([]byte(artifacts.Deployment.Render), deployment); err != nil {
+		t.Fatalf("unable to parse deployment: %v\n%s", err, artifacts.Deployment.Render)
+	}
+	podSpec := deployment.Spec.Template.Spec
+	if len(podSpec.InitContainers) != 2 || podSpec.InitContainers[0].Name != "stage" || podSpec.InitContainers[1].Name != "fix" {
+		t.Fatalf("expected init containers stage and fix in order, got %+v", podSpec.InitContainers)
+	}
+	if len(podSpec.Containers) != 1 || podSpec.Containers[0].Name != "web" {
+		t.Fatalf("expected only web as a container, got %+v", podSpec.Containers)
+	}
+	if mounts := podSpec.InitContainers[0].VolumeMounts; len(mounts) != 1 || mounts[0].Name != "data" || mounts[0].MountPath != "/staging" {
+		t.Errorf("expected the init container to mount the shared volume, got %+v", mounts)
+	}
+	if len(podSpec.Volumes) != 1 {
+		t.Errorf("expected one shared pod volume, got %+v", podSpec.Volumes)
+	}
+	if _, found := artifacts.Services["stage"]; found && artifacts.Services["stage"].Render != "" {
+		t.Errorf("expected no Service for an init container, got:\n%s", artifacts.Services["stage"].Render)
+	}
+	if artifacts.Services["web"].Render == "" {
+		t.Error("expected a Service for web")
+	}
+}
+
+// 21. GenerateArtifacts resolves system templating in referenced Secret names
+func TestGenerateArtifacts_EnvSecretName(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{{
+		Name: "web", Image: "nginx", Command: []string{"nginx"}, Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80}},
+		Env:     []helxv1.EnvVar{{Name: "TOKEN", ValueFrom: helxv1.EnvVarSource{SecretKeyRef: &helxv1.KeySelector{Name: "{{ .system.UserName }}-token", Key: "token"}}}},
+		EnvFrom: []helxv1.EnvFromSource{{SecretRef: &helxv1.EnvObjectRef{Name: "{{ .system.UserName }}-creds", Optional: true}}},
+	}})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-envsecret")
+
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment := &appsv1.Deployment{}
+	if err := yaml.Unmarshal([]byte(artifacts.Deployment.Render), deployment); err != nil {
+		t.Fatalf("unable to parse deployment: %v\n%s", err, artifacts.Deployment.Render)
+	}
+	container := deployment.Spec.Template.Spec.Containers[0]
+	var token *corev1.EnvVar
+	for i := range container.Env {
+		if container.Env[i].Name == "TOKEN" {
+			token = &container.Env[i]
+		}
+	}
+	if token == nil || token.ValueFrom == nil || token.ValueFrom.SecretKeyRef == nil || token.ValueFrom.SecretKeyRef.Name != "alice-token" {
+		t.Errorf("expected TOKEN from secret alice-token, got %+v", container.Env)
+	}
+	if len(container.EnvFrom) != 1 || container.EnvFrom[0].SecretRef == nil || container.EnvFrom[0].SecretRef.Name != "alice-creds" {
+		t.Errorf("expected envFrom secret alice-creds, got %+v", container.EnvFrom)
+	}
+
+	inst.Spec.EnvFrom = []helxv1.EnvFromSource{{}}
+	if _, err := ops.GenerateArtifacts(inst, app, user); err == nil {
+		t.Error("expected an empty instance envFrom to fail rendering")
+	}
+}
+
+// 22. GenerateArtifacts renders the app's scheduling merged with the instance's
+func TestGenerateArtifacts_Scheduling(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "web", Image: "nginx", Command: []string{"nginx"}, Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80}}},
+	})
+	app.Spec.Scheduling = helxv1.Scheduling{
+		NodeSelector: map[string]string{"pool": "gpu", "arch": "amd64"},
+		Tolerations:  []corev1.Toleration{{Key: "gpu", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}},
+		Affinity: &corev1.Affinity{PodAntiAffinity: &corev1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{{
+				Weight: 10,
+				PodAffinityTerm: corev1.PodAffinityTerm{
+					TopologyKey:   "kubernetes.io/hostname",
+					LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"helx.renci.org/username": "{{ .system.UserName }}"}},
+				},
+			}},
+		}},
+		TopologySpreadConstraints: []corev1.TopologySpreadConstraint{{MaxSkew: 1, TopologyKey: "zone", WhenUnsatisfiable: corev1.ScheduleAnyway}},
+		PriorityClassName:         "standard",
+	}
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-scheduling")
+	inst.Spec.Scheduling = helxv1.Scheduling{
+		NodeSelector:              map[string]string{"pool": "highmem"},
+		Tolerations:               []corev1.Toleration{{Key: "highmem", Operator: corev1.TolerationOpExists}},
+		TopologySpreadConstraints: []corev1.TopologySpreadConstraint{{MaxSkew: 2, TopologyKey: "zone", WhenUnsatisfiable: corev1.DoNotSchedule}},
+		PriorityClassName:         "interactive",
+	}
+
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment := &appsv1.Deployment{}
+	if err := yaml.Unmarshal([]byte(artifacts.Deployment.Render), deployment); err != nil {
+		t.Fatalf("unable to parse deployment: %v\n%s", err, artifacts.Deployment.Render)
+	}
+	podSpec := deployment.Spec.Template.Spec
+	if podSpec.NodeSelector["pool"] != "highmem" || podSpec.NodeSelector["arch"] != "amd64" {
+		t.Errorf("expected the instance node selector merged over the app's, got %v", podSpec.NodeSelector)
+	}
+	if len(podSpec.Tolerations) != 2 || podSpec.Tolerations[1].Key != "highmem" {
+		t.Errorf("expected the instance toleration added to the app's, got %+v", podSpec.Tolerations)
+	}
+	if podSpec.Affinity == nil || podSpec.Affinity.PodAntiAffinity == nil ||
+		podSpec.Affinity.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution[0].PodAffinityTerm.LabelSelector.MatchLabels["helx.renci.org/username"] != "alice" {
+		t.Errorf("expected the app's templated pod anti-affinity, got %+v", podSpec.Affinity)
+	}
+	if len(podSpec.TopologySpreadConstraints) != 1 || podSpec.TopologySpreadConstraints[0].MaxSkew != 2 {
+		t.Errorf("expected the instance spread constraint to replace the app's, got %+v", podSpec.TopologySpreadConstraints)
+	}
+	if podSpec.PriorityClassName != "interactive" {
+		t.Errorf("expected priority class interactive, got %q", podSpec.PriorityClassName)
+	}
+	if app.Spec.NodeSelector["pool"] != "gpu" || len(app.Spec.Tolerations) != 1 {
+		t.Error("expected the merge to leave the app unchanged")
+	}
+
+	inst.Spec.Tolerations = []corev1.Toleration{{Key: "bad", Operator: corev1.TolerationOpExists, Value: "x"}}
+	if _, err := ops.GenerateArtifacts(inst, app, user); err == nil {
+		t.Error("expected a bad instance toleration to fail rendering")
+	}
+}
+
+// profileApp returns an app with a gpu-small profile for its jupyter service.
+func profileApp() *helxv1.HelxApp {
+	app := makeApp("ns", "myapp", "Jupyter", []helxv1.Service{{
+		Name: "jupyter", Image: "jupyter/base-notebook", Ports: []helxv1.PortMap{{ContainerPort: 8888, Port: 8888}},
+		ResourceBounds: map[string]helxv1.ResourceBoundary{"memory": {Min: "1Gi", Max: "32Gi"}, "nvidia.com/gpu": {Max: "2"}},
+	}})
+	app.Spec.Profiles = map[string]helxv1.HardwareProfile{
+		"gpu-small": {
+			Resources: map[string]helxv1.Resources{"jupyter": {
+				Requests: map[string]string{"memory": "16Gi", "nvidia.com/gpu": "1"},
+				Limits:   map[string]string{"memory": "16Gi", "nvidia.com/gpu": "1"},
+			}},
+			Scheduling: helxv1.Scheduling{
+				NodeSelector: map[string]string{"pool": "gpu"},
+				Tolerations:  []corev1.Toleration{{Key: "nvidia.com/gpu", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}},
+			},
+		},
+	}
+	return app
+}
+
+// 23. GenerateArtifacts renders the resources and scheduling of the instance's profile
+func TestGenerateArtifacts_Profile(t *testing.T) {
+	app := profileApp()
+	app.Spec.NodeSelector = map[string]string{"arch": "amd64"}
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-profile")
+	inst.Spec.Profile = "gpu-small"
+	inst.Spec.Resources = map[string]helxv1.Resources{"jupyter": {Limits: map[string]string{"memory": "24Gi"}}}
+
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployment := &appsv1.Deployment{}
+	if err := yaml.Unmarshal([]byte(artifacts.Deployment.Render), deployment); err != nil {
+		t.Fatalf("unable to parse deployment: %v\n%s", err, artifacts.Deployment.Render)
+	}
+	podSpec := deployment.Spec.Template.Spec
+	resources := podSpec.Containers[0].Resources
+	if gpu := resources.Limits["nvidia.com/gpu"]; gpu.String() != "1" {
+		t.Errorf("expected one GPU from the profile, got %v", resources.Limits)
+	}
+	if memory := resources.Limits[corev1.ResourceMemory]; memory.String() != "24Gi" {
+		t.Errorf("expected the instance memory limit to win, got %v", resources.Limits)
+	}
+	if memory := resources.Requests[corev1.ResourceMemory]; memory.String() != "16Gi" {
+		t.Errorf("expected the profile memory request, got %v", resources.Requests)
+	}
+	if podSpec.NodeSelector["pool"] != "gpu" || podSpec.NodeSelector["arch"] != "amd64" || len(podSpec.Tolerations) != 1 {
+		t.Errorf("expected the profile scheduling over the app's, got %v %+v", podSpec.NodeSelector, podSpec.Tolerations)
+	}
+
+	inst.Spec.Profile = "gpu-large"
+	if _, err := ops.GenerateArtifacts(inst, app, user); err == nil || !strings.Contains(err.Error(), "no profile gpu-large") {
+		t.Errorf("expected an unknown profile to fail rendering, got %v", err)
+	}
+}
+
+// 24. GenerateArtifacts refuses service types outside the allowlist
+func TestGenerateArtifacts_ServiceTypeNotAllowed(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "web", Image: "nginx", Command: []string{"nginx"}, Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80}}, ServiceType: helxv1.ServiceTypeHeadless},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-servicetype")
+
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(artifacts.Services["web"].Render, "clusterIP: None") {
+		t.Errorf("expected a headless Service, got:\n%s", artifacts.Services["web"].Render)
+	}
+
+	app.Spec.Services[0].ServiceType = helxv1.ServiceTypeNodePort
+	if _, err := ops.GenerateArtifacts(inst, app, user); err == nil || !strings.Contains(err.Error(), "serviceType") {
+		t.Errorf("expected NodePort to fail rendering, got %v", err)
+	}
+}
+
+// routeOps returns Operations exposing every app class through an Ingress,
+// and the Nginx class through an HTTPRoute.
+func routeOps(t *testing.T) *Operations {
+	o, err := NewOperations(logr.Discard(), "../templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.RouteClasses = map[string]RouteClass{
+		DefaultRouteClass: {Host: "apps.example.org", Path: "/private/{{appName}}/{{user}}/{{uuid}}/", IngressClassName: "nginx"},
+		"Nginx":           {Kind: RouteKindHTTPRoute, Host: "{{user}}.example.org", Gateway: &GatewayRef{Name: "helx-gateway"}},
+	}
+	return o
+}
+
+// 25. GenerateArtifacts renders a route per exposed TCP port and sets HOST from the route class
+func TestGenerateArtifacts_Routes(t *testing.T) {
+	app := makeApp("ns", "myapp", "Jupyter", []helxv1.Service{
+		{Name: "main", Image: "jupyter", Command: []string{"start"}, Ports: []helxv1.PortMap{{ContainerPort: 8888, Port: 80, Name: "http"}}},
+		{Name: "api", Image: "api", Ports: []helxv1.PortMap{{ContainerPort: 9000, Port: 9000}, {ContainerPort: 9090}, {ContainerPort: 5900, Port: 5900, Protocol: "UDP"}}},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-routes")
+
+	artifacts, err := routeOps(t).GenerateArtifacts(inst, app, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts.Routes) != 2 {
+		t.Fatalf("expected routes for the two exposed TCP ports, got %d", len(artifacts.Routes))
+	}
+	for name, path := range map[string]string{
+		"main-http-test-uuid-routes":     "/private/myapp/alice/test-uuid-routes",
+		"api-port-9000-test-uuid-routes": "/private/myapp/alice/test-uuid-routes/api/port-9000",
+	} {
+		route, found := artifacts.Routes[name]
+		if !found {
+			t.Fatalf("expected route %s, got %v", name, artifacts.Routes)
+		}
+		if route.Attr["kind"] != "Ingress" || !strings.Contains(route.Render, `path: "`+path+`"`) || !strings.Contains(route.Render, `host: "apps.example.org"`) {
+			t.Errorf("unexpected route %s:\n%s", name, route.Render)
+		}
+	}
+	if !strings.Contains(artifacts.Deployment.Render, "name: HOST\n") || !strings.Contains(artifacts.Deployment.Render, `value: "apps.example.org"`) {
+		t.Errorf("expected HOST from the route class, got:\n%s", artifacts.Deployment.Render)
+	}
+
+	app.Spec.AppClassName = "Nginx"
+	if artifacts, err = routeOps(t).GenerateArtifacts(inst, app, user); err != nil {
+		t.Fatal(err)
+	}
+	route := artifacts.Routes["main-http-test-uuid-routes"]
+	if route.Attr["kind"] != "HTTPRoute" || !strings.Contains(route.Render, `value: "/"`) || !strings.Contains(route.Render, `- "alice.example.org"`) {
+		t.Errorf("expected an HTTPRoute at / for the class's own route, got:\n%s", route.Render)
+	}
+
+	if artifacts, err = ops.GenerateArtifacts(inst, app, user); err != nil {
+		t.Fatal(err)
+	}
+	if len(artifacts.Routes) != 0 {
+		t.Errorf("expected no routes without route classes, got %v", artifacts.Routes)
+	}
+}
+
+func TestLoadRouteClasses(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := dir + "/routes.yaml"
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	classes, err := LoadRouteClasses(write(`
+"*":
+  host: apps.example.org
+  path: /private/{{appName}}/{{user}}/{{uuid}}
+  annotations:
+    nginx.ingress.kubernetes.io/proxy-body-size: "0"
+Jupyter:
+  kind: HTTPRoute
+  gateway:
+    name: helx-gateway
+    sectionName: https
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if classes[DefaultRouteClass].Path != "/private/{{appName}}/{{user}}/{{uuid}}" || classes[DefaultRouteClass].Annotations["nginx.ingress.kubernetes.io/proxy-body-size"] != "0" {
+		t.Errorf("unexpected default class %+v", classes[DefaultRouteClass])
+	}
+	if jupyter := classes["Jupyter"]; jupyter.Kind != RouteKindHTTPRoute || jupyter.Gateway == nil || jupyter.Gateway.SectionName != "https" {
+		t.Errorf("unexpected Jupyter class %+v", jupyter)
+	}
+	o := &Operations{RouteClasses: classes}
+	if !o.UsesRouteKind(RouteKindIngress) || !o.UsesRouteKind(RouteKindHTTPRoute) {
+		t.Error("expected both route kinds to be in use")
+	}
+	delete(o.RouteClasses, "Jupyter")
+	if o.UsesRouteKind(RouteKindHTTPRoute) {
+		t.Error("expected no HTTPRoutes without a class of that kind")
+	}
+
+	for _, bad := range []string{
+		"Jupyter:\n  kind: Route\n",
+		"Jupyter:\n  kind: HTTPRoute\n",
+		"Jupyter:\n  path: /private/{{owner}}\n",
+		"Jupyter:\n  hostname: apps.example.org\n",
+	} {
+		if _, err := LoadRouteClasses(write(bad)); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+	if _, err := LoadRouteClasses(dir + "/missing.yaml"); err == nil {
+		t.Error("expected a missing file to be rejected")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// CreateDerivatives status conditions and phase
+// ---------------------------------------------------------------------------
+
+func TestCreateDerivatives_MissingAppIsPending(t *testing.T) {
+	inst := makeInst("ns", "inst1", "myapp", "alice", "cond-uuid-1")
+
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, makeUser("ns", "alice", nil), inst)
+	if err := ops.CreateDerivatives(inst, c, scheme, nil, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionFalse(inst.Status.Conditions, helxv1.HelxInstConditionAppResolved) {
+		t.Error("expected AppResolved=False")
+	}
+	if !meta.IsStatusConditionTrue(inst.Status.Conditions, helxv1.HelxInstConditionUserResolved) {
+		t.Error("expected UserResolved=True")
+	}
+	if inst.Status.Phase != helxv1.HelxInstPhasePending {
+		t.Errorf("expected phase Pending, got %s", inst.Status.Phase)
+	}
+}
+
+func TestCreateDerivatives_AppliedIsDeploying(t *testing.T) {
+	app := makeApp("ns", "myapp", "Nginx", []helxv1.Service{
+		{Name: "main", Image: "nginx", Command: []string{"nginx"}, Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80}}},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "cond-uuid-2")
+
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, app, user, inst)
+	if err := ops.CreateDerivatives(inst, c, scheme, nil, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, condType := range []string{
+		helxv1.HelxInstConditionAppResolved,
+		helxv1.HelxInstConditionUserResolved,
+		helxv1.HelxInstConditionRendered,
+		helxv1.HelxInstConditionApplied,
+	} {
+		if !meta.IsStatusConditionTrue(inst.Status.Conditions, condType) {
+			t.Errorf("expected %s=True", condType)
+		}
+	}
+	if !meta.IsStatusConditionFalse(inst.Status.Conditions, helxv1.HelxInstConditionReady) {
+		t.Error("expected Ready=False before the deployment is available")
+	}
+	if inst.Status.Phase != helxv1.HelxInstPhaseDeploying {
+		t.Errorf("expected phase Deploying, got %s", inst.Status.Phase)
+	}
+
+	deployments := &appsv1.DeploymentList{}
+	if err := c.List(context.Background(), deployments, client.InNamespace("ns")); err != nil {
+		t.Fatal(err)
+	}
+	if len(deployments.Items) != 1 {
+		t.Fatalf("expected 1 deployment, got %d", len(deployments.Items))
+	}
+}
+
+func TestCreateDerivatives_AvailableIsRunning(t *testing.T) {
+	app := makeApp("ns", "myapp", "Nginx", []helxv1.Service{
+		{Name: "main", Image: "nginx", Command: []string{"nginx"}},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "cond-uuid-3")
+
+	existing := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "inst1-cond-uuid-3",
+			Namespace: "ns",
+			Labels:    map[string]string{"helx.renci.org/id": "cond-uuid-3"},
+		},
+		Status: appsv1.DeploymentStatus{AvailableReplicas: 1},
+	}
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, app, user, inst, existing)
+	if err := ops.CreateDerivatives(inst, c, scheme, nil, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionTrue(inst.Status.Conditions, helxv1.HelxInstConditionReady) {
+		t.Error("expected Ready=True")
+	}
+	if inst.Status.Phase != helxv1.HelxInstPhaseRunning {
+		t.Errorf("expected phase Running, got %s", inst.Status.Phase)
+	}
+}
+
+func TestUpdateInstPhase_RenderFailed(t *testing.T) {
+	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
+	setInstCondition(inst, helxv1.HelxInstConditionAppResolved, metav1.ConditionTrue, "AppFound", "")
+	setInstCondition(inst, helxv1.HelxInstConditionUserResolved, metav1.ConditionTrue, "UserFound", "")
+	setInstCondition(inst, helxv1.HelxInstConditionRendered, metav1.ConditionFalse, "RenderFailed", "bad template")
+	updateInstPhase(inst)
+	if inst.Status.Phase != helxv1.HelxInstPhaseFailed {
+		t.Errorf("expected phase Failed, got %s", inst.Status.Phase)
+	}
+}
+
+func TestCreateDerivatives_ReportsPodState(t *testing.T) {
+	app := makeApp("ns", "myapp", "Nginx", []helxv1.Service{
+		{Name: "main", Image: "nginx", Command: []string{"nginx"}},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "pod-uuid-1")
+
+	labels := map[string]string{IDLabel: "pod-uuid-1"}
+	old := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "old", Namespace: "ns", Labels: labels, CreationTimestamp: metav1.Unix(100, 0)},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.1"},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "new", Namespace: "ns", Labels: labels, CreationTimestamp: metav1.Unix(200, 0)},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodPending,
+			PodIP: "10.0.0.2",
+			ContainerStatuses: []corev1.ContainerStatus{{
+				Name:         "main",
+				RestartCount: 3,
+				State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{
+					Reason:  "ImagePullBackOff",
+					Message: "Back-off pulling image",
+				}},
+			}},
+		},
+	}
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, app, user, inst, old, pod)
+	if err := ops.CreateDerivatives(inst, c, scheme, nil, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if inst.Status.PodName != "new" || inst.Status.PodIP != "10.0.0.2" || inst.Status.PodPhase != "Pending" {
+		t.Errorf("expected the newest pod, got %s %s %s", inst.Status.PodName, inst.Status.PodIP, inst.Status.PodPhase)
+	}
+	if len(inst.Status.Containers) != 1 {
+		t.Fatalf("expected 1 container status, got %d", len(inst.Status.Containers))
+	}
+	if cs := inst.Status.Containers[0]; cs.Reason != "ImagePullBackOff" || cs.RestartCount != 3 || cs.Ready {
+		t.Errorf("unexpected container status %+v", cs)
+	}
+	ready := meta.FindStatusCondition(inst.Status.Conditions, helxv1.HelxInstConditionReady)
+	if ready == nil || ready.Reason != "ContainersNotReady" || !strings.Contains(ready.Message, "container main ImagePullBackOff") {
+		t.Errorf("expected Ready to name the waiting container, got %+v", ready)
+	}
+}
+
+func TestRefreshWorkload(t *testing.T) {
+	inst := makeInst("ns", "inst1", "myapp", "alice", "pod-uuid-refresh")
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "inst1-pod", Namespace: "ns", Labels: map[string]string{IDLabel: "pod-uuid-refresh"}},
+		Status: corev1.PodStatus{
+			Phase:             corev1.PodRunning,
+			ContainerStatuses: []corev1.ContainerStatus{{Name: "main", Ready: true}},
+		},
+	}
+	// neither the app nor the user exists: nothing is rendered or applied
+	c := newFakeClient(newTestScheme(), inst, pod)
+
+	RefreshWorkload(context.Background(), c, inst)
+	if inst.Status.PodName != "" || meta.FindStatusCondition(inst.Status.Conditions, helxv1.HelxInstConditionReady) != nil {
+		t.Errorf("expected an instance that was never applied to be left alone, got %+v", inst.Status)
+	}
+
+	setInstCondition(inst, helxv1.HelxInstConditionAppResolved, metav1.ConditionTrue, "AppFound", "")
+	setInstCondition(inst, helxv1.HelxInstConditionUserResolved, metav1.ConditionTrue, "UserFound", "")
+	setInstCondition(inst, helxv1.HelxInstConditionApplied, metav1.ConditionTrue, "Applied", "")
+	RefreshWorkload(context.Background(), c, inst)
+	if inst.Status.PodName != "inst1-pod" || len(inst.Status.Containers) != 1 || !inst.Status.Containers[0].Ready {
+		t.Errorf("expected the pod state on the status, got %+v", inst.Status)
+	}
+	if !meta.IsStatusConditionFalse(inst.Status.Conditions, helxv1.HelxInstConditionReady) || inst.Status.Phase != helxv1.HelxInstPhaseDeploying {
+		t.Errorf("expected Ready=False without an available Deployment and phase Deploying, got %s", inst.Status.Phase)
+	}
+	deployments := &appsv1.DeploymentList{}
+	if err := c.List(context.Background(), deployments); err != nil || len(deployments.Items) != 0 {
+		t.Errorf("expected nothing to be applied, got %d deployments (%v)", len(deployments.Items), err)
+	}
+}
+
+func TestCreateDerivatives_ReportsInitContainers(t *testing.T) {
+	app := makeApp("ns", "myapp", "Nginx", []helxv1.Service{
+		{Name: "stage", Image: "busybox", Command: []string{"true"}, Init: true},
+		{Name: "fix", Image: "busybox", Command: []string{"chown"}, Init: true},
+		{Name: "main", Image: "nginx", Command: []string{"nginx"}},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "pod-uuid-2")
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "ns", Labels: map[string]string{IDLabel: "pod-uuid-2"}},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodPending,
+			InitContainerStatuses: []corev1.ContainerStatus{
+				{Name: "stage", Ready: true, State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Reason: "Completed"}}},
+				{Name: "fix", RestartCount: 2, State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}}},
+			},
+			ContainerStatuses: []corev1.ContainerStatus{
+				{Name: "main", State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "PodInitializing"}}},
+			},
+		},
+	}
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, app, user, inst, pod)
+	if err := ops.CreateDerivatives(inst, c, scheme, nil, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(inst.Status.Containers) != 3 {
+		t.Fatalf("expected 3 container statuses, got %+v", inst.Status.Containers)
+	}
+	if cs := inst.Status.Containers[0]; cs.Name != "stage" || !cs.Init || cs.Reason != "" {
+		t.Errorf("expected a completed init container without a reason, got %+v", cs)
+	}
+	ready := meta.FindStatusCondition(inst.Status.Conditions, helxv1.HelxInstConditionReady)
+	if ready == nil || !strings.Contains(ready.Message, "init container fix CrashLoopBackOff") || strings.Contains(ready.Message, "stage") {
+		t.Errorf("expected Ready to name the failing init container, got %+v", ready)
+	}
+}
+
+func TestCreateDerivatives_ReportsEndpoints(t *testing.T) {
+	app := makeApp("ns", "myapp", "Nginx", []helxv1.Service{
+		{Name: "main", Image: "nginx", Command: []string{"nginx"}, Ports: []helxv1.PortMap{{ContainerPort: 8080, Port: 80, Name: "http"}}},
+		{Name: "api", Image: "api", Ports: []helxv1.PortMap{{ContainerPort: 9000, Port: 9000}, {ContainerPort: 9090}}},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "endpoint-uuid-1")
+	// a Service named before Services were per container
+	stale := &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "inst1-endpoint-uuid-1", Labels: map[string]string{IDLabel: "endpoint-uuid-1"}}}
+
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, app, user, inst, stale)
+	if err := ops.CreateDerivatives(inst, c, scheme, nil, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	expected := []helxv1.HelxInstEndpoint{
+		{Service: "api-endpoint-uuid-1", Container: "api", Name: "port-9000", Host: "api-endpoint-uuid-1.ns.svc", Port: 9000, Protocol: "TCP"},
+		{Service: "main-endpoint-uuid-1", Container: "main", Name: "http", Host: "main-endpoint-uuid-1.ns.svc", Port: 80, Protocol: "TCP"},
+	}
+	if !reflect.DeepEqual(inst.Status.Endpoints, expected) {
+		t.Errorf("unexpected endpoints %+v", inst.Status.Endpoints)
+	}
+
+	services := &corev1.ServiceList{}
+	if err := c.List(context.Background(), services, client.InNamespace("ns")); err != nil {
+		t.Fatal(err)
+	}
+	if len(services.Items) != 2 {
+		t.Fatalf("expected the two container Services and no stale one, got %d", len(services.Items))
+	}
+	for _, service := range services.Items {
+		if len(service.Spec.Ports) != 1 || service.Spec.Ports[0].TargetPort.String() != service.Spec.Ports[0].Name {
+			t.Errorf("expected one port targeting the container port by name, got %+v", service.Spec.Ports)
+		}
+		if service.Labels[ContainerLabel] == "" {
+			t.Errorf("expected the container label on %s", service.Name)
+		}
+	}
+}
+
+func TestCreateDerivatives_RecreatesHeadlessService(t *testing.T) {
+	app := makeApp("ns", "myapp", "Nginx", []helxv1.Service{
+		{Name: "main", Image: "nginx", Command: []string{"nginx"}, Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80}}},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "headless-uuid-1")
+	key := types.NamespacedName{Namespace: "ns", Name: "main-headless-uuid-1"}
+
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, app, user, inst)
+	for _, serviceType := range []helxv1.ServiceType{helxv1.ServiceTypeClusterIP, helxv1.ServiceTypeHeadless, helxv1.ServiceTypeClusterIP} {
+		app.Spec.Services[0].ServiceType = serviceType
+		if err := c.Update(context.Background(), app); err != nil {
+			t.Fatal(err)
+		}
+		if err := ops.CreateDerivatives(inst, c, scheme, nil, instRequest(inst), context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		service := &corev1.Service{}
+		if err := c.Get(context.Background(), key, service); err != nil {
+			t.Fatal(err)
+		}
+		if headless := service.Spec.ClusterIP == corev1.ClusterIPNone; headless != (serviceType == helxv1.ServiceTypeHeadless) {
+			t.Errorf("expected a %s Service, got clusterIP %q", serviceType, service.Spec.ClusterIP)
+		}
+	}
+}
+
+func TestCreateDerivatives_AppliesRoutes(t *testing.T) {
+	app := makeApp("ns", "myapp", "Jupyter", []helxv1.Service{
+		{Name: "main", Image: "jupyter", Command: []string{"start"}, Ports: []helxv1.PortMap{{ContainerPort: 8888, Port: 80, Name: "http"}}},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "route-uuid-1")
+	// a route for a port the app no longer exposes
+	stale := &networkingv1.Ingress{ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "main-old-route-uuid-1", Labels: map[string]string{IDLabel: "route-uuid-1"}}}
+
+	o := routeOps(t)
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, app, user, inst, stale)
+	if err := o.CreateDerivatives(inst, c, scheme, nil, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ingresses := &networkingv1.IngressList{}
+	if err := c.List(context.Background(), ingresses, client.InNamespace("ns")); err != nil {
+		t.Fatal(err)
+	}
+	if len(ingresses.Items) != 1 || ingresses.Items[0].Name != "main-http-route-uuid-1" {
+		t.Fatalf("expected only the rendered Ingress, got %+v", ingresses.Items)
+	}
+	ingress := ingresses.Items[0]
+	if len(ingress.OwnerReferences) != 1 || ingress.OwnerReferences[0].Name != inst.Name {
+		t.Errorf("expected the Ingress to be owned by the instance, got %+v", ingress.OwnerReferences)
+	}
+	if backend := ingress.Spec.Rules[0].HTTP.Paths[0].Backend.Service; backend.Name != "main-route-uuid-1" || backend.Port.Name != "http" {
+		t.Errorf("expected the Ingress to route to the main Service, got %+v", backend)
+	}
+
+	inst.Spec.Suspended = true
+	if err := o.CreateDerivatives(inst, c, scheme, nil, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.List(context.Background(), ingresses, client.InNamespace("ns")); err != nil {
+		t.Fatal(err)
+	}
+	if len(ingresses.Items) != 0 {
+		t.Errorf("expected the Ingress to be removed while suspended, got %d", len(ingresses.Items))
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Dry-render validation
+// ---------------------------------------------------------------------------
+
+func TestTransformApp_BadVolumeReported(t *testing.T) {
+	app := helxv1.HelxApp{
+		Spec: helxv1.HelxAppSpec{
+			Services: []helxv1.Service{
+				{Name: "good", Image: "nginx", Command: []string{"nginx"}},
+				{Name: "bad", Image: "nginx", Command: []string{"nginx"}, Volumes: map[string]string{"data": "justabadstring"}},
+			},
+		},
+	}
+	inst := makeInst("ns", "inst1", "myapp", "alice", "uuid-1")
+
+	containers, _, _, err := transformApp(inst, app)
+	if err == nil {
+		t.Fatal("expected an error for the bad volume")
+	}
+	if !strings.Contains(err.Error(), "service bad") {
+		t.Errorf("expected error to name the service, got %v", err)
+	}
+	if len(containers) != 1 || containers[0].Name != "good" {
+		t.Errorf("expected only the good container, got %+v", containers)
+	}
+}
+
+func TestGenerateArtifacts_BadVolumeFails(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "main", Image: "nginx", Command: []string{"nginx"}, Volumes: map[string]string{"data": "nfs://server:/mnt"}},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-badvol")
+
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
+	if err == nil {
+		t.Fatal("expected a render error for the bad NFS source")
+	}
+	if artifacts != nil {
+		t.Error("expected nil artifacts on render error")
+	}
+}
+
+func TestValidateApp(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "ok", Image: "nginx", Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80}}},
+		{Name: "noimage", Image: ",Always"},
+		{Name: "badport", Image: "nginx", Ports: []helxv1.PortMap{{ContainerPort: 70000}}},
+		{Name: "badvol", Image: "nginx", Volumes: map[string]string{"v": "nfs://server:/mnt"}},
+	})
+
+	messages := ValidateApp(app)
+	if len(messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d: %v", len(messages), messages)
+	}
+	for i, name := range []string{"noimage", "badport", "badvol"} {
+		if !strings.Contains(messages[i], "service "+name) {
+			t.Errorf("expected message %d to mention %s, got %s", i, name, messages[i])
+		}
+	}
+}
+
+func TestValidateApp_ActivityProbe(t *testing.T) {
+	app := makeApp("ns", "myapp", "Jupyter", []helxv1.Service{
+		{Name: "main", Image: "jupyter", Ports: []helxv1.PortMap{{ContainerPort: 8888, Port: 8888}}, Activity: &helxv1.ActivityProbe{Path: "/api/status"}},
+	})
+	if messages := ValidateApp(app); len(messages) != 0 {
+		t.Errorf("expected a valid app, got %v", messages)
+	}
+	if port := ActivityPort(app.Spec.Services[0]); port != 8888 {
+		t.Errorf("expected the first service port, got %d", port)
+	}
+
+	app.Spec.Services[0].Activity = &helxv1.ActivityProbe{Path: "/api/status", Port: 9999}
+	if messages := ValidateApp(app); len(messages) != 1 || !strings.Contains(messages[0], "activity port 9999") {
+		t.Errorf("expected the activity port to be rejected, got %v", messages)
+	}
+	app.Spec.Services[0].Activity = &helxv1.ActivityProbe{Path: "api/status"}
+	if messages := ValidateApp(app); len(messages) != 1 || !strings.Contains(messages[0], "must start with /") {
+		t.Errorf("expected the activity path to be rejected, got %v", messages)
+	}
+	app.Spec.Services[0].Activity = &helxv1.ActivityProbe{Path: "/api/status"}
+	app.Spec.Services[0].Init = true
+	if messages := ValidateApp(app); len(messages) != 1 || !strings.Contains(messages[0], "init service") {
+		t.Errorf("expected an activity probe on an init service to be rejected, got %v", messages)
+	}
+}
+
+func TestValidateApp_Probes(t *testing.T) {
+	app := makeApp("ns", "myapp", "RStudio", []helxv1.Service{{
+		Name: "rstudio", Image: "rocker/rstudio",
+		ReadinessProbe: &helxv1.Probe{HTTPGet: &helxv1.HTTPGetAction{Path: "/", Port: 8787}, PeriodSeconds: 5},
+		StartupProbe:   &helxv1.Probe{TCPSocket: &helxv1.TCPSocketAction{Port: 8787}, FailureThreshold: 60},
+	}})
+	if messages := ValidateApp(app); len(messages) != 0 {
+		t.Errorf("expected a valid app, got %v", messages)
+	}
+	containers, _, _, err := transformApp(&helxv1.HelxInst{}, *app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probe := containers[0].ReadinessProbe; probe == nil || probe.HTTPGet.Port != 8787 || probe.PeriodSeconds != 5 {
+		t.Errorf("unexpected readiness probe %+v", probe)
+	}
+	if probe := containers[0].StartupProbe; probe == nil || probe.TCPSocket.Port != 8787 || probe.FailureThreshold != 60 {
+		t.Errorf("unexpected startup probe %+v", probe)
+	}
+	if containers[0].LivenessProbe != nil {
+		t.Error("expected no liveness probe")
+	}
+
+	app.Spec.Services[0].LivenessProbe = &helxv1.Probe{Exec: &helxv1.ExecAction{Command: []string{"true"}}, TCPSocket: &helxv1.TCPSocketAction{Port: 8787}}
+	if errs := ValidateAppSpec(app); len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), "spec.services[0].livenessProbe: Invalid value: exactly one of") {
+		t.Errorf("expected two handlers to be rejected, got %v", errs)
+	}
+	app.Spec.Services[0].LivenessProbe = nil
+	app.Spec.Services[0].Init = true
+	if messages := ValidateApp(app); len(messages) != 1 || !strings.Contains(messages[0], "readinessProbe: an init service cannot have probes") {
+		t.Errorf("expected probes on an init service to be rejected, got %v", messages)
+	}
+}
+
+func TestValidateApp_Env(t *testing.T) {
+	app := makeApp("ns", "myapp", "Jupyter", []helxv1.Service{{
+		Name: "jupyter", Image: "jupyter/base-notebook",
+		Env: []helxv1.EnvVar{
+			{Name: "TOKEN", ValueFrom: helxv1.EnvVarSource{SecretKeyRef: &helxv1.KeySelector{Name: "{{ .system.UserName }}-token", Key: "token"}}},
+			{Name: "POD_IP", ValueFrom: helxv1.EnvVarSource{FieldRef: &helxv1.FieldSelector{FieldPath: "status.podIP"}}},
+		},
+		EnvFrom: []helxv1.EnvFromSource{{ConfigMapRef: &helxv1.EnvObjectRef{Name: "defaults"}}},
+	}})
+	if errs := ValidateAppSpec(app); len(errs) != 0 {
+		t.Errorf("expected a valid app, got %v", errs)
+	}
+
+	app.Spec.Services[0].Env[1].ValueFrom.ConfigMapKeyRef = &helxv1.KeySelector{Name: "settings", Key: "ip"}
+	app.Spec.Services[0].EnvFrom[0].SecretRef = &helxv1.EnvObjectRef{Name: "creds"}
+	errs := ValidateAppSpec(app)
+	if len(errs) != 2 || errs[0].Field != "spec.services[0].env[1]" || errs[1].Field != "spec.services[0].envFrom[0]" {
+		t.Errorf("expected env[1] and envFrom[0] to be rejected, got %v", errs)
+	}
+	if messages := ValidateApp(app); len(messages) != 1 || !strings.Contains(messages[0], "env POD_IP: exactly one of") {
+		t.Errorf("expected transformApp to reject the env, got %v", messages)
+	}
+}
+
+func TestValidateApp_EnvDuplicates(t *testing.T) {
+	token := helxv1.EnvVarSource{SecretKeyRef: &helxv1.KeySelector{Name: "creds", Key: "token"}}
+	app := makeApp("ns", "myapp", "Jupyter", []helxv1.Service{{
+		Name: "jupyter", Image: "jupyter/base-notebook",
+		Environment: map[string]string{"TOKEN": "literal"},
+		Env:         []helxv1.EnvVar{{Name: "TOKEN", ValueFrom: token}, {Name: "KEY", ValueFrom: token}, {Name: "KEY", ValueFrom: token}},
+	}})
+	errs := ValidateAppSpec(app)
+	if len(errs) != 2 || errs[0].Field != "spec.services[0].env[0].name" || errs[1].Type != field.ErrorTypeDuplicate || errs[1].Field != "spec.services[0].env[2].name" {
+		t.Errorf("expected env[0] and env[2] to be rejected, got %v", errs)
+	}
+	if messages := ValidateApp(app); len(messages) != 1 || !strings.Contains(messages[0], "env TOKEN is also set in environment") {
+		t.Errorf("expected transformApp to reject the duplicate, got %v", messages)
+	}
+
+	app.Spec.Services[0].Env = app.Spec.Services[0].Env[1:2]
+	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-envdup")
+	inst.Spec.Env = []helxv1.EnvVar{{Name: "TOKEN", ValueFrom: token}}
+	containers, _, _, err := transformApp(inst, *app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := containers[0].Environment["TOKEN"]; found || len(containers[0].ValueFrom) != 2 {
+		t.Errorf("expected the instance env to replace the literal TOKEN, got %v and %+v", containers[0].Environment, containers[0].ValueFrom)
+	}
+	if app.Spec.Services[0].Environment["TOKEN"] != "literal" {
+		t.Error("expected the app's environment to be left alone")
+	}
+
+	inst.Spec.Env = append(inst.Spec.Env, inst.Spec.Env[0])
+	if _, err := ops.GenerateArtifacts(inst, app, makeUser("ns", "alice", nil)); err == nil || !strings.Contains(err.Error(), "more than once") {
+		t.Errorf("expected a repeated instance env to fail rendering, got %v", err)
+	}
+
+	inst.Spec.Env = []helxv1.EnvVar{{Name: "USER", ValueFrom: token}}
+	if _, err := ops.GenerateArtifacts(inst, app, makeUser("ns", "alice", nil)); err == nil || !strings.Contains(err.Error(), "env USER is set by the system") {
+		t.Errorf("expected an instance env named USER to fail rendering, got %v", err)
+	}
+	app.Spec.Services[0].Env = []helxv1.EnvVar{{Name: "HOST", ValueFrom: token}}
+	if errs := ValidateAppSpec(app); len(errs) != 1 || errs[0].Field != "spec.services[0].env[0].name" || !strings.Contains(errs[0].Detail, "set by the system") {
+		t.Errorf("expected an app env named HOST to be rejected, got %v", errs)
+	}
+	if messages := ValidateApp(app); len(messages) != 1 || !strings.Contains(messages[0], "env HOST is set by the system") {
+		t.Errorf("expected transformApp to reject HOST, got %v", messages)
+	}
+}
+
+func TestValidateApp_ServiceNames(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "web", Image: "nginx"},
+		{Name: "Web_UI", Image: "nginx"},
+		{Name: strings.Repeat("a", 27), Image: "nginx"},
+		{Name: strings.Repeat("b", 26), Image: "nginx"},
+	})
+	errs := ValidateAppSpec(app)
+	if len(errs) != 2 || errs[0].Field != "spec.services[1].name" || errs[1].Field != "spec.services[2].name" || !strings.Contains(errs[1].Detail, "longer than 26") {
+		t.Errorf("expected services[1] and services[2] to be rejected, got %v", errs)
+	}
+	if messages := ValidateApp(app); len(messages) != 2 {
+		t.Errorf("expected transformApp to reject both names, got %v", messages)
+	}
+}
+
+func TestTransformApp_EnvMerge(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "stage", Image: "busybox", Init: true},
+		{Name: "web", Image: "nginx",
+			Env: []helxv1.EnvVar{
+				{Name: "A", ValueFrom: helxv1.EnvVarSource{ConfigMapKeyRef: &helxv1.KeySelector{Name: "app", Key: "a"}}},
+				{Name: "B", ValueFrom: helxv1.EnvVarSource{ConfigMapKeyRef: &helxv1.KeySelector{Name: "app", Key: "b"}}},
+			},
+			EnvFrom: []helxv1.EnvFromSource{{ConfigMapRef: &helxv1.EnvObjectRef{Name: "app"}}},
+		},
+	})
+	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-env")
+	inst.Spec.Env = []helxv1.EnvVar{
+		{Name: "A", ValueFrom: helxv1.EnvVarSource{SecretKeyRef: &helxv1.KeySelector{Name: "inst", Key: "a"}}},
+		{Name: "C", ValueFrom: helxv1.EnvVarSource{FieldRef: &helxv1.FieldSelector{FieldPath: "metadata.name"}}},
+	}
+	inst.Spec.EnvFrom = []helxv1.EnvFromSource{{SecretRef: &helxv1.EnvObjectRef{Name: "inst"}}}
+
+	containers, initContainers, _, err := transformApp(inst, *app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := containers[0].ValueFrom
+	if len(env) != 3 || env[0].Name != "A" || env[0].SecretKeyRef == nil || env[0].SecretKeyRef.Name != "inst" ||
+		env[1].Name != "B" || env[1].ConfigMapKeyRef == nil || env[2].Name != "C" || env[2].FieldPath != "metadata.name" {
+		t.Errorf("expected the instance to replace A and append C, got %+v", env)
+	}
+	if envFrom := containers[0].EnvFrom; len(envFrom) != 2 || envFrom[0].ConfigMapRef == nil || envFrom[1].SecretRef == nil {
+		t.Errorf("expected app then instance envFrom, got %+v", envFrom)
+	}
+	if len(initContainers[0].ValueFrom) != 2 || len(initContainers[0].EnvFrom) != 1 {
+		t.Errorf("expected the instance env on the init container, got %+v", initContainers[0])
+	}
+}
+
+func TestValidateApp_Scheduling(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{{Name: "main", Image: "nginx"}})
+	app.Spec.Tolerations = []corev1.Toleration{
+		{Key: "gpu", Operator: corev1.TolerationOpEqual, Value: "true", Effect: corev1.TaintEffectNoSchedule},
+		{Key: "evict", Operator: "Sometimes"},
+	}
+	app.Spec.TopologySpreadConstraints = []corev1.TopologySpreadConstraint{{TopologyKey: "zone", WhenUnsatisfiable: corev1.DoNotSchedule}}
+
+	errs := ValidateAppSpec(app)
+	if len(errs) != 2 || errs[0].Field != "spec.tolerations[1]" || errs[1].Field != "spec.topologySpreadConstraints[0]" {
+		t.Errorf("expected tolerations[1] and topologySpreadConstraints[0] to be rejected, got %v", errs)
+	}
+	if messages := ValidateApp(app); len(messages) != 1 || !strings.Contains(messages[0], "operator must be Equal or Exists") {
+		t.Errorf("expected status validation to report the toleration, got %v", messages)
+	}
+}
+
+func TestValidateApp_Profiles(t *testing.T) {
+	app := profileApp()
+	if errs := ValidateAppSpec(app); len(errs) != 0 {
+		t.Errorf("expected a valid app, got %v", errs)
+	}
+
+	app.Spec.Profiles["gpu-large"] = helxv1.HardwareProfile{
+		Resources: map[string]helxv1.Resources{
+			"jupyter": {Requests: map[string]string{"nvidia.com/gpu": "4", "memory": "lots"}},
+			"rstudio": {Requests: map[string]string{"cpu": "1"}},
+		},
+	}
+	errs := ValidateAppSpec(app)
+	if len(errs) != 3 ||
+		errs[0].Field != "spec.profiles[gpu-large].resources[jupyter].request[memory]" ||
+		errs[1].Field != "spec.profiles[gpu-large].resources[jupyter].request[nvidia.com/gpu]" || !strings.Contains(errs[1].Error(), "above max 2") ||
+		errs[2].Field != "spec.profiles[gpu-large].resources[rstudio]" {
+		t.Errorf("unexpected profile errors %v", errs)
+	}
+	if messages := ValidateApp(app); len(messages) != 3 {
+		t.Errorf("expected status validation to report the profile, got %v", messages)
+	}
+}
+
+func TestBoundResources_Profile(t *testing.T) {
+	app := profileApp()
+	inst := makeInst("ns", "inst1", "myapp", "alice", "bound-uuid-profile")
+	inst.Spec.Profile = "gpu-small"
+	inst.Spec.Resources = map[string]helxv1.Resources{"jupyter": {Requests: map[string]string{"nvidia.com/gpu": "3"}}}
+
+	resources, _, violations := BoundResources(inst, app)
+	if len(violations) != 1 || !strings.Contains(violations[0], "nvidia.com/gpu request 3 is above max 2") {
+		t.Errorf("expected the instance override to be held to the bounds, got %v", violations)
+	}
+	if resources["jupyter"].Requests["memory"] != "16Gi" || resources["jupyter"].Limits["nvidia.com/gpu"] != "1" {
+		t.Errorf("expected the profile values to fill the rest, got %+v", resources["jupyter"])
+	}
+	if len(inst.Spec.Resources["jupyter"].Requests) != 1 || len(app.Spec.Profiles["gpu-small"].Resources["jupyter"].Requests) != 2 {
+		t.Error("expected the instance and profile to be left unchanged")
+	}
+}
+
+func TestValidateApp_PortNames(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "web", Image: "nginx", Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80, Name: "http"}, {ContainerPort: 81, Port: 81}}},
+		{Name: "api", Image: "api", Ports: []helxv1.PortMap{{ContainerPort: 9000, Port: 9000, Name: "http"}, {ContainerPort: 9001, Name: "Not_Valid"}}},
+	})
+	errs := ValidateAppSpec(app)
+	if len(errs) != 2 || errs[0].Field != "spec.services[1].ports[0].name" || errs[0].Type != field.ErrorTypeDuplicate ||
+		errs[1].Field != "spec.services[1].ports[1].name" || errs[1].Type != field.ErrorTypeInvalid {
+		t.Errorf("expected a duplicate and an invalid port name, got %v", errs)
+	}
+	if messages := ValidateApp(app); len(messages) != 1 || !strings.Contains(messages[0], `port name "Not_Valid"`) {
+		t.Errorf("expected transformApp to reject the port name, got %v", messages)
+	}
+}
+
+func TestValidateApp_Protocols(t *testing.T) {
+	app := makeApp("ns", "myapp", "DNS", []helxv1.Service{{
+		Name: "dns", Image: "coredns",
+		Ports: []helxv1.PortMap{{ContainerPort: 53, Port: 53}, {ContainerPort: 53, Port: 53, Protocol: "UDP"}},
+	}})
+	if errs := ValidateAppSpec(app); len(errs) != 0 {
+		t.Errorf("expected the same port over TCP and UDP to be valid, got %v", errs)
+	}
+	containers, _, _, err := transformApp(&helxv1.HelxInst{}, *app)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ports := containers[0].Ports; ports[0].Name != "port-53" || ports[1].Name != "udp-53" || ports[1].Protocol != "UDP" {
+		t.Errorf("unexpected ports %+v", ports)
+	}
+
+	app.Spec.Services[0].Ports[1].Protocol = "QUIC"
+	if errs := ValidateAppSpec(app); len(errs) != 1 || errs[0].Field != "spec.services[0].ports[1].protocol" {
+		t.Errorf("expected an unknown protocol to be rejected, got %v", errs)
+	}
+}
+
+func TestValidateServiceTypes(t *testing.T) {
+	if types, err := ParseServiceTypes("ClusterIP, NodePort,"); err != nil || !reflect.DeepEqual(types, []helxv1.ServiceType{helxv1.ServiceTypeClusterIP, helxv1.ServiceTypeNodePort}) {
+		t.Errorf("unexpected types %v %v", types, err)
+	}
+	if _, err := ParseServiceTypes("ClusterIP,ExternalName"); err == nil {
+		t.Error("expected an unknown service type to be rejected")
+	}
+
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "stage", Image: "busybox", Init: true, ServiceType: helxv1.ServiceTypeLoadBalancer},
+		{Name: "web", Image: "nginx", Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80}}},
+		{Name: "vnc", Image: "vnc", Ports: []helxv1.PortMap{{ContainerPort: 5900, Port: 5900}}, ServiceType: helxv1.ServiceTypeLoadBalancer},
+	})
+	if errs := ValidateServiceTypes(app, nil); len(errs) != 1 || errs[0].Field != "spec.services[2].serviceType" {
+		t.Errorf("expected only the vnc LoadBalancer to be refused, got %v", errs)
+	}
+	if errs := ValidateServiceTypes(app, []helxv1.ServiceType{helxv1.ServiceTypeLoadBalancer}); len(errs) != 1 || errs[0].Field != "spec.services[1].serviceType" {
+		t.Errorf("expected the implicit ClusterIP to be refused, got %v", errs)
+	}
+}
+
+func TestValidateApp_Valid(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "main", Image: "nginx:latest,Always", Volumes: map[string]string{"home": "{{ .system.UserName }}-home:/home,rwx"}},
+	})
+	if messages := ValidateApp(app); len(messages) != 0 {
+		t.Errorf("expected no messages, got %v", messages)
+	}
+	if errs := ValidateAppSpec(app); len(errs) != 0 {
+		t.Errorf("expected no field errors, got %v", errs)
+	}
+}
+
+func TestValidateAppSpec(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "web", Image: "nginx", Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80}}, ResourceBounds: map[string]helxv1.ResourceBoundary{"cpu": {Min: "2", Max: "1"}}},
+		{Name: "web", Image: " ", Ports: []helxv1.PortMap{{ContainerPort: 80}, {ContainerPort: 0, Port: 70000}}},
+		{Name: "", Image: "busybox", Volumes: map[string]string{"data": "nfs://server:/mnt", "home": "ftp://x:/home"}},
+	})
+
+	errs := ValidateAppSpec(app)
+	expected := []string{
+		"spec.services[0].resourceBounds[cpu]: Invalid value",
+		"spec.services[1].name: Duplicate value: \"web\"",
+		"spec.services[1].image: Required value",
+		"spec.services[1].ports[0].containerPort: Duplicate value: 80",
+		"spec.services[1].ports[1].containerPort: Invalid value: 0",
+		"spec.services[1].ports[1].port: Invalid value: 70000",
+		"spec.services[2].name: Required value",
+		"spec.services[2].volumes[data]: Invalid value: \"nfs://server:/mnt\": invalid NFS source format",
+		"spec.services[2].volumes[home]: Invalid value: \"ftp://x:/home\"",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %d errors, got %d: %v", len(expected), len(errs), errs)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(errs[i].Error(), prefix) {
+			t.Errorf("expected error %d to start with %q, got %q", i, prefix, errs[i].Error())
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// User identity lookup
+// ---------------------------------------------------------------------------
+
+func userHandleServer(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+}
+
+func TestResolveUser(t *testing.T) {
+	server := userHandleServer(`{"runAsUser": "1000", "runAsGroup": 1001, "fsGroup": "2000", "supplementalGroups": ["100", 200]}`)
+	defer server.Close()
+
+	handle := server.URL
+	sc, info, err := ResolveUser(makeUser("ns", "alice", &handle))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if info["fsGroup"] != "2000" {
+		t.Errorf("expected the whole response as user info, got %v", info)
+	}
+	if *sc.RunAsUser != 1000 || *sc.RunAsGroup != 1001 || *sc.FSGroup != 2000 {
+		t.Errorf("unexpected identity %+v", sc)
+	}
+	if len(sc.SupplementalGroups) != 2 || sc.SupplementalGroups[0] != 100 || sc.SupplementalGroups[1] != 200 {
+		t.Errorf("unexpected supplementalGroups %v", sc.SupplementalGroups)
+	}
+}
+
+func TestResolveUser_NoHandle(t *testing.T) {
+	sc, info, err := ResolveUser(makeUser("ns", "alice", nil))
+	if sc != nil || info != nil || err != nil {
+		t.Errorf("expected nil, nil, nil without a handle, got %+v, %v, %v", sc, info, err)
+	}
+}
+
+func TestResolveUser_NoIdentity(t *testing.T) {
+	server := userHandleServer(`{"name": "alice"}`)
+	defer server.Close()
+
+	handle := server.URL
+	if _, _, err := ResolveUser(makeUser("ns", "alice", &handle)); err == nil {
+		t.Error("expected an error when the handle returns no identity")
+	}
+}
+
+func TestResolveUser_BadValue(t *testing.T) {
+	server := userHandleServer(`{"runAsUser": "alice"}`)
+	defer server.Close()
+
+	handle := server.URL
+	_, _, err := ResolveUser(makeUser("ns", "alice", &handle))
+	if err == nil || !strings.Contains(err.Error(), "runAsUser") {
+		t.Errorf("expected a runAsUser error, got %v", err)
+	}
+}
+
+func TestGenerateArtifacts_UserIdentityFromStatus(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"runAsUser": "2000"}`))
+	}))
+	defer server.Close()
+
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "main", Image: "nginx", Command: []string{"nginx"}},
+	})
+	handle := server.URL
+	user := makeUser("ns", "alice", &handle)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "test-uuid-identity")
+
+	// never resolved: the render looks the identity up itself
+	artifacts, err := ops.GenerateArtifacts(inst, app, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 || !strings.Contains(artifacts.Deployment.Render, "runAsUser: 2000") {
+		t.Errorf("expected one lookup rendering runAsUser 2000, got %d lookups:\n%s", requests, artifacts.Deployment.Render)
+	}
+
+	// resolved by the HelxUser reconciler: the render uses the status
+	uid := int64(1000)
+	now := metav1.Now()
+	user.Status.SecurityContext = &helxv1.SecurityContext{RunAsUser: &uid}
+	user.Status.UserInfo = &runtime.RawExtension{Raw: []byte(`{"runAsUser": "1000", "home": "/home/alice"}`)}
+	user.Status.LastLookupTime = &now
+	if artifacts, err = ops.GenerateArtifacts(inst, app, user); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 || !strings.Contains(artifacts.Deployment.Render, "runAsUser: 1000") {
+		t.Errorf("expected the stored identity without a lookup, got %d lookups:\n%s", requests, artifacts.Deployment.Render)
+	}
+	if info := StoredUserInfo(user); info["home"] != "/home/alice" {
+		t.Errorf("unexpected stored user info %v", info)
+	}
+}
+
+func TestResolveUser_Unreachable(t *testing.T) {
+	server := userHandleServer(`{}`)
+	handle := server.URL
+	server.Close()
+
+	if _, _, err := ResolveUser(makeUser("ns", "alice", &handle)); err == nil {
+		t.Error("expected an error for an unreachable handle")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Events
+// ---------------------------------------------------------------------------
+
+func drainEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func hasEvent(events []string, prefix string) bool {
+	for _, event := range events {
+		if strings.HasPrefix(event, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCreateDerivatives_EventsWaiting(t *testing.T) {
+	inst := makeInst("ns", "inst1", "myapp", "alice", "event-uuid-1")
+
+	scheme := newTestScheme()
+	recorder := record.NewFakeRecorder(10)
+	if err := ops.CreateDerivatives(inst, newFakeClient(scheme), scheme, recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	events := drainEvents(recorder)
+	if !hasEvent(events, "Normal WaitingForApp") || !hasEvent(events, "Normal WaitingForUser") {
+		t.Errorf("expected waiting events, got %v", events)
+	}
+
+	// still waiting: the conditions are already False, so nothing new is reported
+	if err := ops.CreateDerivatives(inst, newFakeClient(scheme), scheme, recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if events := drainEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no repeated waiting events, got %v", events)
+	}
+}
+
+func TestCreateDerivatives_EventsCreatedThenPatched(t *testing.T) {
+	app := makeApp("ns", "myapp", "Nginx", []helxv1.Service{
+		{Name: "main", Image: "nginx", Command: []string{"nginx"}, Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80}}},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "event-uuid-2")
+
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, app, user, inst)
+	recorder := record.NewFakeRecorder(10)
+	if err := ops.CreateDerivatives(inst, c, scheme, recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	events := drainEvents(recorder)
+	if !hasEvent(events, "Normal Created created deployment") || !hasEvent(events, "Normal Created created service main") {
+		t.Errorf("expected created events, got %v", events)
+	}
+
+	if err := ops.CreateDerivatives(inst, c, scheme, recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if events := drainEvents(recorder); hasEvent(events, "Normal Created") {
+		t.Errorf("expected no created events on the second pass, got %v", events)
+	}
+}
+
+func TestCreateDerivatives_EventRenderFailed(t *testing.T) {
+	app := makeApp("ns", "myapp", "App", []helxv1.Service{
+		{Name: "main", Image: "nginx", Command: []string{"nginx"}, Volumes: map[string]string{"data": "nfs://server:/mnt"}},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "event-uuid-3")
+
+	scheme := newTestScheme()
+	recorder := record.NewFakeRecorder(10)
+	if err := ops.CreateDerivatives(inst, newFakeClient(scheme, app, user, inst), scheme, recorder, instRequest(inst), context.Background()); err == nil {
+		t.Fatal("expected a render error")
+	}
+	if events := drainEvents(recorder); !hasEvent(events, "Warning RenderFailed") {
+		t.Errorf("expected a RenderFailed warning, got %v", events)
+	}
+}
+
+func TestDeleteDerivatives_Events(t *testing.T) {
+	inst := makeInst("ns", "inst1", "myapp", "alice", "event-uuid-4")
+	scheme := newTestScheme()
+	recorder := record.NewFakeRecorder(10)
+	if err := ops.DeleteDerivatives(inst, newFakeClient(scheme), recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if events := drainEvents(recorder); !hasEvent(events, "Normal Deleting") {
+		t.Errorf("expected a Deleting event, got %v", events)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Finalizer deletion policies
+// ---------------------------------------------------------------------------
+
+func TestListBoundInsts(t *testing.T) {
+	scheme := newTestScheme()
+	c := newFakeClient(scheme,
+		makeInst("ns", "inst1", "myapp", "alice", "fin-uuid-1"),
+		makeInst("other", "inst2", "ns/myapp", "bob", "fin-uuid-2"),
+		makeInst("other", "inst3", "myapp", "alice", "fin-uuid-3"),
+	)
+
+	insts, err := ListBoundInsts(context.Background(), c, AppNameIndex, "ns/myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insts) != 2 {
+		t.Fatalf("expected 2 instances bound to ns/myapp, got %d", len(insts))
+	}
+	insts, err = ListBoundInsts(context.Background(), c, UserNameIndex, "other/alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(insts) != 1 || insts[0].Name != "inst3" {
+		t.Errorf("expected [inst3] bound to other/alice, got %+v", insts)
+	}
+}
+
+func finalizeFixture(t *testing.T, policy helxv1.DeletionPolicy) (client.Client, bool, error) {
+	inst := makeInst("ns", "inst1", "myapp", "alice", "fin-uuid-4")
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "inst1-fin-uuid-4",
+			Namespace: "ns",
+			Labels:    map[string]string{"helx.renci.org/id": "fin-uuid-4"},
+		},
+	}
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, inst, deployment)
+
+	insts, err := ListBoundInsts(context.Background(), c, AppNameIndex, "ns/myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocked, err := ops.FinalizeInsts(context.Background(), c, nil, instRequest(inst), policy, "AppDeleted", "HelxApp ns/myapp was deleted", insts)
+	return c, blocked, err
+}
+
+func countObjects(t *testing.T, c client.Client) (int, int) {
+	instList := &helxv1.HelxInstList{}
+	if err := c.List(context.Background(), instList); err != nil {
+		t.Fatal(err)
+	}
+	deployments := &appsv1.DeploymentList{}
+	if err := c.List(context.Background(), deployments); err != nil {
+		t.Fatal(err)
+	}
+	return len(instList.Items), len(deployments.Items)
+}
+
+func TestFinalizeInsts_Delete(t *testing.T) {
+	for _, policy := range []helxv1.DeletionPolicy{helxv1.DeletionPolicyDelete, ""} {
+		c, blocked, err := finalizeFixture(t, policy)
+		if err != nil || blocked {
+			t.Fatalf("policy %q: expected no error and not blocked, got %v, %v", policy, blocked, err)
+		}
+		if insts, deployments := countObjects(t, c); insts != 0 || deployments != 0 {
+			t.Errorf("policy %q: expected everything deleted, got %d insts, %d deployments", policy, insts, deployments)
+		}
+	}
+}
+
+func TestFinalizeInsts_Orphan(t *testing.T) {
+	c, blocked, err := finalizeFixture(t, helxv1.DeletionPolicyOrphan)
+	if err != nil || blocked {
+		t.Fatalf("expected no error and not blocked, got %v, %v", blocked, err)
+	}
+	if insts, deployments := countObjects(t, c); insts != 1 || deployments != 1 {
+		t.Errorf("expected everything kept, got %d insts, %d deployments", insts, deployments)
+	}
+}
+
+func TestFinalizeInsts_Block(t *testing.T) {
+	c, blocked, err := finalizeFixture(t, helxv1.DeletionPolicyBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blocked {
+		t.Error("expected the deletion to be blocked")
+	}
+	if insts, deployments := countObjects(t, c); insts != 1 || deployments != 1 {
+		t.Errorf("expected everything kept, got %d insts, %d deployments", insts, deployments)
+	}
+
+	blocked, err = ops.FinalizeInsts(context.Background(), c, nil, ctrl.Request{}, helxv1.DeletionPolicyBlock, "AppDeleted", "", nil)
+	if err != nil || blocked {
+		t.Errorf("expected no block without instances, got %v, %v", blocked, err)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Concurrent reconciles
+// ---------------------------------------------------------------------------
+
+func parallelApp() *helxv1.HelxApp {
+	return makeApp("ns", "myapp", "Nginx", []helxv1.Service{
+		{
+			Name:        "main",
+			Image:       "nginx",
+			Command:     []string{"nginx"},
+			Environment: map[string]string{"OWNER": "{{ .system.UserName }}"},
+			Ports:       []helxv1.PortMap{{ContainerPort: 80, Port: 80}},
+			Volumes:     map[string]string{"home": "{{ .system.UserName }}-home:/home"},
+		},
+	})
+}
+
+func TestGenerateArtifacts_Parallel(t *testing.T) {
+	app := parallelApp()
+	user := makeUser("ns", "alice", nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			uuid := fmt.Sprintf("parallel-uuid-%d", i)
+			inst := makeInst("ns", fmt.Sprintf("inst%d", i), "myapp", "alice", uuid)
+			artifacts, err := ops.GenerateArtifacts(inst, app, user)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if !strings.Contains(artifacts.Deployment.Render, uuid) {
+				errs <- fmt.Errorf("inst%d: deployment does not carry its own uuid", i)
+			}
+			if strings.Count(artifacts.Deployment.Render, "parallel-uuid-") != strings.Count(artifacts.Deployment.Render, uuid) {
+				errs <- fmt.Errorf("inst%d: deployment carries another instance's uuid", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestCreateDerivatives_IsolatedOperations(t *testing.T) {
+	for i := 0; i < 4; i++ {
+		i := i
+		t.Run(fmt.Sprintf("operations-%d", i), func(t *testing.T) {
+			t.Parallel()
+			o, err := NewOperations(logr.Discard(), "../templates")
+			if err != nil {
+				t.Fatal(err)
+			}
+			app := parallelApp()
+			user := makeUser("ns", "alice", nil)
+			scheme := newTestScheme()
+			for j := 0; j < 4; j++ {
+				inst := makeInst("ns", fmt.Sprintf("inst%d", j), "myapp", "alice", fmt.Sprintf("isolated-%d-%d", i, j))
+				c := newFakeClient(scheme, app, user, inst)
+				if err := o.CreateDerivatives(inst, c, scheme, nil, instRequest(inst), context.Background()); err != nil {
+					t.Fatal(err)
+				}
+				if inst.Status.Phase != helxv1.HelxInstPhaseDeploying {
+					t.Errorf("expected phase Deploying, got %s", inst.Status.Phase)
+				}
+			}
+		})
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Drift repair
+// ---------------------------------------------------------------------------
+
+func driftFixture(t *testing.T, uuid string) (client.Client, *runtime.Scheme, *helxv1.HelxInst, *record.FakeRecorder) {
+	t.Helper()
+	app := makeApp("ns", "myapp", "Nginx", []helxv1.Service{
+		{Name: "main", Image: "nginx", Command: []string{"nginx"}, Ports: []helxv1.PortMap{{ContainerPort: 80, Port: 80}}},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", uuid)
+
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, app, user, inst)
+	recorder := record.NewFakeRecorder(10)
+	if err := ops.CreateDerivatives(inst, c, scheme, recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	drainEvents(recorder)
+	return c, scheme, inst, recorder
+}
+
+func getDeployment(t *testing.T, c client.Client, uuid string) *appsv1.Deployment {
+	t.Helper()
+	deployment := &appsv1.Deployment{}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "ns", Name: "inst1-" + uuid}, deployment); err != nil {
+		t.Fatal(err)
+	}
+	return deployment
+}
+
+func TestCreateDerivatives_NoDriftNoPatch(t *testing.T) {
+	c, scheme, inst, recorder := driftFixture(t, "drift-uuid-1")
+	before := getDeployment(t, c, "drift-uuid-1")
+	if !metav1.IsControlledBy(before, inst) {
+		t.Fatal("expected the deployment to be controlled by the instance")
+	}
+
+	if err := ops.CreateDerivatives(inst, c, scheme, recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if events := drainEvents(recorder); hasEvent(events, "Normal Patched") {
+		t.Errorf("expected no patch without drift, got %v", events)
+	}
+	if after := getDeployment(t, c, "drift-uuid-1"); after.ResourceVersion != before.ResourceVersion {
+		t.Errorf("expected resourceVersion %s to be unchanged, got %s", before.ResourceVersion, after.ResourceVersion)
+	}
+}
+
+func TestCreateDerivatives_IgnoresServerDefaults(t *testing.T) {
+	c, scheme, inst, recorder := driftFixture(t, "drift-uuid-2")
+	deployment := getDeployment(t, c, "drift-uuid-2")
+	deployment.Annotations = map[string]string{"deployment.kubernetes.io/revision": "1"}
+	deployment.Spec.Template.Spec.Containers[0].TerminationMessagePath = "/dev/termination-log"
+	deployment.Spec.Template.Spec.DNSPolicy = "ClusterFirst"
+	if err := c.Update(context.Background(), deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ops.CreateDerivatives(inst, c, scheme, recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if events := drainEvents(recorder); hasEvent(events, "Normal Patched") {
+		t.Errorf("expected defaulted fields not to count as drift, got %v", events)
+	}
+}
+
+func TestCreateDerivatives_RepairsDrift(t *testing.T) {
+	c, scheme, inst, recorder := driftFixture(t, "drift-uuid-3")
+	deployment := getDeployment(t, c, "drift-uuid-3")
+	image := deployment.Spec.Template.Spec.Containers[0].Image
+	deployment.Spec.Template.Spec.Containers[0].Image = "busybox"
+	deployment.OwnerReferences = nil
+	if err := c.Update(context.Background(), deployment); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ops.CreateDerivatives(inst, c, scheme, recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if events := drainEvents(recorder); !hasEvent(events, "Normal Patched patched deployment") {
+		t.Errorf("expected a patched event, got %v", events)
+	}
+	repaired := getDeployment(t, c, "drift-uuid-3")
+	if got := repaired.Spec.Template.Spec.Containers[0].Image; got != image {
+		t.Errorf("expected image %s to be restored, got %s", image, got)
+	}
+	if !metav1.IsControlledBy(repaired, inst) {
+		t.Error("expected the owner reference to be restored")
+	}
+}
+
+func TestCreateDerivatives_RecreatesDeleted(t *testing.T) {
+	c, scheme, inst, recorder := driftFixture(t, "drift-uuid-4")
+	if err := c.Delete(context.Background(), getDeployment(t, c, "drift-uuid-4")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ops.CreateDerivatives(inst, c, scheme, recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if events := drainEvents(recorder); !hasEvent(events, "Normal Created created deployment") {
+		t.Errorf("expected the deployment to be recreated, got %v", events)
+	}
+	getDeployment(t, c, "drift-uuid-4")
+}
+
+func TestIsDrift(t *testing.T) {
+	cases := []struct {
+		op    jsonpatch.JsonPatchOperation
+		drift bool
+	}{
+		{jsonpatch.NewOperation("replace", "/spec/replicas", 2), true},
+		{jsonpatch.NewOperation("add", "/metadata/labels/app", "x"), true},
+		{jsonpatch.NewOperation("remove", "/spec/template/spec/containers/1", nil), true},
+		{jsonpatch.NewOperation("remove", "/spec/template/spec/dnsPolicy", nil), false},
+		{jsonpatch.NewOperation("remove", "/metadata/annotations/revision", nil), false},
+		{jsonpatch.NewOperation("replace", "/status/replicas", 0), false},
+		{jsonpatch.NewOperation("remove", "/metadata/resourceVersion", nil), false},
+		{jsonpatch.NewOperation("add", "/kind", "Deployment"), false},
+	}
+	for _, tc := range cases {
+		if got := isDrift(tc.op); got != tc.drift {
+			t.Errorf("%s %s: expected drift=%v, got %v", tc.op.Operation, tc.op.Path, tc.drift, got)
+		}
+	}
+}
+
+func TestSameValue(t *testing.T) {
+	var live interface{}
+	if err := json.Unmarshal([]byte(`{"spec": {"replicas": 1, "containers": [{"name": "main", "resources": {"limits": {"cpu": "1", "memory": "1Gi"}}}]}}`), &live); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		op   jsonpatch.JsonPatchOperation
+		same bool
+	}{
+		{jsonpatch.NewOperation("replace", "/spec/containers/0/resources/limits/cpu", "1000m"), true},
+		{jsonpatch.NewOperation("replace", "/spec/containers/0/resources/limits/memory", "1024Mi"), true},
+		{jsonpatch.NewOperation("replace", "/spec/containers/0/resources/limits/memory", "2Gi"), false},
+		{jsonpatch.NewOperation("replace", "/spec/containers/0/name", "other"), false},
+		{jsonpatch.NewOperation("replace", "/spec/replicas", 2), false},
+		{jsonpatch.NewOperation("add", "/spec/containers/0/resources/limits/cpu", "1"), false},
+		{jsonpatch.NewOperation("replace", "/spec/containers/3/resources/limits/cpu", "1"), false},
+	}
+	for _, tc := range cases {
+		if got := sameValue(live, tc.op); got != tc.same {
+			t.Errorf("%s %s %v: expected same=%v, got %v", tc.op.Operation, tc.op.Path, tc.op.Value, tc.same, got)
+		}
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Suspend and resume
+// ---------------------------------------------------------------------------
+
+func countWorkload(t *testing.T, c client.Client) (int32, int, int) {
+	t.Helper()
+	deployments := &appsv1.DeploymentList{}
+	services := &corev1.ServiceList{}
+	pvcs := &corev1.PersistentVolumeClaimList{}
+	for _, list := range []client.ObjectList{deployments, services, pvcs} {
+		if err := c.List(context.Background(), list, client.InNamespace("ns")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(deployments.Items) != 1 {
+		t.Fatalf("expected 1 deployment, got %d", len(deployments.Items))
+	}
+	return *deployments.Items[0].Spec.Replicas, len(services.Items), len(pvcs.Items)
+}
+
+func TestCreateDerivatives_SuspendAndResume(t *testing.T) {
+	app := makeApp("ns", "myapp", "Nginx", []helxv1.Service{
+		{
+			Name:    "main",
+			Image:   "nginx",
+			Command: []string{"nginx"},
+			Ports:   []helxv1.PortMap{{ContainerPort: 80, Port: 80}},
+			Volumes: map[string]string{"data": "mydata:/data"},
+		},
+	})
+	user := makeUser("ns", "alice", nil)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "suspend-uuid-1")
+
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, app, user, inst)
+	recorder := record.NewFakeRecorder(10)
+	reconcile := func() {
+		t.Helper()
+		if err := ops.CreateDerivatives(inst, c, scheme, recorder, instRequest(inst), context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reconcile()
+	if replicas, services, pvcs := countWorkload(t, c); replicas != 1 || services != 1 || pvcs != 1 {
+		t.Fatalf("expected 1 replica, 1 service, 1 pvc; got %d, %d, %d", replicas, services, pvcs)
+	}
+	drainEvents(recorder)
+
+	inst.Spec.Suspended = true
+	reconcile()
+	if replicas, services, pvcs := countWorkload(t, c); replicas != 0 || services != 0 || pvcs != 1 {
+		t.Errorf("expected 0 replicas, 0 services, 1 pvc; got %d, %d, %d", replicas, services, pvcs)
+	}
+	if inst.Status.Phase != helxv1.HelxInstPhaseSuspended || inst.Status.UUID != "suspend-uuid-1" {
+		t.Errorf("expected phase Suspended with the same uuid, got %s %s", inst.Status.Phase, inst.Status.UUID)
+	}
+	if len(inst.Status.Endpoints) != 0 {
+		t.Errorf("expected no endpoints while suspended, got %v", inst.Status.Endpoints)
+	}
+	if events := drainEvents(recorder); !hasEvent(events, "Normal Suspended") {
+		t.Errorf("expected a suspended event, got %v", events)
+	}
+
+	inst.Spec.Suspended = false
+	reconcile()
+	if replicas, services, pvcs := countWorkload(t, c); replicas != 1 || services != 1 || pvcs != 1 {
+		t.Errorf("expected 1 replica, 1 service, 1 pvc; got %d, %d, %d", replicas, services, pvcs)
+	}
+	if inst.Status.Phase != helxv1.HelxInstPhaseDeploying {
+		t.Errorf("expected phase Deploying after resume, got %s", inst.Status.Phase)
+	}
+	if events := drainEvents(recorder); !hasEvent(events, "Normal Resumed") {
+		t.Errorf("expected a resumed event, got %v", events)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Expiry
+// ---------------------------------------------------------------------------
+
+func TestInstDeadline(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "ttl-uuid-1")
+	inst.CreationTimestamp = metav1.NewTime(created)
+
+	if deadline := InstDeadline(inst); deadline != nil {
+		t.Errorf("expected no deadline, got %v", deadline)
+	}
+
+	inst.Spec.TTL = &metav1.Duration{Duration: 48 * time.Hour}
+	if deadline := InstDeadline(inst); deadline == nil || !deadline.Time.Equal(created.Add(48*time.Hour)) {
+		t.Errorf("expected the ttl deadline, got %v", deadline)
+	}
+
+	expiresAt := metav1.NewTime(created.Add(24 * time.Hour))
+	inst.Spec.ExpiresAt = &expiresAt
+	if deadline := InstDeadline(inst); deadline == nil || !deadline.Time.Equal(expiresAt.Time) {
+		t.Errorf("expected the earlier expiresAt, got %v", deadline)
+	}
+}
+
+func TestObserveExpiry(t *testing.T) {
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	inst := makeInst("ns", "inst1", "myapp", "alice", "ttl-uuid-2")
+	inst.CreationTimestamp = metav1.NewTime(created)
+	inst.Spec.TTL = &metav1.Duration{Duration: 10 * time.Hour}
+	recorder := record.NewFakeRecorder(10)
+
+	// well before the deadline: scheduled, requeue at the start of the warning window
+	expired, after := ObserveExpiry(recorder, inst, created.Add(time.Hour), time.Hour)
+	if expired || after != 8*time.Hour {
+		t.Errorf("expected requeue in 8h, got expired=%v after=%v", expired, after)
+	}
+	if !meta.IsStatusConditionFalse(inst.Status.Conditions, helxv1.HelxInstConditionExpiring) || inst.Status.ExpiresAt == nil {
+		t.Error("expected Expiring=False and status.expiresAt set")
+	}
+	if events := drainEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no events, got %v", events)
+	}
+
+	// inside the warning window: one warning, requeue at the deadline
+	for i := 0; i < 2; i++ {
+		expired, after = ObserveExpiry(recorder, inst, created.Add(9*time.Hour+30*time.Minute), time.Hour)
+		if expired || after != 30*time.Minute {
+			t.Errorf("expected requeue in 30m, got expired=%v after=%v", expired, after)
+		}
+	}
+	if !meta.IsStatusConditionTrue(inst.Status.Conditions, helxv1.HelxInstConditionExpiring) {
+		t.Error("expected Expiring=True")
+	}
+	if events := drainEvents(recorder); len(events) != 1 || !hasEvent(events, "Warning ExpiringSoon") {
+		t.Errorf("expected a single ExpiringSoon event, got %v", events)
+	}
+
+	// past the deadline
+	if expired, _ = ObserveExpiry(recorder, inst, created.Add(10*time.Hour), time.Hour); !expired {
+		t.Error("expected the instance to be expired")
+	}
+	if events := drainEvents(recorder); !hasEvent(events, "Warning Expired") {
+		t.Errorf("expected an expired event, got %v", events)
+	}
+
+	// clearing the ttl removes the condition
+	inst.Spec.TTL = nil
+	ObserveExpiry(recorder, inst, created.Add(10*time.Hour), time.Hour)
+	if meta.FindStatusCondition(inst.Status.Conditions, helxv1.HelxInstConditionExpiring) != nil || inst.Status.ExpiresAt != nil {
+		t.Error("expected the Expiring condition and status.expiresAt to be cleared")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Restart
+// ---------------------------------------------------------------------------
+
+func TestCreateDerivatives_RestartedAtRollsPods(t *testing.T) {
+	c, scheme, inst, recorder := driftFixture(t, "restart-uuid-1")
+	if _, found := getDeployment(t, c, "restart-uuid-1").Spec.Template.Annotations["helx.renci.org/restartedAt"]; found {
+		t.Fatal("expected no restartedAt annotation before a restart")
+	}
+
+	restartedAt := metav1.NewTime(time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC))
+	inst.Spec.RestartedAt = &restartedAt
+	if err := ops.CreateDerivatives(inst, c, scheme, recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := getDeployment(t, c, "restart-uuid-1").Spec.Template.Annotations["helx.renci.org/restartedAt"]; got != "2024-03-01T09:00:00Z" {
+		t.Errorf("expected the pod template to carry the restart time, got %q", got)
+	}
+	if !inst.Status.LastRestartedAt.Equal(&restartedAt) {
+		t.Errorf("expected lastRestartedAt %v, got %v", restartedAt, inst.Status.LastRestartedAt)
+	}
+	events := drainEvents(recorder)
+	if !hasEvent(events, "Normal Patched patched deployment") || !hasEvent(events, "Normal Restarted") {
+		t.Errorf("expected patched and restarted events, got %v", events)
+	}
+
+	if err := ops.CreateDerivatives(inst, c, scheme, recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if events := drainEvents(recorder); len(events) != 0 {
+		t.Errorf("expected no events once the restart is applied, got %v", events)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// User quota
+// ---------------------------------------------------------------------------
+
+func quotaInst(name string, created int64, cpu string) *helxv1.HelxInst {
+	inst := makeInst("ns", name, "myapp", "alice", name+"-uuid")
+	inst.CreationTimestamp = metav1.Unix(created, 0)
+	if cpu != "" {
+		inst.Spec.Resources = map[string]helxv1.Resources{"main": {Requests: map[string]string{"cpu": cpu}}}
+	}
+	return inst
+}
+
+func quotaUser(quota helxv1.UserQuota) *helxv1.HelxUser {
+	user := makeUser("ns", "alice", nil)
+	user.Spec.Quota = &quota
+	return user
+}
+
+func quotaApp(volume string) *helxv1.HelxApp {
+	service := helxv1.Service{Name: "main", Image: "nginx", Command: []string{"nginx"}}
+	if volume != "" {
+		service.Volumes = map[string]string{"data": volume}
+	}
+	return makeApp("ns", "myapp", "Nginx", []helxv1.Service{service})
+}
+
+func checkQuota(t *testing.T, c client.Client, user *helxv1.HelxUser, inst *helxv1.HelxInst) string {
+	t.Helper()
+	message, err := CheckQuota(context.Background(), c, inst, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return message
+}
+
+func TestCheckQuota_MaxInstances(t *testing.T) {
+	maxInstances := int32(1)
+	user := quotaUser(helxv1.UserQuota{MaxInstances: &maxInstances})
+	older, younger := quotaInst("older", 100, ""), quotaInst("younger", 200, "")
+	c := newFakeClient(newTestScheme(), quotaApp(""), user, older, younger)
+
+	// the answer is the same whichever instance is reconciled first
+	if message := checkQuota(t, c, user, younger); !strings.Contains(message, "instances 2 > 1") {
+		t.Errorf("expected the younger instance to exceed the quota, got %q", message)
+	}
+	if message := checkQuota(t, c, user, older); message != "" {
+		t.Errorf("expected the older instance to fit, got %q", message)
+	}
+
+	// a suspended instance does not count
+	older.Spec.Suspended = true
+	if err := c.Update(context.Background(), older); err != nil {
+		t.Fatal(err)
+	}
+	if message := checkQuota(t, c, user, younger); message != "" {
+		t.Errorf("expected the younger instance to fit once the older is suspended, got %q", message)
+	}
+}
+
+func TestCheckQuota_CPU(t *testing.T) {
+	cpu := resource.MustParse("1500m")
+	user := quotaUser(helxv1.UserQuota{CPU: &cpu})
+	first, second, small := quotaInst("first", 100, "1"), quotaInst("second", 200, "1"), quotaInst("small", 300, "500m")
+	c := newFakeClient(newTestScheme(), quotaApp(""), user, first, second, small)
+
+	if message := checkQuota(t, c, user, second); !strings.Contains(message, "cpu 2 > 1500m") {
+		t.Errorf("expected the second instance to exceed the cpu quota, got %q", message)
+	}
+	// the held instance is not counted against younger ones
+	if message := checkQuota(t, c, user, small); message != "" {
+		t.Errorf("expected the small instance to fit, got %q", message)
+	}
+}
+
+func TestCheckQuota_SkipsFailedInstances(t *testing.T) {
+	maxInstances := int32(1)
+	user := quotaUser(helxv1.UserQuota{MaxInstances: &maxInstances})
+	bounded, broken, valid := quotaInst("bounded", 100, ""), quotaInst("broken", 200, ""), quotaInst("valid", 300, "")
+	meta.SetStatusCondition(&bounded.Status.Conditions, metav1.Condition{Type: helxv1.HelxInstConditionResourcesBounded, Status: metav1.ConditionFalse, Reason: "OutOfBounds"})
+	meta.SetStatusCondition(&broken.Status.Conditions, metav1.Condition{Type: helxv1.HelxInstConditionRendered, Status: metav1.ConditionFalse, Reason: "RenderFailed"})
+	c := newFakeClient(newTestScheme(), quotaApp(""), user, bounded, broken, valid)
+
+	if message := checkQuota(t, c, user, valid); message != "" {
+		t.Errorf("expected instances that run nothing not to count, got %q", message)
+	}
+
+	meta.SetStatusCondition(&broken.Status.Conditions, metav1.Condition{Type: helxv1.HelxInstConditionRendered, Status: metav1.ConditionTrue, Reason: "Rendered"})
+	if err := c.Update(context.Background(), broken); err != nil {
+		t.Fatal(err)
+	}
+	if message := checkQuota(t, c, user, valid); !strings.Contains(message, "instances 2 > 1") {
+		t.Errorf("expected a rendered sibling to count, got %q", message)
+	}
+}
+
+func TestCheckQuota_StorageCountsSharedClaimsOnce(t *testing.T) {
+	storage := resource.MustParse("1G")
+	user := quotaUser(helxv1.UserQuota{Storage: &storage})
+
+	shared := newFakeClient(newTestScheme(), quotaApp("{{ .system.UserName }}-home:/home"), user, quotaInst("a", 100, ""), quotaInst("b", 200, ""))
+	if message := checkQuota(t, shared, user, quotaInst("b", 200, "")); message != "" {
+		t.Errorf("expected a shared claim to be counted once, got %q", message)
+	}
+
+	perInst := newFakeClient(newTestScheme(), quotaApp("data-{{ .system.UUID }}:/data"), user, quotaInst("a", 100, ""), quotaInst("b", 200, ""))
+	if message := checkQuota(t, perInst, user, quotaInst("b", 200, "")); !strings.Contains(message, "storage 2G > 1G") {
+		t.Errorf("expected per-instance claims to add up, got %q", message)
+	}
+}
+
+func TestCreateDerivatives_QuotaExceededIsPending(t *testing.T) {
+	maxInstances := int32(1)
+	user := quotaUser(helxv1.UserQuota{MaxInstances: &maxInstances})
+	older, younger := quotaInst("older", 100, ""), quotaInst("younger", 200, "")
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, quotaApp(""), user, older, younger)
+	recorder := record.NewFakeRecorder(10)
+
+	if err := ops.CreateDerivatives(younger, c, scheme, recorder, instRequest(younger), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionTrue(younger.Status.Conditions, helxv1.HelxInstConditionQuotaExceeded) {
+		t.Error("expected QuotaExceeded=True")
+	}
+	if younger.Status.Phase != helxv1.HelxInstPhasePending {
+		t.Errorf("expected phase Pending, got %s", younger.Status.Phase)
+	}
+	if meta.FindStatusCondition(younger.Status.Conditions, helxv1.HelxInstConditionRendered) != nil {
+		t.Error("expected an over-quota instance not to be rendered")
+	}
+	if events := drainEvents(recorder); !hasEvent(events, "Warning QuotaExceeded") {
+		t.Errorf("expected a quota event, got %v", events)
+	}
+	deployments := &appsv1.DeploymentList{}
+	if err := c.List(context.Background(), deployments, client.InNamespace("ns")); err != nil {
+		t.Fatal(err)
+	}
+	if len(deployments.Items) != 0 {
+		t.Errorf("expected no deployments, got %d", len(deployments.Items))
+	}
+
+	if err := ops.CreateDerivatives(older, c, scheme, recorder, instRequest(older), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionFalse(older.Status.Conditions, helxv1.HelxInstConditionQuotaExceeded) || older.Status.Phase != helxv1.HelxInstPhaseDeploying {
+		t.Errorf("expected the older instance to be admitted, got phase %s", older.Status.Phase)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// Resource bounds
+// ---------------------------------------------------------------------------
+
+func boundsApp(policy helxv1.ResourcePolicy) *helxv1.HelxApp {
+	app := makeApp("ns", "myapp", "Nginx", []helxv1.Service{{
+		Name: "main", Image: "nginx", Command: []string{"nginx"},
+		ResourceBounds: map[string]helxv1.ResourceBoundary{
+			"cpu":    {Min: "100m", Max: "2"},
+			"memory": {Min: "128Mi", Max: "1Gi"},
+		},
+	}})
+	app.Spec.ResourcePolicy = policy
+	return app
+}
+
+func boundsInst(requests, limits map[string]string) *helxv1.HelxInst {
+	inst := makeInst("ns", "inst1", "myapp", "alice", "bounds-uuid")
+	inst.Spec.Resources = map[string]helxv1.Resources{"main": {Requests: requests, Limits: limits}}
+	return inst
+}
+
+func TestBoundResources_Reject(t *testing.T) {
+	inst := boundsInst(map[string]string{"cpu": "4", "memory": "256Mi"}, map[string]string{"memory": "64Mi"})
+
+	resources, adjustments, violations := BoundResources(inst, boundsApp(helxv1.ResourcePolicyReject))
+	if len(adjustments) != 0 {
+		t.Errorf("expected no adjustments, got %v", adjustments)
+	}
+	if len(violations) != 2 || violations[0] != "service main: cpu request 4 is above max 2" || violations[1] != "service main: memory limit 64Mi is below min 128Mi" {
+		t.Errorf("unexpected violations %v", violations)
+	}
+	if resources["main"].Requests["cpu"] != "4" {
+		t.Errorf("expected the request to be left alone, got %v", resources["main"])
+	}
+
+	// an unset policy rejects
+	if _, _, violations := BoundResources(inst, boundsApp("")); len(violations) != 2 {
+		t.Errorf("expected Reject by default, got %v", violations)
+	}
+}
+
+func TestBoundResources_Clamp(t *testing.T) {
+	inst := boundsInst(map[string]string{"cpu": "4", "memory": "256Mi"}, map[string]string{"memory": "64Mi"})
+
+	resources, adjustments, violations := BoundResources(inst, boundsApp(helxv1.ResourcePolicyClamp))
+	if len(violations) != 0 {
+		t.Errorf("expected no violations, got %v", violations)
+	}
+	if len(adjustments) != 2 {
+		t.Errorf("expected 2 adjustments, got %v", adjustments)
+	}
+	main := resources["main"]
+	if main.Requests["cpu"] != "2" || main.Requests["memory"] != "256Mi" || main.Limits["memory"] != "128Mi" {
+		t.Errorf("unexpected clamped resources %+v", main)
+	}
+	if _, found := main.Limits["cpu"]; found {
+		t.Error("expected Clamp not to add missing values")
+	}
+	if inst.Spec.Resources["main"].Requests["cpu"] != "4" {
+		t.Error("expected the instance spec to be left alone")
+	}
+}
+
+func TestBoundResources_Default(t *testing.T) {
+	inst := makeInst("ns", "inst1", "myapp", "alice", "bounds-uuid")
+
+	resources, adjustments, violations := BoundResources(inst, boundsApp(helxv1.ResourcePolicyDefault))
+	if len(violations) != 0 {
+		t.Errorf("expected no violations, got %v", violations)
+	}
+	if len(adjustments) != 4 {
+		t.Errorf("expected 4 adjustments, got %v", adjustments)
+	}
+	main := resources["main"]
+	if main.Requests["cpu"] != "100m" || main.Requests["memory"] != "128Mi" || main.Limits["cpu"] != "2" || main.Limits["memory"] != "1Gi" {
+		t.Errorf("unexpected defaulted resources %+v", main)
+	}
+
+	inst = boundsInst(map[string]string{"cpu": "4"}, nil)
+	if _, _, violations := BoundResources(inst, boundsApp(helxv1.ResourcePolicyDefault)); len(violations) != 1 {
+		t.Errorf("expected an out-of-bounds value to be rejected, got %v", violations)
+	}
+}
+
+func TestCreateDerivatives_ResourcesOutOfBounds(t *testing.T) {
+	inst := boundsInst(map[string]string{"cpu": "4"}, nil)
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, boundsApp(helxv1.ResourcePolicyReject), makeUser("ns", "alice", nil), inst)
+	recorder := record.NewFakeRecorder(10)
+
+	if err := ops.CreateDerivatives(inst, c, scheme, recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !meta.IsStatusConditionFalse(inst.Status.Conditions, helxv1.HelxInstConditionResourcesBounded) {
+		t.Error("expected ResourcesBounded=False")
+	}
+	if inst.Status.Phase != helxv1.HelxInstPhaseFailed {
+		t.Errorf("expected phase Failed, got %s", inst.Status.Phase)
+	}
+	if events := drainEvents(recorder); !hasEvent(events, "Warning OutOfBounds") {
+		t.Errorf("expected an OutOfBounds event, got %v", events)
+	}
+	deployments := &appsv1.DeploymentList{}
+	if err := c.List(context.Background(), deployments, client.InNamespace("ns")); err != nil {
+		t.Fatal(err)
+	}
+	if len(deployments.Items) != 0 {
+		t.Errorf("expected no deployments, got %d", len(deployments.Items))
+	}
+}
+
+func TestCreateDerivatives_ResourcesClamped(t *testing.T) {
+	inst := boundsInst(map[string]string{"cpu": "4"}, nil)
+	scheme := newTestScheme()
+	c := newFakeClient(scheme, boundsApp(helxv1.ResourcePolicyClamp), makeUser("ns", "alice", nil), inst)
+	recorder := record.NewFakeRecorder(10)
+
+	if err := ops.CreateDerivatives(inst, c, scheme, recorder, instRequest(inst), context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	condition := meta.FindStatusCondition(inst.Status.Conditions, helxv1.HelxInstConditionResourcesBounded)
+	if condition == nil || condition.Status != metav1.ConditionTrue || condition.Reason != "Clamped" {
+		t.Fatalf("expected ResourcesBounded=True with reason Clamped, got %+v", condition)
+	}
+	if inst.Status.Resources["main"].Requests["cpu"] != "2" {
+		t.Errorf("expected the clamped request on the status, got %v", inst.Status.Resources)
+	}
+	container := getDeployment(t, c, "bounds-uuid").Spec.Template.Spec.Containers[0]
+	if cpu := container.Resources.Requests[corev1.ResourceCPU]; cpu.String() != "2" {
+		t.Errorf("expected the clamped request to be rendered, got %s", cpu.String())
+	}
+}
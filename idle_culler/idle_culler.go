@@ -0,0 +1,210 @@
+package idle_culler
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	helxv1 "github.com/helxplatform/helxapp-controller/api/v1"
+	"github.com/helxplatform/helxapp-controller/connect"
+	"github.com/helxplatform/helxapp-controller/helxapp_operations"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Action is what happens to an instance that has been idle too long.
+type Action string
+
+const (
+	ActionSuspend Action = "suspend"
+	ActionDelete  Action = "delete"
+)
+
+// Policy is the idle limit for one app class.
+type Policy struct {
+	IdleTimeout time.Duration
+	Action      Action
+}
+
+// ParsePolicies reads the --idle-policy flag: comma-separated
+// class=timeout[:action] entries, e.g. "Jupyter=2h:suspend,RStudio=4h:delete".
+// The action defaults to suspend.
+func ParsePolicies(value string) (map[string]Policy, error) {
+	policies := make(map[string]Policy)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		class, rest, found := strings.Cut(entry, "=")
+		if !found || class == "" {
+			return nil, fmt.Errorf("idle policy %q: expected class=timeout[:action]", entry)
+		}
+		timeout, action, _ := strings.Cut(rest, ":")
+		policy := Policy{Action: ActionSuspend}
+		var err error
+		if policy.IdleTimeout, err = time.ParseDuration(timeout); err != nil || policy.IdleTimeout <= 0 {
+			return nil, fmt.Errorf("idle policy %q: invalid timeout %q", entry, timeout)
+		}
+		switch Action(action) {
+		case "", ActionSuspend:
+		case ActionDelete:
+			policy.Action = ActionDelete
+		default:
+			return nil, fmt.Errorf("idle policy %q: unknown action %q", entry, action)
+		}
+		policies[class] = policy
+	}
+	return policies, nil
+}
+
+// Culler periodically asks running instances for their last activity through
+// their generated Services and suspends or deletes those idle longer than the
+// policy for their app class. It runs as a manager Runnable on the leader.
+type Culler struct {
+	Client   client.Client
+	Recorder record.EventRecorder
+	Log      logr.Logger
+	// Interval between passes over the instances
+	Interval time.Duration
+	// Timeout bounds each activity request
+	Timeout time.Duration
+	// Policies is keyed by HelxApp spec.appClassName
+	Policies map[string]Policy
+	// FetchActivity returns the last activity reported at url; nil uses
+	// FetchActivity from this package
+	FetchActivity func(ctx context.Context, url string) (time.Time, error)
+}
+
+// Start runs a pass every Interval until ctx is done.
+func (c *Culler) Start(ctx context.Context) error {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := c.CullOnce(ctx, time.Now()); err != nil {
+				c.Log.Error(err, "idle culling pass failed")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection keeps a single replica culling.
+func (c *Culler) NeedLeaderElection() bool {
+	return true
+}
+
+// FetchActivity reads the last_activity timestamp from a JSON activity
+// endpoint such as Jupyter's /api/status.
+func FetchActivity(ctx context.Context, url string) (time.Time, error) {
+	data, err := connect.FetchDataContext(ctx, url)
+	if err != nil {
+		return time.Time{}, err
+	}
+	value, ok := data["last_activity"].(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("no last_activity in response from %s", url)
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// CullOnce checks every running instance whose app class has a policy.
+// Instances whose activity cannot be read are left alone.
+func (c *Culler) CullOnce(ctx context.Context, now time.Time) error {
+	insts := &helxv1.HelxInstList{}
+	if err := c.Client.List(ctx, insts); err != nil {
+		return fmt.Errorf("failed to get helxinst list: %v", err)
+	}
+	for i := range insts.Items {
+		inst := &insts.Items[i]
+		if inst.DeletionTimestamp != nil || inst.Spec.Suspended || inst.Status.Phase != helxv1.HelxInstPhaseRunning {
+			continue
+		}
+		app, err := helxapp_operations.GetApp(ctx, c.Client, helxapp_operations.GetAppNameFromInst(inst))
+		if err != nil || app == nil {
+			continue
+		}
+		policy, found := c.Policies[app.Spec.AppClassName]
+		if !found {
+			continue
+		}
+		lastActivity, found := c.lastActivity(ctx, inst, app)
+		if !found {
+			continue
+		}
+		if err := c.cull(ctx, inst, policy, lastActivity, now); err != nil {
+			c.Log.Error(err, "unable to cull idle instance", "NamespacedName", helxapp_operations.GetNamespacedName(inst))
+		}
+	}
+	return nil
+}
+
+// lastActivity queries each activity probe of the app through the instance
+// endpoints and returns the latest reported time.
+func (c *Culler) lastActivity(ctx context.Context, inst *helxv1.HelxInst, app *helxv1.HelxApp) (time.Time, bool) {
+	fetch := c.FetchActivity
+	if fetch == nil {
+		fetch = FetchActivity
+	}
+	var latest time.Time
+	found := false
+	for _, service := range app.Spec.Services {
+		if service.Activity == nil {
+			continue
+		}
+		port := helxapp_operations.ActivityPort(service)
+		for _, endpoint := range inst.Status.Endpoints {
+			// endpoints recorded before Services were per container have none
+			if endpoint.Port != port || (endpoint.Container != "" && endpoint.Container != service.Name) {
+				continue
+			}
+			url := fmt.Sprintf("http://%s:%d%s", endpoint.Host, endpoint.Port, service.Activity.Path)
+			probeCtx, cancel := context.WithTimeout(ctx, c.Timeout)
+			activity, err := fetch(probeCtx, url)
+			cancel()
+			if err != nil {
+				c.Log.V(1).Info("activity probe failed", "NamespacedName", helxapp_operations.GetNamespacedName(inst), "url", url, "error", err.Error())
+				continue
+			}
+			if !found || activity.After(latest) {
+				latest, found = activity, true
+			}
+		}
+	}
+	return latest, found
+}
+
+// cull records the last activity on the instance status and applies the
+// policy once the instance has been idle longer than its timeout.
+func (c *Culler) cull(ctx context.Context, inst *helxv1.HelxInst, policy Policy, lastActivity time.Time, now time.Time) error {
+	if inst.Status.LastActivity == nil || !inst.Status.LastActivity.Time.Equal(lastActivity) {
+		original := inst.DeepCopy()
+		inst.Status.LastActivity = &metav1.Time{Time: lastActivity}
+		if err := c.Client.Status().Patch(ctx, inst, client.MergeFrom(original)); err != nil {
+			return err
+		}
+	}
+
+	idle := now.Sub(lastActivity)
+	if idle < policy.IdleTimeout {
+		return nil
+	}
+	idle = idle.Round(time.Second)
+	switch policy.Action {
+	case ActionDelete:
+		c.Recorder.Eventf(inst, corev1.EventTypeNormal, "IdleDeleted", "idle for %s, longer than %s; deleting", idle, policy.IdleTimeout)
+		return client.IgnoreNotFound(c.Client.Delete(ctx, inst))
+	default:
+		c.Recorder.Eventf(inst, corev1.EventTypeNormal, "IdleSuspended", "idle for %s, longer than %s; suspending", idle, policy.IdleTimeout)
+		original := inst.DeepCopy()
+		inst.Spec.Suspended = true
+		return c.Client.Patch(ctx, inst, client.MergeFrom(original))
+	}
+}
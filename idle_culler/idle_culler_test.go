@@ -0,0 +1,219 @@
+package idle_culler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	helxv1 "github.com/helxplatform/helxapp-controller/api/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var now = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+func makeApp(class string) *helxv1.HelxApp {
+	return &helxv1.HelxApp{
+		ObjectMeta: metav1.ObjectMeta{Name: "notebook", Namespace: "ns"},
+		Spec: helxv1.HelxAppSpec{
+			AppClassName: class,
+			Services: []helxv1.Service{{
+				Name:     "jupyter",
+				Image:    "jupyter/base-notebook",
+				Ports:    []helxv1.PortMap{{ContainerPort: 8888, Port: 8888}},
+				Activity: &helxv1.ActivityProbe{Path: "/api/status"},
+			}},
+		},
+	}
+}
+
+func makeInst(name string) *helxv1.HelxInst {
+	return &helxv1.HelxInst{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ns"},
+		Spec:       helxv1.HelxInstSpec{AppName: "notebook", UserName: "alice"},
+		Status: helxv1.HelxInstStatus{
+			UUID:      name + "-uuid",
+			Phase:     helxv1.HelxInstPhaseRunning,
+			Endpoints: []helxv1.HelxInstEndpoint{{Service: name, Host: name + ".ns.svc", Port: 8888}},
+		},
+	}
+}
+
+func newCuller(policies map[string]Policy, activity map[string]time.Time, objs ...client.Object) (*Culler, client.Client, *record.FakeRecorder) {
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = helxv1.AddToScheme(scheme)
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()
+	recorder := record.NewFakeRecorder(10)
+	return &Culler{
+		Client:   c,
+		Recorder: recorder,
+		Log:      logr.Discard(),
+		Timeout:  time.Second,
+		Policies: policies,
+		FetchActivity: func(ctx context.Context, url string) (time.Time, error) {
+			if t, found := activity[url]; found {
+				return t, nil
+			}
+			return time.Time{}, errors.New("unreachable")
+		},
+	}, c, recorder
+}
+
+func getInst(t *testing.T, c client.Client, name string) *helxv1.HelxInst {
+	t.Helper()
+	inst := &helxv1.HelxInst{}
+	if err := c.Get(context.Background(), types.NamespacedName{Namespace: "ns", Name: name}, inst); err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+func TestParsePolicies(t *testing.T) {
+	policies, err := ParsePolicies("Jupyter=2h, RStudio=30m:delete,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := policies["Jupyter"]; p.IdleTimeout != 2*time.Hour || p.Action != ActionSuspend {
+		t.Errorf("unexpected Jupyter policy %+v", p)
+	}
+	if p := policies["RStudio"]; p.IdleTimeout != 30*time.Minute || p.Action != ActionDelete {
+		t.Errorf("unexpected RStudio policy %+v", p)
+	}
+	if policies, err := ParsePolicies(""); err != nil || len(policies) != 0 {
+		t.Errorf("expected no policies, got %v %v", policies, err)
+	}
+	for _, bad := range []string{"Jupyter", "Jupyter=soon", "Jupyter=1h:archive", "=1h"} {
+		if _, err := ParsePolicies(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+}
+
+func TestFetchActivity(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/status" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"connections": 0, "kernels": 1, "last_activity": "2024-01-01T10:30:00.123456Z"}`))
+	}))
+	defer server.Close()
+
+	activity, err := FetchActivity(context.Background(), server.URL+"/api/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !activity.Equal(time.Date(2024, 1, 1, 10, 30, 0, 123456000, time.UTC)) {
+		t.Errorf("unexpected activity %v", activity)
+	}
+	if _, err := FetchActivity(context.Background(), server.URL+"/missing"); err == nil {
+		t.Error("expected an error without last_activity")
+	}
+}
+
+func TestCullOnce_RecordsActivity(t *testing.T) {
+	policies := map[string]Policy{"Jupyter": {IdleTimeout: 2 * time.Hour, Action: ActionSuspend}}
+	activity := map[string]time.Time{"http://busy.ns.svc:8888/api/status": now.Add(-time.Minute)}
+	culler, c, recorder := newCuller(policies, activity, makeApp("Jupyter"), makeInst("busy"))
+
+	if err := culler.CullOnce(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	inst := getInst(t, c, "busy")
+	if inst.Status.LastActivity == nil || !inst.Status.LastActivity.Time.Equal(now.Add(-time.Minute)) {
+		t.Errorf("expected lastActivity to be recorded, got %v", inst.Status.LastActivity)
+	}
+	if inst.Spec.Suspended {
+		t.Error("expected an active instance to keep running")
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no events, got %d", len(recorder.Events))
+	}
+}
+
+func TestCullOnce_MatchesEndpointContainer(t *testing.T) {
+	policies := map[string]Policy{"Jupyter": {IdleTimeout: 2 * time.Hour, Action: ActionSuspend}}
+	activity := map[string]time.Time{
+		"http://jupyter-busy-uuid.ns.svc:8888/api/status": now.Add(-time.Minute),
+		"http://sidecar-busy-uuid.ns.svc:8888/api/status": now.Add(-time.Second),
+	}
+	inst := makeInst("busy")
+	inst.Status.Endpoints = []helxv1.HelxInstEndpoint{
+		{Service: "jupyter-busy-uuid", Container: "jupyter", Host: "jupyter-busy-uuid.ns.svc", Port: 8888},
+		{Service: "sidecar-busy-uuid", Container: "sidecar", Host: "sidecar-busy-uuid.ns.svc", Port: 8888},
+	}
+	culler, c, _ := newCuller(policies, activity, makeApp("Jupyter"), inst)
+
+	if err := culler.CullOnce(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	if last := getInst(t, c, "busy").Status.LastActivity; last == nil || !last.Time.Equal(now.Add(-time.Minute)) {
+		t.Errorf("expected only the jupyter endpoint to be probed, got %v", last)
+	}
+}
+
+func TestCullOnce_Suspends(t *testing.T) {
+	policies := map[string]Policy{"Jupyter": {IdleTimeout: 2 * time.Hour, Action: ActionSuspend}}
+	activity := map[string]time.Time{"http://idle.ns.svc:8888/api/status": now.Add(-3 * time.Hour)}
+	culler, c, recorder := newCuller(policies, activity, makeApp("Jupyter"), makeInst("idle"))
+
+	if err := culler.CullOnce(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	if inst := getInst(t, c, "idle"); !inst.Spec.Suspended {
+		t.Error("expected the idle instance to be suspended")
+	}
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Normal IdleSuspended") {
+		t.Errorf("expected an IdleSuspended event, got %q", event)
+	}
+}
+
+func TestCullOnce_Deletes(t *testing.T) {
+	policies := map[string]Policy{"Jupyter": {IdleTimeout: 2 * time.Hour, Action: ActionDelete}}
+	activity := map[string]time.Time{"http://idle.ns.svc:8888/api/status": now.Add(-3 * time.Hour)}
+	culler, c, _ := newCuller(policies, activity, makeApp("Jupyter"), makeInst("idle"))
+
+	if err := culler.CullOnce(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	err := c.Get(context.Background(), types.NamespacedName{Namespace: "ns", Name: "idle"}, &helxv1.HelxInst{})
+	if !apierrors.IsNotFound(err) {
+		t.Errorf("expected the idle instance to be deleted, got %v", err)
+	}
+}
+
+func TestCullOnce_SkipsWithoutPolicyOrActivity(t *testing.T) {
+	policies := map[string]Policy{"Jupyter": {IdleTimeout: time.Hour, Action: ActionDelete}}
+	unreachable := makeInst("unreachable")
+	suspended := makeInst("suspended")
+	suspended.Spec.Suspended = true
+	culler, c, _ := newCuller(policies, map[string]time.Time{
+		"http://suspended.ns.svc:8888/api/status": now.Add(-3 * time.Hour),
+	}, makeApp("Jupyter"), unreachable, suspended)
+
+	if err := culler.CullOnce(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	getInst(t, c, "unreachable")
+	getInst(t, c, "suspended")
+
+	other, c, _ := newCuller(map[string]Policy{"RStudio": {IdleTimeout: time.Hour, Action: ActionDelete}}, map[string]time.Time{
+		"http://idle.ns.svc:8888/api/status": now.Add(-3 * time.Hour),
+	}, makeApp("Jupyter"), makeInst("idle"))
+	if err := other.CullOnce(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+	getInst(t, c, "idle")
+}
@@ -17,25 +17,32 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	"go.uber.org/zap/zapcore"
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	helxv1 "github.com/helxplatform/helxapp-controller/api/v1"
 	"github.com/helxplatform/helxapp-controller/controllers"
 	"github.com/helxplatform/helxapp-controller/helxapp_operations"
+	"github.com/helxplatform/helxapp-controller/idle_culler"
 	"github.com/helxplatform/helxapp-controller/template_io"
+	"github.com/helxplatform/helxapp-controller/webhooks"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -67,12 +74,28 @@ func main() {
 	var enableLeaderElection bool
 	var probeAddr string
 	var watchNamespace string
+	var maxConcurrentReconciles int
+	var expiryWarning time.Duration
+	var idlePolicy string
+	var idleCheckInterval time.Duration
+	var idleProbeTimeout time.Duration
+	var enableWebhooks bool
+	var allowedServiceTypes string
+	var ingressConfig string
 
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.IntVar(&maxConcurrentReconciles, "max-concurrent-reconciles", 1, "The number of objects of each kind that may be reconciled in parallel.")
+	flag.DurationVar(&expiryWarning, "expiry-warning", time.Hour, "How long before a HelxInst's ttl/expiresAt deadline to post the Expiring condition and a warning event.")
+	flag.StringVar(&idlePolicy, "idle-policy", "", "Idle culling per app class as class=timeout[:suspend|delete],... e.g. Jupyter=2h:suspend. Empty disables culling.")
+	flag.DurationVar(&idleCheckInterval, "idle-check-interval", 5*time.Minute, "How often running instances are probed for activity.")
+	flag.DurationVar(&idleProbeTimeout, "idle-probe-timeout", 10*time.Second, "Timeout for a single activity probe request.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", false, "Serve the HelxApp and HelxInst admission webhooks on port 9443. Requires a serving certificate in /tmp/k8s-webhook-server/serving-certs.")
+	flag.StringVar(&ingressConfig, "ingress-config", "", "YAML file of the Ingress or HTTPRoute to render for each exposed port, per app class. Empty renders none.")
+	flag.StringVar(&allowedServiceTypes, "allowed-service-types", "ClusterIP,Headless", "Service types HelxApp services may use, from ClusterIP, Headless, NodePort and LoadBalancer.")
 	flag.StringVar(&watchNamespace, "namespace", "", "Limit watches to a specific namespace. If empty, watches all namespaces (requires cluster-scoped RBAC).")
 	opts := zap.Options{
 		Development: true,
@@ -90,10 +113,22 @@ func main() {
 		watchNamespace = ns
 	}
 
-	if err := helxapp_operations.Initalize(mainLog); err != nil {
+	operations, err := helxapp_operations.NewOperations(mainLog, "templates")
+	if err != nil {
 		setupLog.Error(err, "Cannot initialize operations")
 		os.Exit(1)
 	}
+	if operations.AllowedServiceTypes, err = helxapp_operations.ParseServiceTypes(allowedServiceTypes); err != nil {
+		setupLog.Error(err, "invalid --allowed-service-types")
+		os.Exit(1)
+	}
+
+	if ingressConfig != "" {
+		if operations.RouteClasses, err = helxapp_operations.LoadRouteClasses(ingressConfig); err != nil {
+			setupLog.Error(err, "invalid --ingress-config")
+			os.Exit(1)
+		}
+	}
 
 	if watchNamespace != "" {
 		setupLog.Info("watching namespace", "namespace", watchNamespace)
@@ -101,6 +136,12 @@ func main() {
 		setupLog.Info("watching all namespaces (cluster-scoped)")
 	}
 
+	podSelector, err := labels.Parse(helxapp_operations.IDLabel)
+	if err != nil {
+		setupLog.Error(err, "invalid pod selector")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     metricsAddr,
@@ -109,6 +150,10 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "e1d4fbc7.renci.org",
+		// Only instance pods are watched, so only they are cached
+		NewCache: cache.BuilderWithOptions(cache.Options{
+			SelectorsByObject: cache.SelectorsByObject{&corev1.Pod{}: {Label: podSelector}},
+		}),
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -126,29 +171,73 @@ func main() {
 		os.Exit(1)
 	}
 
+	if err = helxapp_operations.SetupIndexes(context.Background(), mgr.GetFieldIndexer()); err != nil {
+		setupLog.Error(err, "unable to set up field indexes")
+		os.Exit(1)
+	}
+
 	if err = (&controllers.HelxAppReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		Recorder:                mgr.GetEventRecorderFor("helxapp-controller"),
+		Operations:              operations,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "HelxApp")
 		os.Exit(1)
 	}
 	if err = (&controllers.HelxInstReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		Recorder:                mgr.GetEventRecorderFor("helxapp-controller"),
+		Operations:              operations,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
+		ExpiryWarning:           expiryWarning,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "HelxInstance")
 		os.Exit(1)
 	}
 	if err = (&controllers.HelxUserReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:                  mgr.GetClient(),
+		Scheme:                  mgr.GetScheme(),
+		Recorder:                mgr.GetEventRecorderFor("helxapp-controller"),
+		Operations:              operations,
+		MaxConcurrentReconciles: maxConcurrentReconciles,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "HelxUser")
 		os.Exit(1)
 	}
+	if enableWebhooks {
+		if err = (&webhooks.HelxAppValidator{AllowedServiceTypes: operations.AllowedServiceTypes}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "HelxApp")
+			os.Exit(1)
+		}
+		if err = (&webhooks.HelxInstDefaulter{Client: mgr.GetClient()}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "HelxInst")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
+	idlePolicies, err := idle_culler.ParsePolicies(idlePolicy)
+	if err != nil {
+		setupLog.Error(err, "invalid --idle-policy")
+		os.Exit(1)
+	}
+	if len(idlePolicies) != 0 {
+		if err = mgr.Add(&idle_culler.Culler{
+			Client:   mgr.GetClient(),
+			Recorder: mgr.GetEventRecorderFor("helxapp-controller"),
+			Log:      ctrl.Log.WithName("idle-culler"),
+			Interval: idleCheckInterval,
+			Timeout:  idleProbeTimeout,
+			Policies: idlePolicies,
+		}); err != nil {
+			setupLog.Error(err, "unable to add idle culler")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -15,6 +15,8 @@ import (
 	"github.com/helxplatform/helxapp-controller/connect"
 	"github.com/jackc/pgx/v4"
 	"github.com/kr/pretty"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
 )
 
 type System struct {
@@ -24,12 +26,22 @@ type System struct {
 	Environment     map[string]string
 	UUID            string
 	Host            string
+	Path            string
 	SecurityContext *SecurityContext
 	Containers      []Container
 	InitContainers  []Container
 	Volumes         map[string]Volume
 	UserInfo        map[string]interface{}
 	UserName        string
+	Suspended       bool
+	// RestartedAt is stamped on the pod template so that changing it rolls the pods
+	RestartedAt string
+	// Scheduling of the pod, the app's merged with the instance's
+	NodeSelector              map[string]string
+	Tolerations               []corev1.Toleration
+	Affinity                  *corev1.Affinity
+	TopologySpreadConstraints []corev1.TopologySpreadConstraint
+	PriorityClassName         string
 }
 
 type SecurityContext struct {
@@ -49,19 +61,77 @@ type Container struct {
 	Image           Image
 	Command         []string
 	Environment     map[string]string
+	ValueFrom       []EnvVar
+	EnvFrom         []EnvFrom
 	HasService      bool
+	ServiceType     string
 	Ports           []PortMap
 	Resources       Resources
 	VolumeMounts    []*VolumeMount
 	SecurityContext *SecurityContext
 	LivenessProbe   *Probe
 	ReadinessProbe  *Probe
+	StartupProbe    *Probe
+}
+
+// EnvVar is an environment variable read from a Secret, ConfigMap or pod
+// field; exactly one source is set.
+type EnvVar struct {
+	Name            string
+	SecretKeyRef    *KeyRef
+	ConfigMapKeyRef *KeyRef
+	FieldPath       string
+}
+
+type KeyRef struct {
+	Name     string
+	Key      string
+	Optional bool
+}
+
+// EnvFrom adds every key of a Secret or ConfigMap; exactly one is set.
+type EnvFrom struct {
+	Prefix       string
+	SecretRef    *EnvRef
+	ConfigMapRef *EnvRef
+}
+
+type EnvRef struct {
+	Name     string
+	Optional bool
 }
 
 type PortMap struct {
+	Name          string
 	ContainerPort int
 	Port          int
 	Protocol      string
+	AppProtocol   string
+}
+
+// Route exposes one Service port through an Ingress or a Gateway API
+// HTTPRoute.
+type Route struct {
+	Name             string
+	Kind             string
+	Container        string
+	ServiceName      string
+	PortName         string
+	Port             int
+	Host             string
+	Path             string
+	IngressClassName string
+	Annotations      map[string]string
+	TLSSecretName    string
+	Gateway          *GatewayRef
+}
+
+// GatewayRef is the Gateway, and optionally the listener, an HTTPRoute
+// attaches to.
+type GatewayRef struct {
+	Name        string
+	Namespace   string
+	SectionName string
 }
 
 type Resources struct {
@@ -82,6 +152,7 @@ type Probe struct {
 	TCPSocket           *TCPSocketAction
 	InitialDelaySeconds int32
 	PeriodSeconds       int32
+	TimeoutSeconds      int32
 	FailureThreshold    int32
 }
 
@@ -210,6 +281,15 @@ func ParseTemplates(dir string, logFunc func(string)) (*template.Template, map[s
 		return RenderTemplateToString(tmpl, name, data)
 	}
 
+	// a marshal error fails the render rather than dropping the field
+	funcMap["toYaml"] = func(value interface{}) (string, error) {
+		out, err := yaml.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSuffix(string(out), "\n"), nil
+	}
+
 	funcMap["store"] = func(name, value string) string {
 		return store(storage, name, value)
 	}
@@ -9,6 +9,10 @@ import (
 	"text/template"
 
 	helxv1 "github.com/helxplatform/helxapp-controller/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/util/yaml"
 )
 
 var testTemplate *template.Template
@@ -331,7 +335,7 @@ func TestRenderPVCTemplate(t *testing.T) {
 	}
 }
 
-// 62. TestRenderServiceTemplate - Render service template with HasService=true
+// 62. TestRenderServiceTemplate - Render service template with HasService=true, named for its container
 func TestRenderServiceTemplate(t *testing.T) {
 	ensureTemplates(t)
 
@@ -341,9 +345,11 @@ func TestRenderServiceTemplate(t *testing.T) {
 		UUID:         "test-uuid-svc",
 	}
 	container := Container{
+		Name:       "web",
 		HasService: true,
 		Ports: []PortMap{
-			{ContainerPort: 8080, Port: 80, Protocol: "TCP"},
+			{Name: "http", ContainerPort: 8080, Port: 80, Protocol: "TCP"},
+			{Name: "metrics", ContainerPort: 9090, Protocol: "TCP"},
 		},
 	}
 	vars := map[string]interface{}{
@@ -357,9 +363,15 @@ func TestRenderServiceTemplate(t *testing.T) {
 	if !strings.Contains(result, "port: 80") {
 		t.Errorf("expected output to contain port mapping, got:\n%s", result)
 	}
-	if !strings.Contains(result, "targetPort: 8080") {
+	if !strings.Contains(result, "targetPort: http") {
 		t.Errorf("expected output to contain targetPort mapping, got:\n%s", result)
 	}
+	if !strings.Contains(result, "name: web-test-uuid-svc") {
+		t.Errorf("expected the Service to be named after the container, got:\n%s", result)
+	}
+	if strings.Contains(result, "metrics") {
+		t.Errorf("expected a port without a service port to be left out, got:\n%s", result)
+	}
 }
 
 // 63. TestRenderServiceTemplate_NoService - Render service template with HasService=false
@@ -469,6 +481,362 @@ func TestRenderDeployment_Labels(t *testing.T) {
 	}
 }
 
+// 66. TestRenderDeployment_Suspended - Suspended renders zero replicas, otherwise one
+func TestRenderDeployment_Suspended(t *testing.T) {
+	ensureTemplates(t)
+
+	for _, tc := range []struct {
+		suspended bool
+		replicas  string
+	}{{false, "replicas: 1"}, {true, "replicas: 0"}} {
+		system := System{
+			AppName:      "suspend-app",
+			InstanceName: "suspend-instance",
+			UUID:         "test-uuid-suspend",
+			Containers:   []Container{},
+			Volumes:      map[string]Volume{},
+			Suspended:    tc.suspended,
+		}
+		result, err := RenderGoTemplate(testTemplate, "deployment", map[string]interface{}{"system": system})
+		if err != nil {
+			t.Fatalf("RenderGoTemplate error: %v", err)
+		}
+		if !strings.Contains(result, tc.replicas) {
+			t.Errorf("suspended=%v: expected %q, got:\n%s", tc.suspended, tc.replicas, result)
+		}
+	}
+}
+
+// 67. TestRenderDeployment_RestartedAt - RestartedAt becomes a pod template annotation
+func TestRenderDeployment_RestartedAt(t *testing.T) {
+	ensureTemplates(t)
+
+	for _, restartedAt := range []string{"", "2024-03-01T09:00:00Z"} {
+		system := System{
+			AppName:      "restart-app",
+			InstanceName: "restart-instance",
+			UUID:         "test-uuid-restart",
+			Containers:   []Container{},
+			Volumes:      map[string]Volume{},
+			RestartedAt:  restartedAt,
+		}
+		result, err := RenderGoTemplate(testTemplate, "deployment", map[string]interface{}{"system": system})
+		if err != nil {
+			t.Fatalf("RenderGoTemplate error: %v", err)
+		}
+		if found := strings.Contains(result, `"helx.renci.org/restartedAt": "2024-03-01T09:00:00Z"`); found != (restartedAt != "") {
+			t.Errorf("restartedAt=%q: unexpected annotation presence %v in:\n%s", restartedAt, found, result)
+		}
+	}
+}
+
+// 68. TestRenderDeployment_Probes - Exec, HTTP and TCP probes render as valid container probes
+func TestRenderDeployment_Probes(t *testing.T) {
+	ensureTemplates(t)
+
+	system := System{
+		AppName:      "probe-app",
+		InstanceName: "probe-instance",
+		UUID:         "test-uuid-probes",
+		Containers: []Container{{
+			Name:  "rstudio",
+			Image: Image{ImageName: "rocker/rstudio", Attr: map[string]string{}},
+			Ports: []PortMap{{ContainerPort: 8787, Protocol: "TCP"}},
+			LivenessProbe: &Probe{
+				TCPSocket:     &TCPSocketAction{Port: 8787},
+				PeriodSeconds: 20,
+			},
+			ReadinessProbe: &Probe{
+				HTTPGet: &HTTPGetAction{
+					Path:        "/auth-sign-in",
+					Port:        8787,
+					Scheme:      "HTTP",
+					HttpHeaders: map[string]string{"X-Probe": "ready"},
+				},
+				TimeoutSeconds: 5,
+			},
+			StartupProbe: &Probe{
+				Exec:                &ExecAction{Command: []string{"sh", "-c", "test -f /tmp/started"}},
+				InitialDelaySeconds: 10,
+				FailureThreshold:    30,
+			},
+		}},
+		Volumes: map[string]Volume{},
+	}
+	result, err := RenderGoTemplate(testTemplate, "deployment", map[string]interface{}{"system": system})
+	if err != nil {
+		t.Fatalf("RenderGoTemplate error: %v", err)
+	}
+	deployment := &appsv1.Deployment{}
+	if err := yaml.UnmarshalStrict([]byte(result), deployment); err != nil {
+		t.Fatalf("unable to parse deployment: %v\n%s", err, result)
+	}
+	container := deployment.Spec.Template.Spec.Containers[0]
+	if probe := container.LivenessProbe; probe == nil || probe.TCPSocket == nil || probe.TCPSocket.Port.IntValue() != 8787 || probe.PeriodSeconds != 20 {
+		t.Errorf("unexpected liveness probe %+v", probe)
+	}
+	if probe := container.ReadinessProbe; probe == nil || probe.HTTPGet == nil || probe.HTTPGet.Path != "/auth-sign-in" || probe.TimeoutSeconds != 5 ||
+		len(probe.HTTPGet.HTTPHeaders) != 1 || probe.HTTPGet.HTTPHeaders[0].Value != "ready" {
+		t.Errorf("unexpected readiness probe %+v", probe)
+	}
+	if probe := container.StartupProbe; probe == nil || probe.Exec == nil || len(probe.Exec.Command) != 3 || probe.Exec.Command[2] != "test -f /tmp/started" ||
+		probe.InitialDelaySeconds != 10 || probe.FailureThreshold != 30 {
+		t.Errorf("unexpected startup probe %+v", probe)
+	}
+}
+
+// 69. TestRenderDeployment_EnvSources - valueFrom and envFrom entries render as valid container env
+func TestRenderDeployment_EnvSources(t *testing.T) {
+	ensureTemplates(t)
+
+	system := System{
+		AppName:      "env-app",
+		InstanceName: "env-instance",
+		UUID:         "test-uuid-env",
+		Containers: []Container{{
+			Name:        "jupyter",
+			Image:       Image{ImageName: "jupyter/base-notebook", Attr: map[string]string{}},
+			Environment: map[string]string{"MODE": "lab"},
+			ValueFrom: []EnvVar{
+				{Name: "TOKEN", SecretKeyRef: &KeyRef{Name: "alice-token", Key: "token"}},
+				{Name: "THEME", ConfigMapKeyRef: &KeyRef{Name: "settings", Key: "theme", Optional: true}},
+				{Name: "POD_IP", FieldPath: "status.podIP"},
+			},
+			EnvFrom: []EnvFrom{
+				{SecretRef: &EnvRef{Name: "alice-creds"}},
+				{Prefix: "CFG_", ConfigMapRef: &EnvRef{Name: "defaults", Optional: true}},
+			},
+		}},
+		Volumes: map[string]Volume{},
+	}
+	result, err := RenderGoTemplate(testTemplate, "deployment", map[string]interface{}{"system": system})
+	if err != nil {
+		t.Fatalf("RenderGoTemplate error: %v", err)
+	}
+	deployment := &appsv1.Deployment{}
+	if err := yaml.UnmarshalStrict([]byte(result), deployment); err != nil {
+		t.Fatalf("unable to parse deployment: %v\n%s", err, result)
+	}
+	container := deployment.Spec.Template.Spec.Containers[0]
+	env := map[string]corev1.EnvVar{}
+	for _, entry := range container.Env {
+		env[entry.Name] = entry
+	}
+	if env["MODE"].Value != "lab" {
+		t.Errorf("expected the plain variable to render, got %+v", container.Env)
+	}
+	if ref := env["TOKEN"].ValueFrom; ref == nil || ref.SecretKeyRef == nil || ref.SecretKeyRef.Name != "alice-token" || ref.SecretKeyRef.Key != "token" || ref.SecretKeyRef.Optional != nil {
+		t.Errorf("unexpected TOKEN source %+v", ref)
+	}
+	if ref := env["THEME"].ValueFrom; ref == nil || ref.ConfigMapKeyRef == nil || ref.ConfigMapKeyRef.Name != "settings" || ref.ConfigMapKeyRef.Optional == nil || !*ref.ConfigMapKeyRef.Optional {
+		t.Errorf("unexpected THEME source %+v", ref)
+	}
+	if ref := env["POD_IP"].ValueFrom; ref == nil || ref.FieldRef == nil || ref.FieldRef.FieldPath != "status.podIP" {
+		t.Errorf("unexpected POD_IP source %+v", ref)
+	}
+	if len(container.EnvFrom) != 2 || container.EnvFrom[0].SecretRef == nil || container.EnvFrom[0].SecretRef.Name != "alice-creds" ||
+		container.EnvFrom[1].Prefix != "CFG_" || container.EnvFrom[1].ConfigMapRef == nil || container.EnvFrom[1].ConfigMapRef.Name != "defaults" {
+		t.Errorf("unexpected envFrom %+v", container.EnvFrom)
+	}
+}
+
+// 70. TestRenderDeployment_Scheduling - node selector, tolerations, affinity, spread and priority render on the pod
+func TestRenderDeployment_Scheduling(t *testing.T) {
+	ensureTemplates(t)
+
+	system := System{
+		AppName:      "gpu-app",
+		InstanceName: "gpu-instance",
+		UUID:         "test-uuid-scheduling",
+		Containers:   []Container{},
+		Volumes:      map[string]Volume{},
+		NodeSelector: map[string]string{"node.kubernetes.io/pool": "gpu"},
+		Tolerations: []corev1.Toleration{
+			{Key: "nvidia.com/gpu", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule},
+		},
+		Affinity: &corev1.Affinity{
+			NodeAffinity: &corev1.NodeAffinity{
+				RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+					NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+						MatchExpressions: []corev1.NodeSelectorRequirement{{Key: "gpu-type", Operator: corev1.NodeSelectorOpIn, Values: []string{"a100"}}},
+					}},
+				},
+			},
+		},
+		TopologySpreadConstraints: []corev1.TopologySpreadConstraint{
+			{MaxSkew: 1, TopologyKey: "topology.kubernetes.io/zone", WhenUnsatisfiable: corev1.ScheduleAnyway},
+		},
+		PriorityClassName: "interactive",
+	}
+	result, err := RenderGoTemplate(testTemplate, "deployment", map[string]interface{}{"system": system})
+	if err != nil {
+		t.Fatalf("RenderGoTemplate error: %v", err)
+	}
+	deployment := &appsv1.Deployment{}
+	if err := yaml.UnmarshalStrict([]byte(result), deployment); err != nil {
+		t.Fatalf("unable to parse deployment: %v\n%s", err, result)
+	}
+	podSpec := deployment.Spec.Template.Spec
+	if podSpec.NodeSelector["node.kubernetes.io/pool"] != "gpu" || podSpec.PriorityClassName != "interactive" {
+		t.Errorf("unexpected node selector %v or priority class %q", podSpec.NodeSelector, podSpec.PriorityClassName)
+	}
+	if len(podSpec.Tolerations) != 1 || podSpec.Tolerations[0].Key != "nvidia.com/gpu" || podSpec.Tolerations[0].Operator != corev1.TolerationOpExists {
+		t.Errorf("unexpected tolerations %+v", podSpec.Tolerations)
+	}
+	if podSpec.Affinity == nil || podSpec.Affinity.NodeAffinity == nil ||
+		podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[0].Values[0] != "a100" {
+		t.Errorf("unexpected affinity %+v", podSpec.Affinity)
+	}
+	if len(podSpec.TopologySpreadConstraints) != 1 || podSpec.TopologySpreadConstraints[0].WhenUnsatisfiable != corev1.ScheduleAnyway {
+		t.Errorf("unexpected spread constraints %+v", podSpec.TopologySpreadConstraints)
+	}
+}
+
+// 71. TestRenderServiceTemplate_Types - Headless, NodePort and LoadBalancer Services with UDP and appProtocol ports
+func TestRenderServiceTemplate_Types(t *testing.T) {
+	ensureTemplates(t)
+
+	system := System{AppName: "types-app", InstanceName: "types-instance", UUID: "test-uuid-types"}
+	for _, tc := range []struct {
+		serviceType string
+		kind        corev1.ServiceType
+		clusterIP   string
+	}{
+		{"", corev1.ServiceTypeClusterIP, ""},
+		{"Headless", corev1.ServiceTypeClusterIP, "None"},
+		{"NodePort", corev1.ServiceTypeNodePort, ""},
+		{"LoadBalancer", corev1.ServiceTypeLoadBalancer, ""},
+	} {
+		container := Container{
+			Name:        "connect",
+			HasService:  true,
+			ServiceType: tc.serviceType,
+			Ports: []PortMap{
+				{Name: "http", ContainerPort: 3939, Port: 80, Protocol: "TCP", AppProtocol: "http"},
+				{Name: "udp-5900", ContainerPort: 5900, Port: 5900, Protocol: "UDP"},
+			},
+		}
+		result, err := RenderGoTemplate(testTemplate, "service", map[string]interface{}{"system": system, "container": container})
+		if err != nil {
+			t.Fatalf("RenderGoTemplate error: %v", err)
+		}
+		service := &corev1.Service{}
+		if err := yaml.UnmarshalStrict([]byte(result), service); err != nil {
+			t.Fatalf("unable to parse service: %v\n%s", err, result)
+		}
+		if service.Spec.Type != tc.kind || service.Spec.ClusterIP != tc.clusterIP {
+			t.Errorf("%q: expected type %s and clusterIP %q, got %s %q", tc.serviceType, tc.kind, tc.clusterIP, service.Spec.Type, service.Spec.ClusterIP)
+		}
+		ports := service.Spec.Ports
+		if len(ports) != 2 || ports[0].AppProtocol == nil || *ports[0].AppProtocol != "http" || ports[1].Protocol != corev1.ProtocolUDP || ports[1].AppProtocol != nil {
+			t.Errorf("%q: unexpected ports %+v", tc.serviceType, ports)
+		}
+	}
+}
+
+// 73. TestToYamlError - a value toYaml cannot marshal fails the render instead of rendering nothing
+func TestToYamlError(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(dir+"/yaml.tmpl", []byte(`{{- define "yaml" }}tolerations: {{ toYaml .value }}{{- end }}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, _, err := ParseTemplates(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result, err := RenderGoTemplate(tmpl, "yaml", map[string]interface{}{"value": []string{"a"}}); err != nil || result != "tolerations: - a" {
+		t.Errorf("unexpected render %q, %v", result, err)
+	}
+	if _, err := RenderGoTemplate(tmpl, "yaml", map[string]interface{}{"value": make(chan int)}); err == nil {
+		t.Error("expected an unmarshalable value to fail the render")
+	}
+}
+
+// 72. TestRenderIngressTemplate - an Ingress and an HTTPRoute routing a host and path to a Service port
+func TestRenderIngressTemplate(t *testing.T) {
+	ensureTemplates(t)
+
+	system := System{AppName: "route-app", InstanceName: "route-instance", UUID: "test-uuid-route"}
+	route := Route{
+		Name:             "jupyter-http-test-uuid-route",
+		Kind:             "Ingress",
+		Container:        "jupyter",
+		ServiceName:      "jupyter-test-uuid-route",
+		PortName:         "http",
+		Port:             80,
+		Host:             "apps.example.org",
+		Path:             "/private/route-app/alice/test-uuid-route",
+		IngressClassName: "nginx",
+		Annotations:      map[string]string{"nginx.ingress.kubernetes.io/proxy-body-size": "0"},
+		TLSSecretName:    "apps-tls",
+	}
+	result, err := RenderGoTemplate(testTemplate, "ingress", map[string]interface{}{"system": system, "route": route})
+	if err != nil {
+		t.Fatalf("RenderGoTemplate error: %v", err)
+	}
+	ingress := &networkingv1.Ingress{}
+	if err := yaml.UnmarshalStrict([]byte(result), ingress); err != nil {
+		t.Fatalf("unable to parse ingress: %v\n%s", err, result)
+	}
+	if ingress.Kind != "Ingress" || ingress.Name != route.Name || ingress.Labels["helx.renci.org/id"] != system.UUID || ingress.Annotations["nginx.ingress.kubernetes.io/proxy-body-size"] != "0" {
+		t.Errorf("unexpected ingress metadata %+v", ingress.ObjectMeta)
+	}
+	if ingress.Spec.IngressClassName == nil || *ingress.Spec.IngressClassName != "nginx" || len(ingress.Spec.TLS) != 1 || ingress.Spec.TLS[0].SecretName != "apps-tls" {
+		t.Errorf("unexpected ingress class or tls %+v", ingress.Spec)
+	}
+	rules := ingress.Spec.Rules
+	if len(rules) != 1 || rules[0].Host != route.Host || len(rules[0].HTTP.Paths) != 1 {
+		t.Fatalf("unexpected rules %+v", rules)
+	}
+	path := rules[0].HTTP.Paths[0]
+	if path.Path != route.Path || path.Backend.Service.Name != route.ServiceName || path.Backend.Service.Port.Name != "http" {
+		t.Errorf("unexpected path %+v", path)
+	}
+
+	route.Kind = "HTTPRoute"
+	route.Gateway = &GatewayRef{Name: "helx-gateway", Namespace: "gateway"}
+	result, err = RenderGoTemplate(testTemplate, "ingress", map[string]interface{}{"system": system, "route": route})
+	if err != nil {
+		t.Fatalf("RenderGoTemplate error: %v", err)
+	}
+	var httpRoute struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		Spec       struct {
+			ParentRefs []map[string]string `json:"parentRefs"`
+			Hostnames  []string            `json:"hostnames"`
+			Rules      []struct {
+				Matches []struct {
+					Path map[string]string `json:"path"`
+				} `json:"matches"`
+				BackendRefs []struct {
+					Name string `json:"name"`
+					Port int    `json:"port"`
+				} `json:"backendRefs"`
+			} `json:"rules"`
+		} `json:"spec"`
+	}
+	if err := yaml.Unmarshal([]byte(result), &httpRoute); err != nil {
+		t.Fatalf("unable to parse httproute: %v\n%s", err, result)
+	}
+	if httpRoute.APIVersion != "gateway.networking.k8s.io/v1" || httpRoute.Kind != "HTTPRoute" {
+		t.Errorf("unexpected type %s %s", httpRoute.APIVersion, httpRoute.Kind)
+	}
+	spec := httpRoute.Spec
+	if len(spec.ParentRefs) != 1 || spec.ParentRefs[0]["name"] != "helx-gateway" || spec.ParentRefs[0]["namespace"] != "gateway" {
+		t.Errorf("unexpected parentRefs %v", spec.ParentRefs)
+	}
+	if len(spec.Hostnames) != 1 || spec.Hostnames[0] != route.Host || len(spec.Rules) != 1 || len(spec.Rules[0].Matches) != 1 || len(spec.Rules[0].BackendRefs) != 1 {
+		t.Fatalf("unexpected spec %+v", spec)
+	}
+	if match := spec.Rules[0].Matches[0].Path; match["type"] != "PathPrefix" || match["value"] != route.Path {
+		t.Errorf("unexpected match %v", match)
+	}
+	if backend := spec.Rules[0].BackendRefs[0]; backend.Name != route.ServiceName || backend.Port != 80 {
+		t.Errorf("unexpected backend %+v", backend)
+	}
+}
+
 // --- Tests for previously uncovered functions ---
 
 // TestStore_NewKey - store into a map with a new key creates a new slice
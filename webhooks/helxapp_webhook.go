@@ -0,0 +1,76 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+
+	helxv1 "github.com/helxplatform/helxapp-controller/api/v1"
+	"github.com/helxplatform/helxapp-controller/helxapp_operations"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+//+kubebuilder:webhook:path=/validate-helx-renci-org-v1-helxapp,mutating=false,failurePolicy=fail,sideEffects=None,groups=helx.renci.org,resources=helxapps,verbs=create;update,versions=v1,name=vhelxapp.kb.io,admissionReviewVersions=v1
+
+// HelxAppValidator rejects HelxApps whose services would fail to render,
+// so a bad volume string or port is reported to whoever applies the app
+// rather than only on its status.
+type HelxAppValidator struct {
+	// AllowedServiceTypes is the controller's allowlist; nil allows
+	// helxapp_operations.DefaultServiceTypes
+	AllowedServiceTypes []helxv1.ServiceType
+}
+
+// SetupWebhookWithManager registers the validator with the manager's
+// webhook server.
+func (v *HelxAppValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&helxv1.HelxApp{}).
+		WithValidator(v).
+		Complete()
+}
+
+// ValidateCreate checks a new HelxApp.
+func (v *HelxAppValidator) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	return v.validate(obj)
+}
+
+// ValidateUpdate checks the updated HelxApp when its spec changed. Updates
+// that leave the spec alone, such as the controller adding or removing its
+// finalizer, and updates to an app being deleted are admitted, so an app
+// stored before it became invalid can still be finalized.
+func (v *HelxAppValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	oldApp, ok := oldObj.(*helxv1.HelxApp)
+	if !ok {
+		return fmt.Errorf("expected a HelxApp but got a %T", oldObj)
+	}
+	newApp, ok := newObj.(*helxv1.HelxApp)
+	if !ok {
+		return fmt.Errorf("expected a HelxApp but got a %T", newObj)
+	}
+	if newApp.DeletionTimestamp != nil || equality.Semantic.DeepEqual(oldApp.Spec, newApp.Spec) {
+		return nil
+	}
+	return v.validate(newObj)
+}
+
+// ValidateDelete allows every deletion; bound instances are handled by the
+// HelxApp finalizer.
+func (v *HelxAppValidator) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	return nil
+}
+
+func (v *HelxAppValidator) validate(obj runtime.Object) error {
+	app, ok := obj.(*helxv1.HelxApp)
+	if !ok {
+		return fmt.Errorf("expected a HelxApp but got a %T", obj)
+	}
+	errs := helxapp_operations.ValidateAppSpec(app)
+	errs = append(errs, helxapp_operations.ValidateServiceTypes(app, v.AllowedServiceTypes)...)
+	if len(errs) != 0 {
+		return apierrors.NewInvalid(helxv1.GroupVersion.WithKind("HelxApp").GroupKind(), app.Name, errs)
+	}
+	return nil
+}
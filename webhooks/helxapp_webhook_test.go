@@ -0,0 +1,106 @@
+package webhooks
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	helxv1 "github.com/helxplatform/helxapp-controller/api/v1"
+	"github.com/helxplatform/helxapp-controller/helxapp_operations"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func makeApp(services ...helxv1.Service) *helxv1.HelxApp {
+	return &helxv1.HelxApp{
+		ObjectMeta: metav1.ObjectMeta{Name: "notebook", Namespace: "ns"},
+		Spec:       helxv1.HelxAppSpec{AppClassName: "Jupyter", Services: services},
+	}
+}
+
+func TestHelxAppValidator_Valid(t *testing.T) {
+	v := &HelxAppValidator{}
+	app := makeApp(helxv1.Service{
+		Name:    "jupyter",
+		Image:   "jupyter/base-notebook,Always",
+		Ports:   []helxv1.PortMap{{ContainerPort: 8888, Port: 8888}},
+		Volumes: map[string]string{"home": "{{ .system.UserName }}-home:/home/jovyan"},
+	})
+	if err := v.ValidateCreate(context.Background(), app); err != nil {
+		t.Errorf("expected a valid app, got %v", err)
+	}
+	if err := v.ValidateUpdate(context.Background(), app, app); err != nil {
+		t.Errorf("expected a valid update, got %v", err)
+	}
+}
+
+func TestHelxAppValidator_Invalid(t *testing.T) {
+	v := &HelxAppValidator{}
+	app := makeApp(
+		helxv1.Service{Name: "jupyter", Image: "jupyter/base-notebook", Ports: []helxv1.PortMap{{ContainerPort: 8888}}},
+		helxv1.Service{Name: "jupyter", Image: "sidecar", Volumes: map[string]string{"data": "nfs://server:/mnt"}},
+	)
+
+	err := v.ValidateCreate(context.Background(), app)
+	if !apierrors.IsInvalid(err) {
+		t.Fatalf("expected an Invalid error, got %v", err)
+	}
+	for _, path := range []string{"spec.services[1].name", "spec.services[1].volumes[data]"} {
+		if !strings.Contains(err.Error(), path) {
+			t.Errorf("expected %s in %q", path, err.Error())
+		}
+	}
+	if err := v.ValidateUpdate(context.Background(), makeApp(), app); !apierrors.IsInvalid(err) {
+		t.Errorf("expected the update to be rejected, got %v", err)
+	}
+	if err := v.ValidateDelete(context.Background(), app); err != nil {
+		t.Errorf("expected deletes to be allowed, got %v", err)
+	}
+}
+
+func TestHelxAppValidator_UnchangedSpec(t *testing.T) {
+	v := &HelxAppValidator{}
+	app := makeApp(helxv1.Service{Name: "jupyter", Image: "jupyter/base-notebook", ServiceType: helxv1.ServiceTypeNodePort})
+	if err := v.ValidateCreate(context.Background(), app); !apierrors.IsInvalid(err) {
+		t.Fatalf("expected an Invalid error, got %v", err)
+	}
+
+	finalized := app.DeepCopy()
+	finalized.Finalizers = []string{helxapp_operations.Finalizer}
+	if err := v.ValidateUpdate(context.Background(), app, finalized); err != nil {
+		t.Errorf("expected a finalizer-only update to be admitted, got %v", err)
+	}
+
+	deleting := finalized.DeepCopy()
+	deleting.Finalizers = nil
+	deleting.Spec.Services[0].Image = "jupyter/minimal-notebook"
+	now := metav1.Now()
+	deleting.DeletionTimestamp = &now
+	if err := v.ValidateUpdate(context.Background(), finalized, deleting); err != nil {
+		t.Errorf("expected an update to a deleted app to be admitted, got %v", err)
+	}
+
+	changed := finalized.DeepCopy()
+	changed.Spec.Services[0].Image = "jupyter/minimal-notebook"
+	if err := v.ValidateUpdate(context.Background(), finalized, changed); !apierrors.IsInvalid(err) {
+		t.Errorf("expected a spec change to be validated, got %v", err)
+	}
+}
+
+func TestHelxAppValidator_ServiceTypes(t *testing.T) {
+	app := makeApp(helxv1.Service{
+		Name:        "vnc",
+		Image:       "vnc-server",
+		Ports:       []helxv1.PortMap{{ContainerPort: 5900, Port: 5900, Protocol: "UDP"}},
+		ServiceType: helxv1.ServiceTypeNodePort,
+	})
+	err := (&HelxAppValidator{}).ValidateCreate(context.Background(), app)
+	if !apierrors.IsInvalid(err) || !strings.Contains(err.Error(), `spec.services[0].serviceType: Unsupported value: "NodePort"`) {
+		t.Errorf("expected NodePort to be refused by default, got %v", err)
+	}
+
+	v := &HelxAppValidator{AllowedServiceTypes: []helxv1.ServiceType{helxv1.ServiceTypeClusterIP, helxv1.ServiceTypeNodePort}}
+	if err := v.ValidateCreate(context.Background(), app); err != nil {
+		t.Errorf("expected NodePort to be allowed, got %v", err)
+	}
+}
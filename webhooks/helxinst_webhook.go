@@ -0,0 +1,78 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/google/uuid"
+	helxv1 "github.com/helxplatform/helxapp-controller/api/v1"
+	"github.com/helxplatform/helxapp-controller/helxapp_operations"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+//+kubebuilder:webhook:path=/mutate-helx-renci-org-v1-helxinst,mutating=true,failurePolicy=fail,sideEffects=None,groups=helx.renci.org,resources=helxinsts,verbs=create;update,versions=v1,name=mhelxinst.kb.io,admissionReviewVersions=v1
+
+// HelxInstDefaulter fills in what a HelxInst leaves out, so the stored object
+// says which app and user it is bound to, what it requests and which UUID its
+// derived objects carry, whatever happens to the app later.
+type HelxInstDefaulter struct {
+	Client client.Client
+}
+
+// SetupWebhookWithManager registers the defaulter with the manager's webhook
+// server.
+func (d *HelxInstDefaulter) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&helxv1.HelxInst{}).
+		WithDefaulter(d).
+		Complete()
+}
+
+// Default qualifies appName and userName with the instance namespace, fills
+// missing requests and limits from the HelxApp resourceBounds, and assigns
+// the UUID as the helx.renci.org/id label. An app that does not exist yet,
+// or an instance that picks a hardware profile, leaves the resources alone.
+func (d *HelxInstDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	inst, ok := obj.(*helxv1.HelxInst)
+	if !ok {
+		return fmt.Errorf("expected a HelxInst but got a %T", obj)
+	}
+	if inst.Namespace == "" {
+		// the namespace may only be given in the request URL
+		if req, err := admission.RequestFromContext(ctx); err == nil {
+			inst.Namespace = req.Namespace
+		}
+	}
+
+	inst.Spec.AppName = helxapp_operations.GetAppNameFromInst(inst)
+	inst.Spec.UserName = helxapp_operations.GetUserNameFromInst(inst)
+
+	if inst.Spec.AppName != "" {
+		app, err := helxapp_operations.GetApp(ctx, d.Client, inst.Spec.AppName)
+		if err != nil {
+			return err
+		}
+		// a profile supplies the resources, so the instance is left alone
+		if app != nil && inst.Spec.Profile == "" {
+			if resources := helxapp_operations.DefaultResources(inst, app); len(resources) != 0 {
+				inst.Spec.Resources = resources
+			}
+		}
+	}
+
+	id := inst.Status.UUID
+	if id == "" {
+		id = inst.Labels[helxapp_operations.IDLabel]
+	}
+	if id == "" {
+		id = uuid.New().String()
+	}
+	if inst.Labels == nil {
+		inst.Labels = make(map[string]string)
+	}
+	inst.Labels[helxapp_operations.IDLabel] = id
+	return nil
+}
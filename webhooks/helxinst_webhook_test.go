@@ -0,0 +1,110 @@
+package webhooks
+
+import (
+	"context"
+	"testing"
+
+	helxv1 "github.com/helxplatform/helxapp-controller/api/v1"
+	"github.com/helxplatform/helxapp-controller/helxapp_operations"
+	admissionv1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newDefaulter(objs ...client.Object) *HelxInstDefaulter {
+	scheme := runtime.NewScheme()
+	_ = helxv1.AddToScheme(scheme)
+	return &HelxInstDefaulter{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()}
+}
+
+func makeInst(appName, userName string) *helxv1.HelxInst {
+	return &helxv1.HelxInst{
+		ObjectMeta: metav1.ObjectMeta{Name: "inst1", Namespace: "ns"},
+		Spec:       helxv1.HelxInstSpec{AppName: appName, UserName: userName},
+	}
+}
+
+func TestHelxInstDefaulter_Names(t *testing.T) {
+	d := newDefaulter()
+	inst := makeInst("notebook", "other/alice")
+	if err := d.Default(context.Background(), inst); err != nil {
+		t.Fatal(err)
+	}
+	if inst.Spec.AppName != "ns/notebook" || inst.Spec.UserName != "other/alice" {
+		t.Errorf("unexpected names %q %q", inst.Spec.AppName, inst.Spec.UserName)
+	}
+
+	// the namespace may only be in the request
+	inst = makeInst("notebook", "alice")
+	inst.Namespace = ""
+	ctx := admission.NewContextWithRequest(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{Namespace: "team"}})
+	if err := d.Default(ctx, inst); err != nil {
+		t.Fatal(err)
+	}
+	if inst.Spec.AppName != "team/notebook" || inst.Spec.UserName != "team/alice" {
+		t.Errorf("unexpected names %q %q", inst.Spec.AppName, inst.Spec.UserName)
+	}
+}
+
+func TestHelxInstDefaulter_Resources(t *testing.T) {
+	app := makeApp(helxv1.Service{
+		Name:           "jupyter",
+		Image:          "jupyter/base-notebook",
+		ResourceBounds: map[string]helxv1.ResourceBoundary{"cpu": {Min: "500m", Max: "2"}},
+	})
+	d := newDefaulter(app)
+
+	inst := makeInst("notebook", "alice")
+	inst.Spec.Resources = map[string]helxv1.Resources{"jupyter": {Requests: map[string]string{"cpu": "1"}}}
+	if err := d.Default(context.Background(), inst); err != nil {
+		t.Fatal(err)
+	}
+	jupyter := inst.Spec.Resources["jupyter"]
+	if jupyter.Requests["cpu"] != "1" || jupyter.Limits["cpu"] != "2" {
+		t.Errorf("expected only the missing limit to be defaulted, got %+v", jupyter)
+	}
+
+	// an app that does not exist yet leaves the resources alone
+	inst = makeInst("missing", "alice")
+	if err := d.Default(context.Background(), inst); err != nil {
+		t.Fatal(err)
+	}
+	if inst.Spec.Resources != nil {
+		t.Errorf("expected no resources, got %v", inst.Spec.Resources)
+	}
+
+	// a profile supplies the resources
+	inst = makeInst("notebook", "alice")
+	inst.Spec.Profile = "small"
+	if err := d.Default(context.Background(), inst); err != nil {
+		t.Fatal(err)
+	}
+	if inst.Spec.Resources != nil {
+		t.Errorf("expected no resources with a profile, got %v", inst.Spec.Resources)
+	}
+}
+
+func TestHelxInstDefaulter_UUID(t *testing.T) {
+	d := newDefaulter()
+	inst := makeInst("notebook", "alice")
+	if err := d.Default(context.Background(), inst); err != nil {
+		t.Fatal(err)
+	}
+	id := inst.Labels[helxapp_operations.IDLabel]
+	if id == "" {
+		t.Fatal("expected a UUID label")
+	}
+
+	// the label is stable across updates, and restored from the status
+	if err := d.Default(context.Background(), inst); err != nil || inst.Labels[helxapp_operations.IDLabel] != id {
+		t.Errorf("expected the UUID to be kept, got %q %v", inst.Labels[helxapp_operations.IDLabel], err)
+	}
+	inst.Labels = nil
+	inst.Status.UUID = "assigned-uuid"
+	if err := d.Default(context.Background(), inst); err != nil || inst.Labels[helxapp_operations.IDLabel] != "assigned-uuid" {
+		t.Errorf("expected the status UUID, got %q %v", inst.Labels[helxapp_operations.IDLabel], err)
+	}
+}